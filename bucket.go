@@ -4,8 +4,10 @@ import (
 	"context"
 	"fmt"
 	"runtime"
+	"strings"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/cenkalti/backoff/v3"
@@ -16,6 +18,7 @@ type S3Bucket struct {
 	s3Client             *s3.S3
 	bucketName           string
 	serverSideEncryption string
+	enrichmentCache      *EnrichmentCache
 }
 
 func NewS3Bucket(sess *session.Session, bucketName string, serverSideEncryption string) *S3Bucket {
@@ -27,7 +30,15 @@ func NewS3Bucket(sess *session.Session, bucketName string, serverSideEncryption
 	}
 }
 
-func (l *S3Bucket) UpdateObjectsWithTags(ctx context.Context, items []Object) error {
+// SetEnrichmentCache sets a cache to consult before fetching tags or
+// metadata, and to record them in afterwards.
+func (l *S3Bucket) SetEnrichmentCache(cache *EnrichmentCache) {
+	l.enrichmentCache = cache
+}
+
+// UpdateObjectsWithTags fetches the tags for each of items included by
+// filter, or every item if filter is nil.
+func (l *S3Bucket) UpdateObjectsWithTags(ctx context.Context, items []Object, filter PathFilter) error {
 	maxWorkers := runtime.GOMAXPROCS(0)
 
 	eg := errgroup.Group{}
@@ -37,6 +48,17 @@ func (l *S3Bucket) UpdateObjectsWithTags(ctx context.Context, items []Object) er
 		idx := index
 		obj := o
 
+		if filter != nil && !filter.Include(obj.Key()) {
+			continue
+		}
+
+		if l.enrichmentCache != nil {
+			if tags, ok := l.enrichmentCache.Tags(obj); ok {
+				items[idx].SetTags(tags)
+				continue
+			}
+		}
+
 		eg.Go(func() error {
 			tags, err := l.fetchObjectTags(ctx, obj.Key())
 
@@ -46,6 +68,10 @@ func (l *S3Bucket) UpdateObjectsWithTags(ctx context.Context, items []Object) er
 
 			items[idx].SetTags(tags)
 
+			if l.enrichmentCache != nil {
+				l.enrichmentCache.SetTags(obj, tags)
+			}
+
 			return nil
 		})
 	}
@@ -55,40 +81,147 @@ func (l *S3Bucket) UpdateObjectsWithTags(ctx context.Context, items []Object) er
 	return err
 }
 
-func (l *S3Bucket) ListObjectsWithTags(ctx context.Context, prefix string) ([]Object, error) {
-	items, err := l.ListObjects(ctx, prefix)
-	if err != nil {
-		return items, fmt.Errorf("error listing objects: %w", err)
+// TagEnricher returns an ObjectEnricherFunc that fetches tags for the objects
+// included by filter.
+func (l *S3Bucket) TagEnricher(filter PathFilter) ObjectEnricherFunc {
+	return func(ctx context.Context, objects []Object) error {
+		return l.UpdateObjectsWithTags(ctx, objects, filter)
+	}
+}
+
+// UpdateObjectsWithMetadata calls HeadObject for each of items included by
+// filter, or every item if filter is nil, and sets its metadata.
+func (l *S3Bucket) UpdateObjectsWithMetadata(ctx context.Context, items []Object, filter PathFilter) error {
+	maxWorkers := runtime.GOMAXPROCS(0)
+
+	eg := errgroup.Group{}
+	eg.SetLimit(maxWorkers)
+
+	for index, o := range items {
+		idx := index
+		obj := o
+
+		if filter != nil && !filter.Include(obj.Key()) {
+			continue
+		}
+
+		if l.enrichmentCache != nil {
+			if metadata, ok := l.enrichmentCache.Metadata(obj); ok {
+				items[idx].SetMetadata(metadata)
+				continue
+			}
+		}
+
+		eg.Go(func() error {
+			metadata, err := l.fetchObjectMetadata(ctx, obj.Key())
+
+			if err != nil {
+				return fmt.Errorf("error fetching metadata for %v: %w", obj.Key(), err)
+			}
+
+			items[idx].SetMetadata(metadata)
+
+			if l.enrichmentCache != nil {
+				l.enrichmentCache.SetMetadata(obj, metadata)
+			}
+
+			return nil
+		})
 	}
 
-	err = l.UpdateObjectsWithTags(ctx, items)
+	err := eg.Wait()
 
-	return items, err
+	return err
 }
 
-func (l *S3Bucket) ListObjects(ctx context.Context, prefix string) ([]Object, error) {
-	objInput := s3.ListObjectsInput{
-		Bucket: &l.bucketName,
-		Prefix: &prefix,
+// MetadataEnricher returns an ObjectEnricherFunc that fetches metadata for
+// the objects included by filter.
+func (l *S3Bucket) MetadataEnricher(filter PathFilter) ObjectEnricherFunc {
+	return func(ctx context.Context, objects []Object) error {
+		return l.UpdateObjectsWithMetadata(ctx, objects, filter)
 	}
+}
 
-	items := make([]Object, 0)
+func (l *S3Bucket) ListObjectsWithTags(ctx context.Context, prefix string) ([]Object, error) {
+	return CollectPages(l.ListObjectPagesWithTags)(ctx, prefix)
+}
 
-	err := l.s3Client.ListObjectsPagesWithContext(ctx, &objInput, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+func (l *S3Bucket) ListObjects(ctx context.Context, prefix string) ([]Object, error) {
+	return CollectPages(l.ListObjectPages)(ctx, prefix)
+}
+
+// ListObjectPages lists the objects under prefix, passing each page to fn as
+// it arrives.
+func (l *S3Bucket) ListObjectPages(ctx context.Context, prefix string, fn ObjectPageFunc) error {
+	fetchOwner := true
+	objInput := s3.ListObjectsV2Input{
+		Bucket:     &l.bucketName,
+		Prefix:     &prefix,
+		FetchOwner: &fetchOwner,
+	}
+
+	var pageErr error
+	err := l.s3Client.ListObjectsV2PagesWithContext(ctx, &objInput, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
 		localItems := make([]Object, len(page.Contents))
 		for i, o := range page.Contents {
 			localItems[i] = NewObject(o)
 		}
-		items = append(items, localItems...)
+
+		pageErr = fn(localItems)
+
+		return pageErr == nil
+	})
+
+	if pageErr != nil {
+		return pageErr
+	}
+
+	if err != nil {
+		return fmt.Errorf("error listing objects: %w", err)
+	}
+
+	return nil
+}
+
+// ListObjectPagesWithTags lists the objects under prefix, fetching the tags
+// for each page before passing it to fn.
+func (l *S3Bucket) ListObjectPagesWithTags(ctx context.Context, prefix string, fn ObjectPageFunc) error {
+	return EnrichedPageLister(l.ListObjectPages, l.TagEnricher(nil))(ctx, prefix, fn)
+}
+
+// ListDirectory lists the objects directly within prefix, along with the
+// common prefixes of any sub-directories.
+func (l *S3Bucket) ListDirectory(ctx context.Context, prefix string) ([]Object, []string, error) {
+	delimiter := "/"
+	fetchOwner := true
+	objInput := s3.ListObjectsV2Input{
+		Bucket:     &l.bucketName,
+		Prefix:     &prefix,
+		Delimiter:  &delimiter,
+		FetchOwner: &fetchOwner,
+	}
+
+	items := make([]Object, 0)
+	commonPrefixes := make([]string, 0)
+
+	err := l.s3Client.ListObjectsV2PagesWithContext(ctx, &objInput, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, o := range page.Contents {
+			items = append(items, NewObject(o))
+		}
+		for _, p := range page.CommonPrefixes {
+			if p.Prefix != nil {
+				commonPrefixes = append(commonPrefixes, *p.Prefix)
+			}
+		}
 
 		return true
 	})
 
 	if err != nil {
-		return items, fmt.Errorf("error listing objects: %v", err)
+		return items, commonPrefixes, fmt.Errorf("error listing directory %v: %w", prefix, err)
 	}
 
-	return items, nil
+	return items, commonPrefixes, nil
 }
 
 func (l *S3Bucket) fetchObjectTags(ctx context.Context, key string) (map[string]string, error) {
@@ -123,3 +256,47 @@ func fetchObjectTags(ctx context.Context, client *s3.S3, bucketName string, key
 
 	return tagMap, nil
 }
+
+func (l *S3Bucket) fetchObjectMetadata(ctx context.Context, key string) (ObjectMetadata, error) {
+	return fetchObjectMetadata(ctx, l.s3Client, l.bucketName, key)
+}
+
+func fetchObjectMetadata(ctx context.Context, client *s3.S3, bucketName string, key string) (ObjectMetadata, error) {
+	checksumMode := s3.ChecksumModeEnabled
+	headInput := s3.HeadObjectInput{
+		Bucket:       &bucketName,
+		Key:          &key,
+		ChecksumMode: &checksumMode,
+	}
+
+	retryBackoff := backoff.NewExponentialBackOff()
+	retryBackoff.MaxElapsedTime = 15 * time.Second
+
+	var head *s3.HeadObjectOutput
+	var err error
+
+	err = backoff.Retry(func() error {
+		head, err = client.HeadObjectWithContext(ctx, &headInput)
+		return err
+	}, retryBackoff)
+
+	if err != nil {
+		return ObjectMetadata{}, fmt.Errorf("error fetching metadata for %v: %w", key, err)
+	}
+
+	userMetadata := make(map[string]string)
+	for k, v := range head.Metadata {
+		if v != nil {
+			userMetadata[strings.ToLower(k)] = *v
+		}
+	}
+
+	return ObjectMetadata{
+		ContentType:    aws.StringValue(head.ContentType),
+		UserMetadata:   userMetadata,
+		ChecksumSHA256: aws.StringValue(head.ChecksumSHA256),
+		ChecksumSHA1:   aws.StringValue(head.ChecksumSHA1),
+		ChecksumCRC32:  aws.StringValue(head.ChecksumCRC32),
+		ChecksumCRC32C: aws.StringValue(head.ChecksumCRC32C),
+	}, nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/url"
+	"path"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	aferos3 "github.com/fclairamb/afero-s3"
+	"github.com/spf13/afero"
+)
+
+// EnrichmentCacheEntry holds the tags and metadata fetched for a particular
+// version of an object, identified by its ETag.
+type EnrichmentCacheEntry struct {
+	ETag     string            `json:"etag"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	Metadata *ObjectMetadata   `json:"metadata,omitempty"`
+}
+
+// EnrichmentCache caches the results of GetObjectTagging and HeadObject calls
+// keyed by object key and ETag, so that unchanged objects don't need to be
+// fetched again.
+type EnrichmentCache struct {
+	mu      sync.Mutex
+	entries map[string]*EnrichmentCacheEntry
+	seen    map[string]bool
+	hits    int
+	misses  int
+}
+
+func NewEnrichmentCache() *EnrichmentCache {
+	return &EnrichmentCache{
+		entries: make(map[string]*EnrichmentCacheEntry),
+		seen:    make(map[string]bool),
+	}
+}
+
+// LoadEnrichmentCache reads the cache from cachePath within cacheFS, returning
+// an empty cache if it doesn't exist yet.
+func LoadEnrichmentCache(cacheFS afero.Fs, cachePath string) (*EnrichmentCache, error) {
+	c := NewEnrichmentCache()
+
+	data, err := afero.ReadFile(cacheFS, cachePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read enrichment cache %v: %w", cachePath, err)
+	}
+
+	err = json.Unmarshal(data, &c.entries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse enrichment cache %v: %w", cachePath, err)
+	}
+
+	return c, nil
+}
+
+// Save writes the cache to cachePath within cacheFS. If prune is set, entries
+// for objects that weren't looked up since the cache was loaded are dropped.
+func (c *EnrichmentCache) Save(cacheFS afero.Fs, cachePath string, prune bool) error {
+	c.mu.Lock()
+	entries := c.entries
+	if prune {
+		entries = make(map[string]*EnrichmentCacheEntry)
+		for key, entry := range c.entries {
+			if c.seen[key] {
+				entries[key] = entry
+			}
+		}
+	}
+	data, err := json.Marshal(entries)
+	c.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("failed to encode enrichment cache: %w", err)
+	}
+
+	err = cacheFS.MkdirAll(path.Dir(cachePath), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create directory for enrichment cache %v: %w", cachePath, err)
+	}
+
+	err = afero.WriteFile(cacheFS, cachePath, data, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write enrichment cache %v: %w", cachePath, err)
+	}
+
+	return nil
+}
+
+// Stats returns the number of cache hits and misses.
+func (c *EnrichmentCache) Stats() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+// entry returns the entry for the current version of o, creating one if
+// create is set. Objects without an ETag can't be cached.
+func (c *EnrichmentCache) entry(o Object, create bool) *EnrichmentCacheEntry {
+	if o.ETag() == "" {
+		return nil
+	}
+
+	c.seen[o.Key()] = true
+
+	e, exists := c.entries[o.Key()]
+	if exists && e.ETag == o.ETag() {
+		return e
+	}
+
+	if !create {
+		return nil
+	}
+
+	e = &EnrichmentCacheEntry{ETag: o.ETag()}
+	c.entries[o.Key()] = e
+
+	return e
+}
+
+func (c *EnrichmentCache) record(hit bool) {
+	if hit {
+		c.hits++
+	} else {
+		c.misses++
+	}
+}
+
+// Tags returns the cached tags for the current version of o.
+func (c *EnrichmentCache) Tags(o Object) (map[string]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.entry(o, false)
+	hit := e != nil && e.Tags != nil
+	c.record(hit)
+	if !hit {
+		return nil, false
+	}
+	return e.Tags, true
+}
+
+func (c *EnrichmentCache) SetTags(o Object, tags map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e := c.entry(o, true); e != nil {
+		e.Tags = tags
+	}
+}
+
+// Metadata returns the cached metadata for the current version of o.
+func (c *EnrichmentCache) Metadata(o Object) (ObjectMetadata, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.entry(o, false)
+	hit := e != nil && e.Metadata != nil
+	c.record(hit)
+	if !hit {
+		return ObjectMetadata{}, false
+	}
+	return *e.Metadata, true
+}
+
+func (c *EnrichmentCache) SetMetadata(o Object, metadata ObjectMetadata) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e := c.entry(o, true); e != nil {
+		e.Metadata = &metadata
+	}
+}
+
+// enrichmentCacheFS returns the filesystem and path of the cache at cacheURL,
+// either an s3:// URL or a local path.
+func enrichmentCacheFS(sess *session.Session, cacheURL *url.URL) (afero.Fs, string) {
+	if cacheURL.Scheme == "s3" {
+		return aferos3.NewFs(cacheURL.Host, sess), cacheURL.Path
+	}
+	return afero.NewOsFs(), cacheURL.Path
+}
+
+// loadEnrichmentCache loads the cache configured by cfg, returning nil if no
+// cache is configured.
+func loadEnrichmentCache(sess *session.Session, cfg Config) (*EnrichmentCache, error) {
+	if cfg.EnrichmentCacheURL == nil {
+		return nil, nil
+	}
+
+	cacheFS, cachePath := enrichmentCacheFS(sess, cfg.EnrichmentCacheURL)
+
+	return LoadEnrichmentCache(cacheFS, cachePath)
+}
+
+func saveEnrichmentCache(sess *session.Session, cfg Config, cache *EnrichmentCache, prune bool) error {
+	if cache == nil {
+		return nil
+	}
+
+	hits, misses := cache.Stats()
+	log.Printf("EnrichmentCache: hits:%d misses:%d\n", hits, misses)
+
+	cacheFS, cachePath := enrichmentCacheFS(sess, cfg.EnrichmentCacheURL)
+
+	return cache.Save(cacheFS, cachePath, prune)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func objectWithETag(key, etag string) Object {
+	return NewObject(&s3.Object{Key: stringToPointer(key), ETag: stringToPointer(`"` + etag + `"`)})
+}
+
+func TestEnrichmentCache(t *testing.T) {
+	cache := NewEnrichmentCache()
+
+	o := objectWithETag("a/fileA", "etag-1")
+	if _, ok := cache.Tags(o); ok {
+		t.Fatalf("expected cache miss")
+	}
+
+	cache.SetTags(o, map[string]string{"key": "value"})
+	cache.SetMetadata(o, ObjectMetadata{ContentType: "application/zip"})
+
+	tags, ok := cache.Tags(o)
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{"key": "value"}, tags)
+
+	metadata, ok := cache.Metadata(o)
+	assert.True(t, ok)
+	assert.Equal(t, "application/zip", metadata.ContentType)
+
+	if _, ok := cache.Tags(objectWithETag("a/fileA", "etag-2")); ok {
+		t.Errorf("expected cache miss for changed ETag")
+	}
+
+	if _, ok := cache.Tags(simpleObject("a/fileA")); ok {
+		t.Errorf("expected cache miss for object without ETag")
+	}
+
+	hits, misses := cache.Stats()
+	assert.Equal(t, 2, hits)
+	assert.Equal(t, 3, misses)
+}
+
+func TestEnrichmentCacheSaveAndLoad(t *testing.T) {
+	cacheFS := afero.NewMemMapFs()
+
+	cache, err := LoadEnrichmentCache(cacheFS, "/cache/cache.json")
+	if err != nil {
+		t.Fatalf("LoadEnrichmentCache() error = %v", err)
+	}
+
+	cache.SetTags(objectWithETag("a/fileA", "etag-a"), map[string]string{"key": "a"})
+	cache.SetTags(objectWithETag("b/fileB", "etag-b"), map[string]string{"key": "b"})
+
+	err = cache.Save(cacheFS, "/cache/cache.json", false)
+	if err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	loaded, err := LoadEnrichmentCache(cacheFS, "/cache/cache.json")
+	if err != nil {
+		t.Fatalf("LoadEnrichmentCache() error = %v", err)
+	}
+
+	tags, ok := loaded.Tags(objectWithETag("a/fileA", "etag-a"))
+	assert.True(t, ok)
+	assert.Equal(t, "a", tags["key"])
+
+	// only a/fileA has been looked up since loading so b/fileB is pruned
+	err = loaded.Save(cacheFS, "/cache/cache.json", true)
+	if err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	pruned, err := LoadEnrichmentCache(cacheFS, "/cache/cache.json")
+	if err != nil {
+		t.Fatalf("LoadEnrichmentCache() error = %v", err)
+	}
+	assert.Len(t, pruned.entries, 1)
+}
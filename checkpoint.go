@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	lambdaservice "github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/spf13/afero"
+)
+
+var (
+	// checkpointFile records the directories left to render when a run
+	// stopped before its deadline
+	checkpointFile = "/.checkpoint.json"
+
+	DefaultDeadlineMargin = 10 * time.Second
+
+	// ResumeBatchSize is the most pending directories a run resumes, so that
+	// a large checkpoint is worked through over several runs rather than
+	// listed in one that never reaches rendering
+	ResumeBatchSize = 1000
+
+	errRenderCutoff = errors.New("render cutoff reached")
+)
+
+// Checkpoint records the directories a run didn't render before it stopped,
+// so a later run can resume rather than start over.
+type Checkpoint struct {
+	Job               string    `json:"job,omitempty"`
+	Bucket            string    `json:"bucket"`
+	DestinationPrefix string    `json:"destination_prefix"`
+	CreatedAt         time.Time `json:"created_at"`
+	Pending           []string  `json:"pending"`
+	// BatchSize is how many pending directories the next run resumes,
+	// halved each time a run stops without rendering any
+	BatchSize int `json:"batch_size,omitempty"`
+}
+
+// batchSize returns how many pending directories to resume from c.
+func (c *Checkpoint) batchSize() int {
+	if c.BatchSize > 0 {
+		return c.BatchSize
+	}
+	return ResumeBatchSize
+}
+
+// DeadlineError is returned when rendering stopped before the deadline with
+// directories still to render.
+type DeadlineError struct {
+	Pending []string
+	// Rendered is the number of directories rendered before stopping
+	Rendered int
+}
+
+func (e *DeadlineError) Error() string {
+	return fmt.Sprintf("stopped before deadline with %d directories still to render", len(e.Pending))
+}
+
+// LoadCheckpoint returns the checkpoint in outputFS, or nil if there isn't
+// one.
+func LoadCheckpoint(outputFS afero.Fs) (*Checkpoint, error) {
+	content, err := afero.ReadFile(outputFS, checkpointFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+
+	checkpoint := &Checkpoint{}
+	err = json.Unmarshal(content, checkpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint: %w", err)
+	}
+
+	return checkpoint, nil
+}
+
+// SaveCheckpoint writes checkpoint to outputFS.
+func SaveCheckpoint(outputFS afero.Fs, checkpoint *Checkpoint) error {
+	content, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	err = afero.WriteFile(outputFS, checkpointFile, content, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+
+	return nil
+}
+
+// RemoveCheckpoint removes any checkpoint from outputFS.
+func RemoveCheckpoint(outputFS afero.Fs) error {
+	_, err := RemoveFiles(outputFS, []string{checkpointFile})
+	return err
+}
+
+// renderCutoff returns the time by which rendering should stop to leave
+// cfg.DeadlineMargin before the deadline of ctx, or the zero time if it
+// shouldn't stop. Single page indexes and staged generations can't be
+// resumed part way through so are never cut off.
+func renderCutoff(ctx context.Context, cfg Config) time.Time {
+	deadline, ok := ctx.Deadline()
+	if !ok || cfg.DeadlineMargin <= 0 || cfg.IndexType == SinglePageIdentifier || cfg.StagedPublish {
+		return time.Time{}
+	}
+	return deadline.Add(-cfg.DeadlineMargin)
+}
+
+// cutoffWalker wraps a walker so that no more nodes are walked once cutoff
+// has passed, recording those that were.
+type cutoffWalker struct {
+	cutoff time.Time
+	walked map[string]bool
+	mu     sync.Mutex
+}
+
+func newCutoffWalker(cutoff time.Time) *cutoffWalker {
+	return &cutoffWalker{
+		cutoff: cutoff,
+		walked: make(map[string]bool),
+	}
+}
+
+func (w *cutoffWalker) wrap(walker ObjectTreeWalker) ObjectTreeWalker {
+	return func(node *ObjectTree) error {
+		if !w.cutoff.IsZero() && time.Now().After(w.cutoff) {
+			return errRenderCutoff
+		}
+
+		err := walker(node)
+		if err != nil {
+			return err
+		}
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.walked[node.FullPath] = true
+
+		return nil
+	}
+}
+
+// result returns err, or a *DeadlineError listing those of paths that weren't
+// walked if the walk was cut off.
+func (w *cutoffWalker) result(err error, paths []string) error {
+	if !errors.Is(err, errRenderCutoff) {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	pending := slices.DeleteFunc(slices.Clone(paths), func(p string) bool {
+		return w.walked[p]
+	})
+	slices.Sort(pending)
+
+	return &DeadlineError{Pending: pending, Rendered: len(w.walked)}
+}
+
+// listBefore calls list with a context that's cancelled at cutoff, returning
+// errRenderCutoff if list was still running then. A zero cutoff never stops.
+func listBefore(ctx context.Context, cutoff time.Time, list func(ctx context.Context) error) error {
+	if cutoff.IsZero() {
+		return list(ctx)
+	}
+
+	listCtx, cancel := context.WithDeadline(ctx, cutoff)
+	defer cancel()
+
+	err := list(listCtx)
+	if err != nil && listCtx.Err() != nil && ctx.Err() == nil {
+		return errRenderCutoff
+	}
+	return err
+}
+
+type resumeRequestKey struct{}
+
+// withResumeRequest returns ctx marked as resuming from a checkpoint, rather
+// than responding to changed keys or rebuilding in full.
+func withResumeRequest(ctx context.Context) context.Context {
+	return context.WithValue(ctx, resumeRequestKey{}, true)
+}
+
+func isResumeRequest(ctx context.Context) bool {
+	resume, _ := ctx.Value(resumeRequestKey{}).(bool)
+	return resume
+}
+
+// RenderObjectTreeIndexesBefore renders indexes as RenderObjectTreeIndexes
+// does, but stops once cutoff passes and returns a *DeadlineError listing
+// the directories still to render. A zero cutoff never stops.
+func RenderObjectTreeIndexesBefore(cutoff time.Time, objectTree *ObjectTree, renderers IndexRenderers, destFS afero.Fs, recursive bool) error {
+	w := newCutoffWalker(cutoff)
+	err := objectTree.Walk(w.wrap(RenderWalker(destFS, renderers)), recursive, true)
+	if !errors.Is(err, errRenderCutoff) {
+		return err
+	}
+
+	paths, pathsErr := ObjectTreePaths(objectTree, recursive)
+	if pathsErr != nil {
+		return pathsErr
+	}
+
+	return w.result(err, paths)
+}
+
+// RenderObjectTreeIndexesForPathsBefore renders indexes as
+// RenderObjectTreeIndexesForPaths does, but stops once cutoff passes and
+// returns a *DeadlineError listing those of paths still to render.
+func RenderObjectTreeIndexesForPathsBefore(cutoff time.Time, objectTree *ObjectTree, renderers IndexRenderers, destFS afero.Fs, paths []string) error {
+	w := newCutoffWalker(cutoff)
+	err := WalkObjectTreePaths(objectTree, w.wrap(RenderWalker(destFS, renderers)), paths)
+	return w.result(err, paths)
+}
+
+var (
+	// ResumeEventSource is the source of the events the function sends
+	// itself to resume from a checkpoint
+	ResumeEventSource = "s3-index-generator"
+	ResumeDetailType  = "Resume Checkpoint"
+)
+
+// ResumeDetail is the detail of a resume event, identifying the job and
+// output whose checkpoint should be resumed.
+type ResumeDetail struct {
+	Job               string `json:"job,omitempty"`
+	Bucket            string `json:"bucket"`
+	DestinationPrefix string `json:"destination_prefix"`
+}
+
+// SyntheticResumeEvent returns the event sent to resume from checkpoint.
+func SyntheticResumeEvent(checkpoint *Checkpoint) (events.EventBridgeEvent, error) {
+	detail, err := json.Marshal(ResumeDetail{
+		Job:               checkpoint.Job,
+		Bucket:            checkpoint.Bucket,
+		DestinationPrefix: checkpoint.DestinationPrefix,
+	})
+	if err != nil {
+		return events.EventBridgeEvent{}, err
+	}
+
+	return events.EventBridgeEvent{
+		Version:    "0",
+		DetailType: ResumeDetailType,
+		Source:     ResumeEventSource,
+		Time:       time.Now().UTC(),
+		Detail:     detail,
+	}, nil
+}
+
+// ReinvokeFunction asynchronously invokes the running Lambda function with an
+// event resuming from checkpoint, using sess for the Lambda client.
+func ReinvokeFunction(ctx context.Context, sess *session.Session, checkpoint *Checkpoint) error {
+	if lambdacontext.FunctionName == "" {
+		return errors.New("not running as a Lambda function")
+	}
+
+	event, err := SyntheticResumeEvent(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	client := lambdaservice.New(sess)
+	_, err = client.InvokeWithContext(ctx, &lambdaservice.InvokeInput{
+		FunctionName:   aws.String(lambdacontext.FunctionName),
+		InvocationType: aws.String(lambdaservice.InvocationTypeEvent),
+		Payload:        payload,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to invoke %v: %w", lambdacontext.FunctionName, err)
+	}
+
+	return nil
+}
+
+// handleResumeEvent resumes the job named in event from the checkpoint left
+// in its output. There's nothing to do if the checkpoint has since been
+// cleared.
+func handleResumeEvent(ctx context.Context, jobs []Config, event events.EventBridgeEvent, regenerate RegenerateFunc) (*EventSummary, error) {
+	detail := ResumeDetail{}
+	err := json.Unmarshal(event.Detail, &detail)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %v detail: %w", event.DetailType, err)
+	}
+
+	summary := &EventSummary{
+		Regenerated: make([]*RegenerationTarget, 0),
+		Skipped:     make([]SkippedRecord, 0),
+	}
+
+	log.Printf("resume: job:%v bucket:%v prefix:%v\n", detail.Job, detail.Bucket, detail.DestinationPrefix)
+
+	i := slices.IndexFunc(jobs, func(cfg Config) bool {
+		return cfg.Name == detail.Job &&
+			(cfg.Bucket == "" || cfg.Bucket == detail.Bucket) &&
+			cfg.DestinationBucketPrefix == detail.DestinationPrefix
+	})
+	if i < 0 {
+		reason := "no job matches the checkpoint"
+		log.Printf("skipping: event:%v reason:%v\n", event.DetailType, reason)
+		summary.Skipped = append(summary.Skipped, SkippedRecord{EventName: event.DetailType, Reason: reason})
+		return summary, nil
+	}
+
+	cfg := jobs[i]
+	cfg.Bucket = detail.Bucket
+
+	target := &RegenerationTarget{
+		Job:               cfg.Name,
+		Bucket:            cfg.Bucket,
+		DestinationPrefix: cfg.DestinationBucketPrefix,
+		Keys:              make([]string, 0),
+	}
+	summary.Regenerated = append(summary.Regenerated, target)
+
+	err = regenerate(withResumeRequest(ctx), cfg, nil)
+	if err != nil {
+		target.Error = err.Error()
+		return summary, fmt.Errorf("failed to resume %v/%v: %w", target.Bucket, target.DestinationPrefix, err)
+	}
+
+	return summary, nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckpoint(t *testing.T) {
+	outputFS := NewMemoryOutputFS()
+
+	checkpoint, err := LoadCheckpoint(outputFS)
+	if err != nil {
+		t.Fatalf("LoadCheckpoint() error = %v", err)
+	}
+	assert.Nil(t, checkpoint)
+
+	saved := &Checkpoint{
+		Job:               "releases",
+		Bucket:            "bucket-a",
+		DestinationPrefix: "site",
+		CreatedAt:         time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC),
+		Pending:           []string{"/a", "/a/b"},
+	}
+	err = SaveCheckpoint(outputFS, saved)
+	if err != nil {
+		t.Fatalf("SaveCheckpoint() error = %v", err)
+	}
+
+	checkpoint, err = LoadCheckpoint(outputFS)
+	if err != nil {
+		t.Fatalf("LoadCheckpoint() error = %v", err)
+	}
+	assert.Equal(t, saved, checkpoint)
+
+	err = RemoveCheckpoint(outputFS)
+	if err != nil {
+		t.Fatalf("RemoveCheckpoint() error = %v", err)
+	}
+	exists, _ := afero.Exists(outputFS, checkpointFile)
+	assert.False(t, exists)
+}
+
+func TestRenderCutoff(t *testing.T) {
+	deadline := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+	withDeadline, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	tests := map[string]struct {
+		ctx    context.Context
+		cfg    Config
+		cutoff time.Time
+	}{
+		"deadline": {
+			ctx:    withDeadline,
+			cfg:    Config{IndexType: MultiPageIdentifier, DeadlineMargin: 10 * time.Second},
+			cutoff: deadline.Add(-10 * time.Second),
+		},
+		"no deadline": {
+			ctx: context.Background(),
+			cfg: Config{IndexType: MultiPageIdentifier, DeadlineMargin: 10 * time.Second},
+		},
+		"no margin": {
+			ctx: withDeadline,
+			cfg: Config{IndexType: MultiPageIdentifier},
+		},
+		"singlepage": {
+			ctx: withDeadline,
+			cfg: Config{IndexType: SinglePageIdentifier, DeadlineMargin: 10 * time.Second},
+		},
+		"staged": {
+			ctx: withDeadline,
+			cfg: Config{IndexType: MultiPageIdentifier, DeadlineMargin: 10 * time.Second, StagedPublish: true},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tt.cutoff, renderCutoff(tt.ctx, tt.cfg))
+		})
+	}
+}
+
+func TestRenderObjectTreeIndexesBefore(t *testing.T) {
+	tree := NewObjectTreeWithObjects(ObjectTreeConfig{}, []Object{
+		simpleObject("a/b/fileA"),
+		simpleObject("c/fileC"),
+	})
+	renderers := IndexRenderers{JSONIndexRenderer(DioadIndexConfig)}
+
+	destFS := afero.NewMemMapFs()
+	err := RenderObjectTreeIndexesBefore(time.Time{}, tree, renderers, destFS, true)
+	if err != nil {
+		t.Fatalf("RenderObjectTreeIndexesBefore() error = %v", err)
+	}
+	exists, _ := afero.Exists(destFS, "/a/b/index.json")
+	assert.True(t, exists)
+
+	destFS = afero.NewMemMapFs()
+	err = RenderObjectTreeIndexesBefore(time.Now().Add(-time.Second), tree, renderers, destFS, true)
+	var deadlineErr *DeadlineError
+	if !errors.As(err, &deadlineErr) {
+		t.Fatalf("RenderObjectTreeIndexesBefore() error = %v, expected a DeadlineError", err)
+	}
+	assert.Equal(t, []string{"/", "/a", "/a/b", "/c"}, deadlineErr.Pending)
+	exists, _ = afero.Exists(destFS, "/index.json")
+	assert.False(t, exists)
+
+	destFS = afero.NewMemMapFs()
+	err = RenderObjectTreeIndexesForPathsBefore(time.Now().Add(-time.Second), tree, renderers, destFS, []string{"/a/b", "/c"})
+	if !errors.As(err, &deadlineErr) {
+		t.Fatalf("RenderObjectTreeIndexesForPathsBefore() error = %v, expected a DeadlineError", err)
+	}
+	assert.Equal(t, []string{"/a/b", "/c"}, deadlineErr.Pending)
+}
+
+func TestGenerateIndexesListingCutoff(t *testing.T) {
+	pageLister := func(ctx context.Context, prefix string, fn ObjectPageFunc) error {
+		err := fn([]Object{objectWithETag("connect/0.57.0/connect_linux_amd64.zip", "etag")})
+		if err != nil {
+			return err
+		}
+		// the rest of the listing doesn't arrive before the cutoff
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	cfg := testCLIConfig()
+	cfg.IndexFormats = []IndexFormat{JSONIndex}
+	cfg.DeadlineMargin = time.Minute - 50*time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	outputFS := afero.NewMemMapFs()
+	err := generateIndexes(ctx, &Sessions{}, cfg, pageLister, outputFS)
+	var deadlineErr *DeadlineError
+	if !errors.As(err, &deadlineErr) {
+		t.Fatalf("generateIndexes() error = %v, expected a DeadlineError", err)
+	}
+	assert.Equal(t, []string{"/", "/connect", "/connect/0.57.0"}, deadlineErr.Pending)
+	assert.Equal(t, 0, deadlineErr.Rendered)
+
+	exists, _ := afero.Exists(outputFS, "/index.json")
+	assert.False(t, exists)
+}
+
+func TestHandleResumeEvent(t *testing.T) {
+	jobs := []Config{
+		{Name: "releases", Bucket: "bucket-a", DestinationBucketPrefix: "site"},
+		{Name: "any", DestinationBucketPrefix: "site"},
+	}
+
+	calls := make([]regenerateCall, 0)
+	regenerate := func(ctx context.Context, cfg Config, keys []string) error {
+		assert.True(t, isResumeRequest(ctx))
+		calls = append(calls, regenerateCall{bucket: cfg.Bucket, prefix: cfg.DestinationBucketPrefix, keys: keys})
+		return nil
+	}
+
+	event, err := SyntheticResumeEvent(&Checkpoint{Job: "any", Bucket: "bucket-b", DestinationPrefix: "site"})
+	if err != nil {
+		t.Fatalf("SyntheticResumeEvent() error = %v", err)
+	}
+
+	summary, err := handleResumeEvent(context.Background(), jobs, event, regenerate)
+	if err != nil {
+		t.Fatalf("handleResumeEvent() error = %v", err)
+	}
+	assert.Equal(t, []regenerateCall{{bucket: "bucket-b", prefix: "site"}}, calls)
+	assert.Len(t, summary.Regenerated, 1)
+
+	event, _ = SyntheticResumeEvent(&Checkpoint{Job: "releases", Bucket: "bucket-b", DestinationPrefix: "site"})
+	summary, err = handleResumeEvent(context.Background(), jobs, event, regenerate)
+	if err != nil {
+		t.Fatalf("handleResumeEvent() error = %v", err)
+	}
+	assert.Len(t, calls, 1)
+	assert.Len(t, summary.Skipped, 1)
+}
+
+func TestLambdaRegenerateCheckpoint(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	server := newFakeS3Server(t)
+	server.PutObject("bucket-a", "connect/0.57.0/connect_linux_amd64.zip", []byte("00000"))
+	server.PutObject("bucket-a", "connect/0.57.1/connect_linux_amd64.zip", []byte("00000"))
+	server.PutObject("bucket-a", "tunnel/1.0.0/tunnel_linux_amd64.zip", []byte("00000"))
+
+	defer func(batchSize int) { ResumeBatchSize = batchSize }(ResumeBatchSize)
+	ResumeBatchSize = 4
+
+	reinvoked := make([]*Checkpoint, 0)
+	defer func(f func(context.Context, *session.Session, *Checkpoint) error) { reinvokeFunction = f }(reinvokeFunction)
+	reinvokeFunction = func(ctx context.Context, sess *session.Session, checkpoint *Checkpoint) error {
+		reinvoked = append(reinvoked, checkpoint)
+		return nil
+	}
+
+	cfg := testCLIConfig()
+	cfg.IndexFormats = []IndexFormat{JSONIndex}
+	cfg.Bucket = "bucket-a"
+	cfg.DestinationBucketPrefix = "site"
+	cfg.Incremental = true
+	cfg.DeadlineMargin = time.Hour
+	cfg.ReinvokeOnDeadline = true
+	cfg.LocalOutputDirectory = t.TempDir()
+	cfg.S3 = server.Options()
+
+	regenerate := lambdaRegenerate(NewSessions(cfg))
+	outputFS, _ := NewLocalOutputFS(filepath.Join(cfg.LocalOutputDirectory, cfg.DestinationBucketPrefix))
+
+	exists := func(p string) bool {
+		found, _ := afero.Exists(outputFS, p)
+		return found
+	}
+
+	// the deadline is within the margin so the run stops before listing
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err := regenerate(ctx, cfg, []string{"connect/0.57.1/connect_linux_amd64.zip"})
+	if err != nil {
+		t.Fatalf("regenerate() error = %v", err)
+	}
+
+	checkpoint, err := LoadCheckpoint(outputFS)
+	if err != nil {
+		t.Fatalf("LoadCheckpoint() error = %v", err)
+	}
+	assert.Equal(t, []string{"/", "/connect", "/connect/0.57.1"}, checkpoint.Pending)
+	assert.Equal(t, 2, checkpoint.BatchSize)
+	assert.Empty(t, reinvoked, "a run that rendered nothing isn't reinvoked")
+
+	// a later event resumes a batch of the checkpoint along with its own keys
+	err = regenerate(context.Background(), cfg, []string{"tunnel/1.0.0/tunnel_linux_amd64.zip"})
+	if err != nil {
+		t.Fatalf("regenerate() error = %v", err)
+	}
+	assert.True(t, exists("/index.json"))
+	assert.True(t, exists("/connect/index.json"))
+	assert.True(t, exists("/tunnel/1.0.0/index.json"))
+	assert.False(t, exists("/connect/0.57.1/index.json"))
+
+	checkpoint, _ = LoadCheckpoint(outputFS)
+	assert.Equal(t, []string{"/connect/0.57.1"}, checkpoint.Pending)
+	assert.Len(t, reinvoked, 1)
+
+	// the reinvocation resumes the rest and clears the checkpoint
+	err = regenerate(withResumeRequest(context.Background()), cfg, nil)
+	if err != nil {
+		t.Fatalf("regenerate() error = %v", err)
+	}
+	assert.True(t, exists("/connect/0.57.1/index.json"))
+	assert.False(t, exists(checkpointFile))
+
+	// with nothing left to resume a resume request does nothing
+	listed := server.Requests(http.MethodGet)
+	err = regenerate(withResumeRequest(context.Background()), cfg, nil)
+	if err != nil {
+		t.Fatalf("regenerate() error = %v", err)
+	}
+	assert.Equal(t, listed, server.Requests(http.MethodGet))
+
+	// a full rebuild starts over rather than resuming, and clears the checkpoint
+	err = SaveCheckpoint(outputFS, &Checkpoint{Bucket: "bucket-a", DestinationPrefix: "site", Pending: []string{"/connect"}})
+	if err != nil {
+		t.Fatalf("SaveCheckpoint() error = %v", err)
+	}
+	err = regenerate(context.Background(), cfg, nil)
+	if err != nil {
+		t.Fatalf("regenerate() error = %v", err)
+	}
+	assert.True(t, exists("/connect/0.57.0/index.json"))
+	assert.False(t, exists(checkpointFile))
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// indexFileNames returns the name of the index file written for each of
+// formats.
+func indexFileNames(formats []IndexFormat) []string {
+	names := make([]string, 0, len(formats))
+	for _, format := range formats {
+		names = append(names, format.IndexFile())
+	}
+	return names
+}
+
+// excludedTreePath returns true if the key prefix of treePath is excluded by
+// cfg, or any part of it is excluded as a directory name, so the generator
+// never indexes its contents.
+func excludedTreePath(cfg ObjectTreeConfig, treePath string) bool {
+	if !cfg.DirectoryExclusions.Include(prefixForTreePath(cfg, treePath)) {
+		return true
+	}
+
+	return slices.ContainsFunc(splitTreePath(treePath), func(part string) bool {
+		return !cfg.Exclusions.Include(part)
+	})
+}
+
+// ObjectTreePaths returns the FullPath of objectTree and, if recursive, of
+// every node beneath it.
+func ObjectTreePaths(objectTree *ObjectTree, recursive bool) ([]string, error) {
+	var mu sync.Mutex
+	paths := make([]string, 0)
+
+	err := objectTree.Walk(func(node *ObjectTree) error {
+		mu.Lock()
+		defer mu.Unlock()
+		paths = append(paths, node.FullPath)
+		return nil
+	}, recursive, true)
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(paths)
+
+	return paths, nil
+}
+
+// StaleIndexFiles returns the index files within outputFS that are in a
+// directory other than those in paths. The static directory, and any
+// directory excluded by cfg, is left alone.
+func StaleIndexFiles(outputFS afero.Fs, cfg ObjectTreeConfig, indexFiles []string, paths []string) ([]string, error) {
+	generated := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		generated[p] = true
+	}
+
+	stale := make([]string, 0)
+
+	err := afero.Walk(outputFS, "/", func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if filePath == "/static" || excludedTreePath(cfg, filePath) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if slices.Contains(indexFiles, path.Base(filePath)) && !generated[path.Dir(filePath)] {
+			stale = append(stale, filePath)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stale, nil
+}
+
+// RemoveFiles removes those of files that exist in outputFS, returning the
+// files that were removed.
+func RemoveFiles(outputFS afero.Fs, files []string) ([]string, error) {
+	removed := make([]string, 0)
+
+	var errs []error
+	for _, filePath := range files {
+		exists, err := afero.Exists(outputFS, filePath)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !exists {
+			continue
+		}
+
+		err = outputFS.Remove(filePath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+			continue
+		}
+		removed = append(removed, filePath)
+	}
+
+	return removed, errors.Join(errs...)
+}
+
+// removeStaleIndexes removes index files left in directories that are no
+// longer part of objectTree.
+func removeStaleIndexes(cfg Config, outputFS afero.Fs, objectTree *ObjectTree, recursive bool) error {
+	paths, err := ObjectTreePaths(objectTree, recursive)
+	if err != nil {
+		return err
+	}
+
+	stale, err := StaleIndexFiles(outputFS, objectTree.Config, indexFileNames(cfg.IndexFormats), paths)
+	if err != nil {
+		return err
+	}
+
+	removed, err := RemoveFiles(outputFS, stale)
+	logRemovedIndexFiles(removed)
+
+	return err
+}
+
+// removeMissingIndexes removes the index files at paths that are no longer
+// part of objectTree, such as directories whose last object was deleted.
+// Excluded directories are left alone.
+func removeMissingIndexes(cfg Config, outputFS afero.Fs, objectTree *ObjectTree, paths []string) error {
+	missing := make([]string, 0)
+	for _, p := range paths {
+		if objectTree.Lookup(p) != nil || excludedTreePath(objectTree.Config, p) {
+			continue
+		}
+		for _, indexFile := range indexFileNames(cfg.IndexFormats) {
+			missing = append(missing, path.Join(p, indexFile))
+		}
+	}
+
+	removed, err := RemoveFiles(outputFS, missing)
+	logRemovedIndexFiles(removed)
+
+	return err
+}
+
+func logRemovedIndexFiles(removed []string) {
+	for _, filePath := range removed {
+		log.Printf("RemoveStaleIndexes: removed %v\n", strings.TrimPrefix(filePath, "/"))
+	}
+	log.Printf("RemoveStaleIndexes: removed:%d\n", len(removed))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaleIndexFiles(t *testing.T) {
+	outputFS := NewMemoryOutputFS()
+	for _, p := range []string{
+		"/index.html",
+		"/index.json",
+		"/a/index.html",
+		"/a/gone/index.html",
+		"/a/gone/index.json",
+		"/a/gone/other.txt",
+		"/static/index.html",
+		"/private/index.html",
+		"/private/keys/index.html",
+		"/releases/internal/index.html",
+		"/releases/gone/index.html",
+	} {
+		afero.WriteFile(outputFS, p, []byte("content"), 0644)
+	}
+
+	cfg := ObjectTreeConfig{
+		DirectoryExclusions: Exclusions{HasPrefix("private/"), HasPrefix("releases/internal")},
+	}
+	indexFiles := indexFileNames([]IndexFormat{HTMLIndex, JSONIndex})
+
+	stale, err := StaleIndexFiles(outputFS, cfg, indexFiles, []string{"/", "/a", "/releases"})
+	if err != nil {
+		t.Fatalf("StaleIndexFiles() error = %v", err)
+	}
+	assert.Equal(t, []string{"/a/gone/index.html", "/a/gone/index.json", "/releases/gone/index.html"}, stale)
+
+	removed, err := RemoveFiles(outputFS, append(stale, "/missing/index.html"))
+	if err != nil {
+		t.Fatalf("RemoveFiles() error = %v", err)
+	}
+	assert.Equal(t, stale, removed)
+
+	exists, _ := afero.Exists(outputFS, "/a/gone/index.html")
+	assert.False(t, exists)
+	exists, _ = afero.Exists(outputFS, "/a/gone/other.txt")
+	assert.True(t, exists)
+}
+
+func TestExcludedTreePath(t *testing.T) {
+	cfg := objectTreeConfig(Config{
+		ObjectPrefix:     "data",
+		ExcludedPrefixes: []string{"data/private/", "data/releases/internal"},
+	})
+
+	for treePath, excluded := range map[string]bool{
+		"/":                          false,
+		"/private":                   true,
+		"/private/keys":              true,
+		"/releases":                  false,
+		"/releases/internal":         true,
+		"/releases/internal-preview": true,
+		"/releases/1.0.0":            false,
+		"/.staging":                  true,
+	} {
+		assert.Equal(t, excluded, excludedTreePath(cfg, treePath), treePath)
+	}
+}
+
+func TestRemoveMissingIndexes(t *testing.T) {
+	outputFS := NewMemoryOutputFS()
+	for _, p := range []string{
+		"/index.html",
+		"/connect/index.html",
+		"/connect/0.57.0/index.html",
+		"/connect/0.57.1/index.html",
+	} {
+		afero.WriteFile(outputFS, p, []byte("content"), 0644)
+	}
+
+	// every object in connect/0.57.1/ has been removed, leaving the indexes
+	// written alongside them
+	keys := []string{
+		"index.html",
+		"index.json",
+		"connect/index.html",
+		"connect/index.json",
+		"connect/0.57.0/connect_linux_amd64.zip",
+		"connect/0.57.0/index.html",
+		"connect/0.57.1/index.html",
+		"connect/0.57.1/index.json",
+	}
+	removedKeys := []string{
+		"connect/0.57.1/connect_linux_amd64.zip",
+	}
+
+	cfg := Config{IndexFormats: []IndexFormat{HTMLIndex, JSONIndex}}
+	treeCfg := objectTreeConfig(cfg)
+	paths := DirtyTreePaths(treeCfg, removedKeys)
+
+	listed := make([]string, 0)
+	lister := FilteredDirectoryLister(fakeDirectoryLister(keys, &listed), listedKeyPredicate(cfg, ""), generatedPrefixPredicate(cfg, ""))
+	objectTree, err := NewIncrementalObjectTree(context.Background(), treeCfg, lister, paths, false)
+	if err != nil {
+		t.Fatalf("NewIncrementalObjectTree() error = %v", err)
+	}
+	assert.Nil(t, objectTree.Lookup("/connect/0.57.1"))
+	assert.NotNil(t, objectTree.Lookup("/connect/0.57.0"))
+
+	err = removeMissingIndexes(cfg, outputFS, objectTree, paths)
+	if err != nil {
+		t.Fatalf("removeMissingIndexes() error = %v", err)
+	}
+
+	exists, _ := afero.Exists(outputFS, "/connect/0.57.1/index.html")
+	assert.False(t, exists)
+	exists, _ = afero.Exists(outputFS, "/connect/0.57.0/index.html")
+	assert.True(t, exists)
+	exists, _ = afero.Exists(outputFS, "/connect/index.html")
+	assert.True(t, exists)
+}
+
+func TestRemoveStaleIndexesListedIndexes(t *testing.T) {
+	outputFS := NewMemoryOutputFS()
+	for _, p := range []string{
+		"/index.html",
+		"/index.json",
+		"/connect/0.57.0/index.json",
+		"/connect/0.57.1/index.json",
+	} {
+		afero.WriteFile(outputFS, p, []byte("content"), 0644)
+	}
+
+	// the indexes are written to the bucket being listed
+	cfg := Config{IndexFormats: []IndexFormat{JSONIndex}}
+	objects := []Object{
+		simpleObject("index.json"),
+		simpleObject("connect/0.57.0/connect_linux_amd64.zip"),
+		simpleObject("connect/0.57.0/index.json"),
+		simpleObject("connect/0.57.1/index.json"),
+		simpleObject("connect/0.57.1/"),
+	}
+	pageLister := FilteredPageLister(PagesFromLister(func(ctx context.Context, prefix string) ([]Object, error) {
+		return objects, nil
+	}), listedKeyPredicate(cfg, ""))
+
+	objectTree := NewRootObjectTree(objectTreeConfig(cfg))
+	err := objectTree.AddAllObjectsFromPageLister(context.Background(), pageLister)
+	if err != nil {
+		t.Fatalf("AddAllObjectsFromPageLister() error = %v", err)
+	}
+
+	err = removeStaleIndexes(cfg, outputFS, objectTree, true)
+	if err != nil {
+		t.Fatalf("removeStaleIndexes() error = %v", err)
+	}
+
+	exists, _ := afero.Exists(outputFS, "/connect/0.57.1/index.json")
+	assert.False(t, exists)
+	exists, _ = afero.Exists(outputFS, "/connect/0.57.0/index.json")
+	assert.True(t, exists)
+}
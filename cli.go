@@ -0,0 +1,686 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+var cliName = "s3-index-generator"
+
+// cliCommand is a subcommand of the command line interface. Every command
+// accepts the flags registered by configFlags in addition to its own.
+type cliCommand struct {
+	Name        string
+	Args        string
+	Description string
+	// Flags registers any flags specific to the command
+	Flags func(fs *flag.FlagSet)
+	Run   func(ctx context.Context, cfg Config, args []string) error
+}
+
+func cliCommands(stdout io.Writer) []*cliCommand {
+	return []*cliCommand{
+		generateCommand(stdout),
+		validateTemplatesCommand(stdout),
+		diffCommand(stdout),
+		serveCommand(),
+		dumpListingCommand(),
+		invokeCommand(stdout),
+	}
+}
+
+func generateCommand(stdout io.Writer) *cliCommand {
+	var jobName string
+	var planFormat string
+
+	return &cliCommand{
+		Name:        "generate",
+		Args:        "[<source> [output-dir]]",
+		Description: "Generate indexes for source, writing them to output-dir, the source directory or the destination bucket. Without a source every job in the config file is generated.",
+		Flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&jobName, "job", "", "only generate the named job from the config file")
+			fs.Var(choiceValue{&planFormat, []string{"text", "json"}}, "plan-format", "format of the dry run plan, text or json")
+		},
+		Run: func(ctx context.Context, cfg Config, args []string) error {
+			if len(args) > 2 {
+				return errors.New("expected [<source> [output-dir]]")
+			}
+
+			output := newPlanOutput(stdout, planFormat)
+
+			if len(args) == 0 {
+				return generateJobs(ctx, cfg, jobName, output)
+			}
+
+			if len(args) == 2 {
+				cfg.LocalOutputDirectory = args[1]
+			}
+
+			sourceURL, err := parseSourceArg(args[0], &cfg)
+			if err != nil {
+				return fmt.Errorf("invalid source: %w", err)
+			}
+
+			return generate(ctx, cfg, sourceURL, output)
+		},
+	}
+}
+
+// planOutputFunc reports the plan for a dry run.
+type planOutputFunc func(plan *OutputPlan) error
+
+func newPlanOutput(w io.Writer, format string) planOutputFunc {
+	return func(plan *OutputPlan) error {
+		if format == "json" {
+			return plan.WriteJSON(w)
+		}
+		return plan.WriteText(w)
+	}
+}
+
+func generate(ctx context.Context, cfg Config, sourceURL *url.URL, output planOutputFunc) error {
+	sessions := NewSessions(cfg)
+
+	outputFS, err := outputFSForSource(sessions, cfg, sourceURL)
+	if err != nil {
+		return err
+	}
+
+	index := func(cfg Config, outputFS afero.Fs) error {
+		return indexSource(ctx, sessions, cfg, sourceURL, outputFS)
+	}
+
+	if cfg.DryRun {
+		plan, err := planIndexes(cfg, outputFS, index)
+		if err != nil {
+			return err
+		}
+		return output(plan)
+	}
+
+	err = publishIndexes(cfg, outputFS, true, index)
+	if err != nil {
+		return fmt.Errorf("failed to generate index files: %w", err)
+	}
+
+	return nil
+}
+
+// generateJobs generates the indexes for every job in the config file, or
+// only the one named jobName. A local output directory holds each job's
+// indexes under its destination prefix, as the bucket would.
+func generateJobs(ctx context.Context, cfg Config, jobName string, output planOutputFunc) error {
+	if cfg.ConfigURL == nil {
+		return errors.New("expected a source or a config file")
+	}
+
+	jobs, err := jobConfigs(cfg)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, job := range jobs {
+		if jobName != "" && job.Name != jobName {
+			continue
+		}
+		found = true
+
+		if job.LocalOutputDirectory != "" {
+			job.LocalOutputDirectory = filepath.Join(job.LocalOutputDirectory, job.DestinationBucketPrefix)
+		}
+
+		sourceURL := &url.URL{Scheme: "s3", Host: job.Bucket, Path: "/" + job.ObjectPrefix}
+
+		log.Printf("job: name:%v source:%v\n", job.Name, sourceURL)
+		err = generate(ctx, job, sourceURL, output)
+		if err != nil {
+			return fmt.Errorf("job %v: %w", job.Name, err)
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("no job named %v", jobName)
+	}
+
+	return nil
+}
+
+func validateTemplatesCommand(stdout io.Writer) *cliCommand {
+	return &cliCommand{
+		Name:        "validate-templates",
+		Description: "Check that the templates of every job load, define the index template and render a sample tree.",
+		Run: func(ctx context.Context, cfg Config, args []string) error {
+			if len(args) != 0 {
+				return errors.New("expected no arguments")
+			}
+
+			jobs, err := jobConfigs(cfg)
+			if err != nil {
+				return err
+			}
+
+			for _, job := range jobs {
+				tmpl, err := LoadTemplates(NewSessions(job).Template, job.TemplateBucketURL)
+				if err != nil {
+					return fmt.Errorf("failed to load templates: %w", err)
+				}
+
+				err = ValidateTemplates(tmpl, job.IndexTemplate, job.IndexType != SinglePageIdentifier)
+				if err != nil {
+					return err
+				}
+
+				if job.Name != "" {
+					fmt.Fprintf(stdout, "%v: ", job.Name)
+				}
+				fmt.Fprintf(stdout, "%v: ok\n", job.IndexTemplate)
+			}
+
+			return nil
+		},
+	}
+}
+
+func diffCommand(stdout io.Writer) *cliCommand {
+	return &cliCommand{
+		Name:        "diff",
+		Args:        "<source> [output-dir]",
+		Description: "Render indexes for source in memory and list the files that differ from those already written. Nothing is written.",
+		Run: func(ctx context.Context, cfg Config, args []string) error {
+			if len(args) < 1 || len(args) > 2 {
+				return errors.New("expected <source> [output-dir]")
+			}
+			if len(args) == 2 {
+				cfg.LocalOutputDirectory = args[1]
+			}
+
+			sourceURL, err := parseSourceArg(args[0], &cfg)
+			if err != nil {
+				return fmt.Errorf("invalid source: %w", err)
+			}
+
+			sessions := NewSessions(cfg)
+
+			existingFS, err := outputFSForSource(sessions, cfg, sourceURL)
+			if err != nil {
+				return err
+			}
+
+			plan, err := planIndexes(cfg, existingFS, func(cfg Config, renderedFS afero.Fs) error {
+				return indexSource(ctx, sessions, cfg, sourceURL, renderedFS)
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, d := range plan.Files {
+				switch d.Change {
+				case CreatedOutput:
+					fmt.Fprintf(stdout, "+ %v\n", d.Path)
+				case ChangedOutput:
+					fmt.Fprintf(stdout, "~ %v\n", d.Path)
+				}
+			}
+
+			return nil
+		},
+	}
+}
+
+func serveCommand() *cliCommand {
+	var listen string
+
+	return &cliCommand{
+		Name:        "serve",
+		Args:        "<source>",
+		Description: "Render indexes for source in memory and serve them over HTTP to preview templates.",
+		Flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&listen, "listen", "localhost:8080", "address to serve on")
+		},
+		Run: func(ctx context.Context, cfg Config, args []string) error {
+			if len(args) != 1 {
+				return errors.New("expected <source>")
+			}
+
+			sourceURL, err := parseSourceArg(args[0], &cfg)
+			if err != nil {
+				return fmt.Errorf("invalid source: %w", err)
+			}
+
+			// nothing is written when previewing
+			cfg.EnrichmentCacheURL = nil
+
+			renderedFS := NewMemoryOutputFS()
+			err = indexSource(ctx, NewSessions(cfg), cfg, sourceURL, renderedFS)
+			if err != nil {
+				return fmt.Errorf("failed to generate index files: %w", err)
+			}
+
+			log.Printf("serving indexes for %v on http://%v/\n", args[0], listen)
+
+			return http.ListenAndServe(listen, http.FileServer(afero.NewHttpFs(renderedFS)))
+		},
+	}
+}
+
+func dumpListingCommand() *cliCommand {
+	return &cliCommand{
+		Name:        "dump-listing",
+		Args:        "<s3-source> [listing.json|listing.csv]",
+		Description: "Write the objects and tags of an s3:// source to a listing file, or to stdout as JSON.",
+		Run: func(ctx context.Context, cfg Config, args []string) error {
+			if len(args) < 1 || len(args) > 2 {
+				return errors.New("expected <s3-source> [listing-file]")
+			}
+
+			outputPath := ""
+			if len(args) == 2 {
+				outputPath = args[1]
+			}
+
+			return dumpListing(ctx, NewSessions(cfg), cfg, args[0], outputPath)
+		},
+	}
+}
+
+func invokeCommand(stdout io.Writer) *cliCommand {
+	opts := invokeOptions{}
+
+	return &cliCommand{
+		Name:        "invoke",
+		Args:        "[<key>...]",
+		Description: "Run the Lambda handler locally with the event in -event, a synthetic S3 event for keys in the configured bucket or a synthetic scheduled event, and print its response. Indexes are written to the output directory if one is given.",
+		Flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&opts.EventPath, "event", "", "file containing an S3, SQS or EventBridge event, or - for stdin")
+			fs.StringVar(&opts.EventName, "event-name", "ObjectCreated:Put", "event name of synthetic records")
+			fs.BoolVar(&opts.SQS, "sqs", false, "wrap each synthetic record in an SQS message")
+			fs.BoolVar(&opts.Scheduled, "scheduled", false, "send a scheduled event, rebuilding every job in full")
+		},
+		Run: func(ctx context.Context, cfg Config, args []string) error {
+			payload, err := invokePayload(cfg, opts, args)
+			if err != nil {
+				return err
+			}
+
+			jobs, err := jobConfigs(cfg)
+			if err != nil {
+				return err
+			}
+
+			response, err := HandleRequest(NewSessions(cfg), jobs)(ctx, payload)
+
+			encoder := json.NewEncoder(stdout)
+			encoder.SetIndent("", "  ")
+			encodeErr := encoder.Encode(response)
+
+			return errors.Join(err, encodeErr)
+		},
+	}
+}
+
+// invokeOptions describes the event sent by the invoke command.
+type invokeOptions struct {
+	EventPath string
+	EventName string
+	SQS       bool
+	Scheduled bool
+}
+
+// invokePayload reads the event at opts.EventPath or, if there isn't one,
+// builds a synthetic scheduled event or an event for keys in the configured
+// bucket.
+func invokePayload(cfg Config, opts invokeOptions, keys []string) (json.RawMessage, error) {
+	if opts.EventPath != "" || opts.Scheduled {
+		if len(keys) > 0 {
+			return nil, errors.New("expected keys only for synthetic S3 events")
+		}
+	}
+
+	if opts.EventPath != "" {
+		if opts.EventPath == "-" {
+			return io.ReadAll(os.Stdin)
+		}
+		return os.ReadFile(opts.EventPath)
+	}
+
+	if opts.Scheduled {
+		return json.Marshal(SyntheticScheduledEvent())
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("expected -event, -scheduled or at least one key")
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("expected a bucket for synthetic events")
+	}
+
+	event := SyntheticS3Event(cfg.Bucket, opts.EventName, keys)
+	if !opts.SQS {
+		return json.Marshal(event)
+	}
+
+	sqsEvent, err := SyntheticSQSEvent(event)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(sqsEvent)
+}
+
+// outputFSForSource returns the local output directory if one is configured
+// and otherwise the default output for sourceURL.
+func outputFSForSource(sessions *Sessions, cfg Config, sourceURL *url.URL) (afero.Fs, error) {
+	if cfg.LocalOutputDirectory != "" {
+		outputFS, err := NewLocalOutputFS(cfg.LocalOutputDirectory)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create local output FS: %w", err)
+		}
+		return outputFS, nil
+	}
+
+	outputFS, err := defaultOutputFS(sessions, cfg, sourceURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output FS: %w", err)
+	}
+
+	return outputFS, nil
+}
+
+// stringListValue is a flag.Value for a comma separated list.
+type stringListValue struct {
+	values *[]string
+}
+
+func (v stringListValue) String() string {
+	if v.values == nil {
+		return ""
+	}
+	return strings.Join(*v.values, ",")
+}
+
+func (v stringListValue) Set(value string) error {
+	*v.values = commaSeparated(value)
+	return nil
+}
+
+// indexFormatsValue is a flag.Value for a comma separated list of index
+// formats.
+type indexFormatsValue struct {
+	formats *[]IndexFormat
+}
+
+func (v indexFormatsValue) String() string {
+	if v.formats == nil {
+		return ""
+	}
+	formats := make([]string, 0, len(*v.formats))
+	for _, f := range *v.formats {
+		formats = append(formats, string(f))
+	}
+	return strings.Join(formats, ",")
+}
+
+func (v indexFormatsValue) Set(value string) error {
+	formats, err := indexFormats(value)
+	if err != nil {
+		return err
+	}
+	*v.formats = formats
+	return nil
+}
+
+// urlValue is a flag.Value for an optional URL.
+type urlValue struct {
+	url **url.URL
+}
+
+func (v urlValue) String() string {
+	if v.url == nil || *v.url == nil {
+		return ""
+	}
+	return (*v.url).String()
+}
+
+func (v urlValue) Set(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	*v.url = u
+	return nil
+}
+
+// repeatedValue is a flag.Value for a flag that may be given more than once.
+type repeatedValue struct {
+	values *[]string
+}
+
+func (v repeatedValue) String() string {
+	if v.values == nil {
+		return ""
+	}
+	return strings.Join(*v.values, " ")
+}
+
+func (v repeatedValue) Set(value string) error {
+	*v.values = append(*v.values, value)
+	return nil
+}
+
+// choiceValue is a flag.Value for a string that must be one of choices.
+type choiceValue struct {
+	value   *string
+	choices []string
+}
+
+func (v choiceValue) String() string {
+	if v.value == nil {
+		return ""
+	}
+	return *v.value
+}
+
+func (v choiceValue) Set(value string) error {
+	if !slices.Contains(v.choices, value) {
+		return fmt.Errorf("expected one of %v", strings.Join(v.choices, ", "))
+	}
+	*v.value = value
+	return nil
+}
+
+func roleFlags(fs *flag.FlagSet, name string, role *RoleConfig) {
+	fs.StringVar(&role.RoleARN, name+"-role-arn", role.RoleARN, fmt.Sprintf("IAM role to assume for the %v", name))
+	fs.StringVar(&role.ExternalID, name+"-role-external-id", role.ExternalID, fmt.Sprintf("external ID used to assume the %v role", name))
+	fs.StringVar(&role.SessionName, name+"-role-session-name", role.SessionName, fmt.Sprintf("session name used to assume the %v role", name))
+}
+
+// configFlags registers a flag for every field of cfg, defaulting to its
+// current value, so that flags override the environment.
+func configFlags(fs *flag.FlagSet, cfg *Config) {
+	fs.Var(urlValue{&cfg.ConfigURL}, "config", "s3:// URL or local path of a YAML or JSON config file defining jobs")
+	fs.StringVar(&cfg.Bucket, "bucket", cfg.Bucket, "S3 bucket to index")
+	fs.StringVar(&cfg.DestinationBucketPrefix, "destination-prefix", cfg.DestinationBucketPrefix, "prefix within the bucket to write indexes to")
+	fs.StringVar(&cfg.ObjectPrefix, "object-prefix", cfg.ObjectPrefix, "prefix of the objects to index")
+	fs.Var(choiceValue{&cfg.IndexType, []string{MultiPageIdentifier, SinglePageIdentifier}}, "index-type", "index type, multipage or singlepage")
+	fs.Var(indexFormatsValue{&cfg.IndexFormats}, "index-formats", "comma separated index formats, html and/or json")
+	fs.StringVar(&cfg.IndexTemplate, "index-template", cfg.IndexTemplate, "name of the root template, defaults to ${index-type}.index.html.tmpl")
+	fs.Var(urlValue{&cfg.TemplateBucketURL}, "template-url", "s3:// URL containing a templates/ directory")
+	fs.Var(urlValue{&cfg.StaticBucketURL}, "static-url", "s3:// URL containing a static/ directory")
+	fs.StringVar(&cfg.ServerSideEncryption, "sse", cfg.ServerSideEncryption, "server side encryption for written indexes")
+	fs.StringVar(&cfg.LocalOutputDirectory, "output", cfg.LocalOutputDirectory, "local directory to write indexes to")
+	fs.BoolVar(&cfg.DryRun, "dry-run", cfg.DryRun, "render in memory and report the files that would be created or changed without writing anything")
+	fs.BoolVar(&cfg.SkipUnchanged, "skip-unchanged", cfg.SkipUnchanged, "don't rewrite files whose content, ignoring nonces, hasn't changed")
+	fs.BoolVar(&cfg.RemoveStaleIndexes, "remove-stale-indexes", cfg.RemoveStaleIndexes, "remove index files from directories that no longer contain any objects")
+	fs.BoolVar(&cfg.StagedPublish, "staged-publish", cfg.StagedPublish, "render into a staging directory and only copy the indexes into place once every one has rendered")
+	fs.BoolVar(&cfg.GenerationGuard, "generation-guard", cfg.GenerationGuard, "give up rather than overwrite indexes once a newer run has started writing to the same output")
+	fs.DurationVar(&cfg.DeadlineMargin, "deadline-margin", cfg.DeadlineMargin, "stop rendering this long before the Lambda deadline and save a checkpoint to resume from")
+	fs.BoolVar(&cfg.ReinvokeOnDeadline, "reinvoke-on-deadline", cfg.ReinvokeOnDeadline, "invoke the function again to resume from a checkpoint")
+	fs.BoolVar(&cfg.Incremental, "incremental", cfg.Incremental, "only regenerate the directories containing changed keys when handling events")
+	fs.Var(choiceValue{&cfg.ListingStrategy, []string{SequentialListing, ShardedListing}}, "listing-strategy", "listing strategy, sequential or sharded")
+	fs.IntVar(&cfg.ListingWorkers, "listing-workers", cfg.ListingWorkers, "number of shards listed concurrently")
+	fs.Var(stringListValue{&cfg.ExcludedStorageClasses}, "exclude-storage-classes", "comma separated storage classes to leave out of indexes")
+	fs.Var(stringListValue{&cfg.ExcludedPrefixes}, "exclude-prefixes", "comma separated key prefixes to leave out of indexes")
+	fs.Var(stringListValue{&cfg.ExcludedSuffixes}, "exclude-suffixes", "comma separated key suffixes to leave out of indexes")
+	fs.Var(repeatedValue{&cfg.ReleaseKeyExtractors}, "release-key-extractor", "regular expression with named groups to extract release details from keys, may be repeated")
+	fs.Var(stringListValue{&cfg.MetadataEnrichment.Prefixes}, "metadata-prefixes", "comma separated key prefixes to fetch metadata for")
+	fs.Var(stringListValue{&cfg.MetadataEnrichment.Suffixes}, "metadata-suffixes", "comma separated key suffixes to fetch metadata for")
+	fs.Var(stringListValue{&cfg.TagEnrichment.Prefixes}, "tag-prefixes", "comma separated key prefixes to fetch tags for")
+	fs.Var(stringListValue{&cfg.TagEnrichment.Suffixes}, "tag-suffixes", "comma separated key suffixes to fetch tags for")
+	fs.Var(urlValue{&cfg.EnrichmentCacheURL}, "enrichment-cache-url", "s3:// URL or local path to cache tags and metadata in")
+	fs.Var(urlValue{&cfg.InventoryManifestURL}, "inventory-manifest-url", "s3:// URL or local path of an S3 Inventory manifest.json to list from")
+	fs.StringVar(&cfg.S3.Endpoint, "s3-endpoint", cfg.S3.Endpoint, "custom S3 endpoint URL")
+	fs.StringVar(&cfg.S3.Region, "s3-region", cfg.S3.Region, "S3 region")
+	fs.BoolVar(&cfg.S3.ForcePathStyle, "s3-force-path-style", cfg.S3.ForcePathStyle, "use path-style bucket addressing")
+	fs.BoolVar(&cfg.S3.InsecureSkipVerify, "s3-insecure-skip-verify", cfg.S3.InsecureSkipVerify, "disable TLS certificate verification")
+	roleFlags(fs, "source", &cfg.SourceRole)
+	roleFlags(fs, "template", &cfg.TemplateRole)
+	roleFlags(fs, "static", &cfg.StaticRole)
+	roleFlags(fs, "destination", &cfg.DestinationRole)
+}
+
+func printIndexOptions(w io.Writer) {
+	fmt.Fprintf(w, "Index types: %v, %v\n", MultiPageIdentifier, SinglePageIdentifier)
+	fmt.Fprintf(w, "Index formats: %v, %v\n", HTMLIndex, JSONIndex)
+}
+
+func printUsage(w io.Writer, commands []*cliCommand) {
+	fmt.Fprintf(w, "Usage: %v <command> [flags] [arguments]\n\nCommands:\n", cliName)
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-20v %v\n", c.Name, c.Description)
+	}
+	fmt.Fprintf(w, "\nSources are s3://bucket/prefix, bucket/destination-prefix, file:///path/to/dir\nor file:///path/to/listing.json|csv.\n\n")
+	printIndexOptions(w)
+	fmt.Fprintf(w, "\nFlags default to their environment variables. Run '%v <command> -h' for the\nflags of a command.\n", cliName)
+}
+
+// environmentFlags maps the environment variables that can fail to parse to
+// the flags that override them.
+var environmentFlags = map[string]string{
+	"INDEX_FORMATS":           "index-formats",
+	"TEMPLATE_BUCKET_URL":     "template-url",
+	"STATIC_BUCKET_URL":       "static-url",
+	"INCREMENTAL":             "incremental",
+	"DRY_RUN":                 "dry-run",
+	"SKIP_UNCHANGED":          "skip-unchanged",
+	"REMOVE_STALE_INDEXES":    "remove-stale-indexes",
+	"STAGED_PUBLISH":          "staged-publish",
+	"GENERATION_GUARD":        "generation-guard",
+	"CONFIG_URL":              "config",
+	"INVENTORY_MANIFEST_URL":  "inventory-manifest-url",
+	"ENRICHMENT_CACHE_URL":    "enrichment-cache-url",
+	"LISTING_WORKERS":         "listing-workers",
+	"DEADLINE_MARGIN":         "deadline-margin",
+	"REINVOKE_ON_DEADLINE":    "reinvoke-on-deadline",
+	"S3_FORCE_PATH_STYLE":     "s3-force-path-style",
+	"S3_INSECURE_SKIP_VERIFY": "s3-insecure-skip-verify",
+}
+
+// remainingEnvironmentErrors returns the errors within envErr other than the
+// EnvironmentErrors for variables whose flag is in setFlags.
+func remainingEnvironmentErrors(envErr error, setFlags map[string]bool) []error {
+	if envErr == nil {
+		return nil
+	}
+
+	if joined, ok := envErr.(interface{ Unwrap() []error }); ok {
+		errs := make([]error, 0)
+		for _, err := range joined.Unwrap() {
+			errs = append(errs, remainingEnvironmentErrors(err, setFlags)...)
+		}
+		return errs
+	}
+
+	var environmentErr *EnvironmentError
+	if errors.As(envErr, &environmentErr) && setFlags[environmentFlags[environmentErr.Variable]] {
+		return nil
+	}
+
+	return []error{envErr}
+}
+
+// runCLI runs the command named by args[0] with cfg, read from the
+// environment, as the defaults for its flags. envErr holds the environment
+// values that couldn't be parsed, which are only reported if their flags
+// aren't given. Arguments without a command are passed to generate, as the
+// original positional interface was.
+func runCLI(ctx context.Context, cfg Config, envErr error, args []string, stdout io.Writer, stderr io.Writer) error {
+	commands := cliCommands(stdout)
+
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		printUsage(stderr, commands)
+		if len(args) == 0 {
+			return errors.New("no command given")
+		}
+		return nil
+	}
+
+	var command *cliCommand
+	for _, c := range commands {
+		if c.Name == args[0] {
+			command = c
+			args = args[1:]
+			break
+		}
+	}
+
+	if command == nil {
+		if strings.HasPrefix(args[0], "-") {
+			printUsage(stderr, commands)
+			return fmt.Errorf("unknown command %v", args[0])
+		}
+		command = commands[0]
+	}
+
+	fs := flag.NewFlagSet(command.Name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %v %v [flags] %v\n\n%v\n\n", cliName, command.Name, command.Args, command.Description)
+		printIndexOptions(stderr)
+		fmt.Fprintf(stderr, "\nFlags:\n")
+		fs.PrintDefaults()
+	}
+
+	configFlags(fs, &cfg)
+	if command.Flags != nil {
+		command.Flags(fs)
+	}
+
+	err := fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	setFlags := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+	cfg.destinationPrefixFlag = setFlags["destination-prefix"]
+
+	// the template follows the index type unless it was given explicitly
+	if _, ok := os.LookupEnv("INDEX_TEMPLATE"); !ok && !setFlags["index-template"] {
+		cfg.IndexTemplate = fmt.Sprintf("%v.index.html.tmpl", cfg.IndexType)
+	}
+
+	err = errors.Join(append(remainingEnvironmentErrors(envErr, setFlags), cfg.Validate())...)
+	if err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	return command.Run(ctx, cfg, fs.Args())
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testCLIConfig() Config {
+	return Config{
+		IndexType:       MultiPageIdentifier,
+		IndexTemplate:   "multipage.index.html.tmpl",
+		IndexFormats:    []IndexFormat{HTMLIndex, JSONIndex},
+		ListingStrategy: SequentialListing,
+		ListingWorkers:  DefaultListingWorkers,
+	}
+}
+
+func writeTestFiles(t *testing.T, dir string, keys ...string) {
+	t.Helper()
+
+	for _, key := range keys {
+		filePath := filepath.Join(dir, key)
+		err := os.MkdirAll(filepath.Dir(filePath), 0755)
+		if err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		err = os.WriteFile(filePath, []byte(key), 0644)
+		if err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+}
+
+func TestRunCLIUsage(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	err := runCLI(context.Background(), testCLIConfig(), nil, []string{"help"}, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("runCLI() error = %v", err)
+	}
+
+	for _, expected := range []string{"generate", "validate-templates", "diff", "serve", "dump-listing", "invoke", "multipage, singlepage", "html, json"} {
+		assert.Contains(t, stderr.String(), expected)
+	}
+
+	err = runCLI(context.Background(), testCLIConfig(), nil, []string{}, &stdout, &stderr)
+	assert.Error(t, err)
+}
+
+func TestRunCLIValidateTemplates(t *testing.T) {
+	for _, indexType := range []string{MultiPageIdentifier, SinglePageIdentifier} {
+		t.Run(indexType, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			err := runCLI(context.Background(), testCLIConfig(), nil, []string{"validate-templates", "-index-type", indexType}, &stdout, &stderr)
+			if err != nil {
+				t.Fatalf("runCLI() error = %v", err)
+			}
+			assert.Equal(t, indexType+".index.html.tmpl: ok\n", stdout.String())
+		})
+	}
+
+	var stdout, stderr bytes.Buffer
+	err := runCLI(context.Background(), testCLIConfig(), nil, []string{"validate-templates", "-index-template", "missing.tmpl"}, &stdout, &stderr)
+	assert.ErrorContains(t, err, "missing.tmpl")
+}
+
+func TestRunCLIInvalidFlag(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	err := runCLI(context.Background(), testCLIConfig(), nil, []string{"generate", "-index-type", "other", "file:///tmp"}, &stdout, &stderr)
+	assert.Error(t, err)
+}
+
+func TestRunCLIFlagsOverrideInvalidEnvironment(t *testing.T) {
+	t.Setenv("INDEX_TYPE", "other")
+
+	cfg, err := parseConfigFromEnvironment()
+	if err != nil {
+		t.Fatalf("parseConfigFromEnvironment() error = %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	err = runCLI(context.Background(), cfg, nil, []string{"validate-templates", "-index-type", MultiPageIdentifier}, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("runCLI() error = %v", err)
+	}
+	assert.Equal(t, "multipage.index.html.tmpl: ok\n", stdout.String())
+
+	stdout.Reset()
+	err = runCLI(context.Background(), cfg, nil, []string{"validate-templates"}, &stdout, &stderr)
+	assert.ErrorContains(t, err, "INDEX_TYPE")
+}
+
+func TestRunCLIFlagsOverrideUnparsableEnvironment(t *testing.T) {
+	t.Setenv("INCREMENTAL", "maybe")
+
+	cfg, envErr := parseConfigFromEnvironment()
+	assert.ErrorContains(t, envErr, "INCREMENTAL")
+
+	var stdout, stderr bytes.Buffer
+	err := runCLI(context.Background(), cfg, envErr, []string{"validate-templates", "-incremental=false", "-index-type", MultiPageIdentifier}, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("runCLI() error = %v", err)
+	}
+	assert.Equal(t, "multipage.index.html.tmpl: ok\n", stdout.String())
+
+	err = runCLI(context.Background(), cfg, envErr, []string{"validate-templates", "-index-type", MultiPageIdentifier}, &stdout, &stderr)
+	assert.ErrorContains(t, err, "INCREMENTAL")
+}
+
+func TestRunCLIGenerateAndDiff(t *testing.T) {
+	sourceDir := t.TempDir()
+	outputDir := t.TempDir()
+	writeTestFiles(t, sourceDir, "product/1.0.0/product_1.0.0_linux_amd64.zip")
+
+	var stdout, stderr bytes.Buffer
+	err := runCLI(context.Background(), testCLIConfig(), nil, []string{"diff", "file://" + sourceDir, outputDir}, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("runCLI(diff) error = %v", err)
+	}
+	assert.Contains(t, stdout.String(), "+ /product/1.0.0/index.html")
+
+	err = runCLI(context.Background(), testCLIConfig(), nil, []string{"generate", "-output", outputDir, "file://" + sourceDir}, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("runCLI(generate) error = %v", err)
+	}
+	_, err = os.Stat(filepath.Join(outputDir, "product", "1.0.0", "index.json"))
+	assert.NoError(t, err)
+
+	stdout.Reset()
+	err = runCLI(context.Background(), testCLIConfig(), nil, []string{"diff", "file://" + sourceDir, outputDir}, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("runCLI(diff) error = %v", err)
+	}
+	assert.Empty(t, strings.TrimSpace(stdout.String()))
+}
+
+func TestRunCLIGenerateInPlace(t *testing.T) {
+	sourceDir := t.TempDir()
+	writeTestFiles(t, sourceDir, "product/1.0.0/product_1.0.0_linux_amd64.zip")
+
+	var stdout, stderr bytes.Buffer
+	for i := 0; i < 2; i++ {
+		err := runCLI(context.Background(), testCLIConfig(), nil, []string{"generate", "file://" + sourceDir}, &stdout, &stderr)
+		if err != nil {
+			t.Fatalf("runCLI(generate) error = %v", err)
+		}
+	}
+
+	// the indexes and static files from the first run aren't indexed by the second
+	_, err := os.Stat(filepath.Join(sourceDir, "static", "index.html"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	for _, indexPath := range []string{"index.json", "product/1.0.0/index.json"} {
+		content, err := os.ReadFile(filepath.Join(sourceDir, indexPath))
+		if err != nil {
+			t.Fatalf("failed to read %v: %v", indexPath, err)
+		}
+		assert.NotContains(t, string(content), "index.html", indexPath)
+		assert.NotContains(t, string(content), "static", indexPath)
+	}
+}
+
+func TestRunCLIDryRun(t *testing.T) {
+	sourceDir := t.TempDir()
+	outputDir := t.TempDir()
+	writeTestFiles(t, sourceDir, "product/1.0.0/product_1.0.0_linux_amd64.zip")
+
+	var stdout, stderr bytes.Buffer
+	err := runCLI(context.Background(), testCLIConfig(), nil, []string{"generate", "-dry-run", "-plan-format", "json", "file://" + sourceDir, outputDir}, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("runCLI() error = %v", err)
+	}
+
+	plan := &OutputPlan{}
+	err = json.Unmarshal(stdout.Bytes(), plan)
+	if err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	assert.Equal(t, len(plan.Files), plan.Created)
+
+	i := slices.IndexFunc(plan.Files, func(d OutputDiff) bool {
+		return d.Path == "/product/1.0.0/index.json"
+	})
+	if i < 0 {
+		t.Fatalf("expected /product/1.0.0/index.json in plan, got %v", plan.Files)
+	}
+	assert.Equal(t, CreatedOutput, plan.Files[i].Change)
+	assert.Positive(t, plan.Files[i].Size)
+
+	// nothing is written
+	entries, err := os.ReadDir(outputDir)
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	assert.Empty(t, entries)
+}
+
+func TestRunCLIInvoke(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	args := []string{"invoke", "-bucket", "bucket-a", "-sqs", "product/index.html", "product/index.json"}
+	err := runCLI(context.Background(), testCLIConfig(), nil, args, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("runCLI() error = %v", err)
+	}
+
+	summary := &BatchSummary{}
+	err = json.Unmarshal(stdout.Bytes(), summary)
+	if err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	assert.Equal(t, 2, summary.Messages)
+	assert.Len(t, summary.Skipped, 2)
+	assert.Empty(t, summary.BatchItemFailures)
+
+	err = runCLI(context.Background(), testCLIConfig(), nil, []string{"invoke"}, &stdout, &stderr)
+	assert.Error(t, err)
+}
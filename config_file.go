@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	aferos3 "github.com/fclairamb/afero-s3"
+	"github.com/spf13/afero"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFile is a YAML or JSON file describing several indexing jobs.
+// Settings left out of a job are taken from the environment and flags.
+type ConfigFile struct {
+	Jobs []JobConfig `yaml:"jobs" json:"jobs"`
+}
+
+// JobConfig is a single indexing job within a ConfigFile.
+type JobConfig struct {
+	Name              string   `yaml:"name" json:"name"`
+	Bucket            string   `yaml:"bucket" json:"bucket"`
+	ObjectPrefix      string   `yaml:"object_prefix" json:"object_prefix"`
+	DestinationPrefix string   `yaml:"destination_prefix" json:"destination_prefix"`
+	IndexType         string   `yaml:"index_type" json:"index_type"`
+	IndexFormats      []string `yaml:"index_formats" json:"index_formats"`
+	IndexTemplate     string   `yaml:"index_template" json:"index_template"`
+	TemplateURL       string   `yaml:"template_url" json:"template_url"`
+	StaticURL         string   `yaml:"static_url" json:"static_url"`
+	// Exclusions are added to those configured for every job
+	Exclusions JobExclusions `yaml:"exclusions" json:"exclusions"`
+	// ReleaseKeyExtractors are regular expressions with named groups used to
+	// extract release details from keys, replacing the default extractor
+	ReleaseKeyExtractors []string `yaml:"release_key_extractors" json:"release_key_extractors"`
+}
+
+// JobExclusions are the objects left out of a job's indexes.
+type JobExclusions struct {
+	Prefixes       []string `yaml:"prefixes" json:"prefixes"`
+	Suffixes       []string `yaml:"suffixes" json:"suffixes"`
+	StorageClasses []string `yaml:"storage_classes" json:"storage_classes"`
+}
+
+// Apply returns base with the settings of the job applied to it, validating
+// the result.
+func (j JobConfig) Apply(base Config) (Config, error) {
+	cfg := base
+	cfg.Name = j.Name
+
+	if j.Bucket != "" {
+		cfg.Bucket = j.Bucket
+	}
+
+	if j.ObjectPrefix != "" {
+		cfg.ObjectPrefix = j.ObjectPrefix
+	}
+
+	if j.DestinationPrefix != "" {
+		cfg.DestinationBucketPrefix = j.DestinationPrefix
+	}
+
+	var errs []error
+
+	if j.IndexType != "" {
+		cfg.IndexType = j.IndexType
+		cfg.IndexTemplate = fmt.Sprintf("%v.index.html.tmpl", cfg.IndexType)
+	}
+
+	if j.IndexTemplate != "" {
+		cfg.IndexTemplate = j.IndexTemplate
+	}
+
+	if len(j.IndexFormats) > 0 {
+		formats, err := indexFormats(strings.Join(j.IndexFormats, ","))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("index_formats: %w", err))
+		}
+		cfg.IndexFormats = formats
+	}
+
+	if j.TemplateURL != "" {
+		templateURL, err := url.Parse(j.TemplateURL)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to parse template_url as URL: %w", err))
+		}
+		cfg.TemplateBucketURL = templateURL
+	}
+
+	if j.StaticURL != "" {
+		staticURL, err := url.Parse(j.StaticURL)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to parse static_url as URL: %w", err))
+		}
+		cfg.StaticBucketURL = staticURL
+	}
+
+	cfg.ExcludedPrefixes = append(slices.Clone(base.ExcludedPrefixes), j.Exclusions.Prefixes...)
+	cfg.ExcludedSuffixes = append(slices.Clone(base.ExcludedSuffixes), j.Exclusions.Suffixes...)
+	cfg.ExcludedStorageClasses = append(slices.Clone(base.ExcludedStorageClasses), j.Exclusions.StorageClasses...)
+
+	if len(j.ReleaseKeyExtractors) > 0 {
+		cfg.ReleaseKeyExtractors = j.ReleaseKeyExtractors
+	}
+
+	if len(errs) > 0 {
+		return cfg, errors.Join(errs...)
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// ParseConfigFile parses data as JSON if name ends in .json and as YAML
+// otherwise.
+func ParseConfigFile(name string, data []byte) (*ConfigFile, error) {
+	configFile := &ConfigFile{}
+
+	var err error
+	if strings.ToLower(path.Ext(name)) == ".json" {
+		err = json.Unmarshal(data, configFile)
+	} else {
+		err = yaml.Unmarshal(data, configFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %v: %w", name, err)
+	}
+
+	if len(configFile.Jobs) == 0 {
+		return nil, fmt.Errorf("config file %v defines no jobs", name)
+	}
+
+	return configFile, nil
+}
+
+// LoadConfigFile reads the config file at an s3:// URL or local path.
+func LoadConfigFile(sess *session.Session, configURL *url.URL) (*ConfigFile, error) {
+	var configFS afero.Fs = afero.NewOsFs()
+	if configURL.Scheme == "s3" {
+		configFS = aferos3.NewFs(configURL.Host, sess)
+	}
+
+	data, err := afero.ReadFile(configFS, configURL.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %v: %w", configURL.Redacted(), err)
+	}
+
+	return ParseConfigFile(configURL.Path, data)
+}
+
+// Configs returns the config for each job, applied to base.
+func (f *ConfigFile) Configs(base Config) ([]Config, error) {
+	configs := make([]Config, 0, len(f.Jobs))
+
+	var errs []error
+	for i, job := range f.Jobs {
+		cfg, err := job.Apply(base)
+		if err != nil {
+			name := job.Name
+			if name == "" {
+				name = fmt.Sprintf("%d", i)
+			}
+			errs = append(errs, fmt.Errorf("job %v: %w", name, err))
+		}
+		configs = append(configs, cfg)
+	}
+
+	return configs, errors.Join(errs...)
+}
+
+// jobConfigs returns the jobs defined by the config file at cfg.ConfigURL,
+// or just cfg if there isn't one.
+func jobConfigs(cfg Config) ([]Config, error) {
+	if cfg.ConfigURL == nil {
+		return []Config{cfg}, nil
+	}
+
+	configFile, err := LoadConfigFile(s3Session(cfg.S3), cfg.ConfigURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return configFile.Configs(cfg)
+}
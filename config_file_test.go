@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testConfigFileYAML = `
+jobs:
+  - name: releases
+    bucket: releases-bucket
+    object_prefix: data
+    destination_prefix: site
+    index_formats: [json]
+    exclusions:
+      prefixes: [data/internal/]
+      suffixes: [.sig]
+      storage_classes: [GLACIER]
+  - name: docs
+    object_prefix: docs
+    destination_prefix: docs-site
+    index_type: singlepage
+    template_url: s3://platform-bucket/templates
+    release_key_extractors:
+      - '(?P<Product>[^/]+)/(?P<Version>[^/]+)/(?P<PackageName>[^_]+)_(?P<OS>[^_]+)_(?P<Arch>[^\.]+)\.(?P<ArchiveType>.+)$'
+`
+
+func TestParseConfigFile(t *testing.T) {
+	base := testCLIConfig()
+	base.Bucket = "default-bucket"
+	base.ExcludedStorageClasses = []string{"DEEP_ARCHIVE"}
+
+	configFile, err := ParseConfigFile("config.yaml", []byte(testConfigFileYAML))
+	if err != nil {
+		t.Fatalf("ParseConfigFile() error = %v", err)
+	}
+
+	jobs, err := configFile.Configs(base)
+	if err != nil {
+		t.Fatalf("Configs() error = %v", err)
+	}
+
+	assert.Len(t, jobs, 2)
+
+	releases := jobs[0]
+	assert.Equal(t, "releases", releases.Name)
+	assert.Equal(t, "releases-bucket", releases.Bucket)
+	assert.Equal(t, "data", releases.ObjectPrefix)
+	assert.Equal(t, "site", releases.DestinationBucketPrefix)
+	assert.Equal(t, []IndexFormat{JSONIndex}, releases.IndexFormats)
+	assert.Equal(t, "multipage.index.html.tmpl", releases.IndexTemplate)
+	assert.Equal(t, []string{"data/internal/"}, releases.ExcludedPrefixes)
+	assert.Equal(t, []string{"DEEP_ARCHIVE", "GLACIER"}, releases.ExcludedStorageClasses)
+	assert.Equal(t, DioadIndexConfig, indexConfig(releases))
+
+	docs := jobs[1]
+	assert.Equal(t, "default-bucket", docs.Bucket)
+	assert.Equal(t, SinglePageIdentifier, docs.IndexType)
+	assert.Equal(t, "singlepage.index.html.tmpl", docs.IndexTemplate)
+	assert.Equal(t, "platform-bucket", docs.TemplateBucketURL.Host)
+	assert.Equal(t, []string{"DEEP_ARCHIVE"}, docs.ExcludedStorageClasses)
+	assert.Len(t, indexConfig(docs).KeyExtractions, 1)
+
+	details, err := indexConfig(docs).KeyExtractions.ExtractReleaseDetails("tool/1.0.0/tool_linux_amd64.tar.gz")
+	if err != nil {
+		t.Fatalf("ExtractReleaseDetails() error = %v", err)
+	}
+	assert.Equal(t, "linux", details["OS"])
+}
+
+func TestParseConfigFileJSON(t *testing.T) {
+	configFile, err := ParseConfigFile("config.json", []byte(`{"jobs": [{"name": "a", "object_prefix": "data"}]}`))
+	if err != nil {
+		t.Fatalf("ParseConfigFile() error = %v", err)
+	}
+
+	assert.Equal(t, "data", configFile.Jobs[0].ObjectPrefix)
+}
+
+func TestParseConfigFileErrors(t *testing.T) {
+	tests := map[string]string{
+		"no jobs":          `jobs: []`,
+		"bad index type":   `jobs: [{name: a, index_type: other}]`,
+		"bad extractor":    `jobs: [{name: a, release_key_extractors: ["(?P<Product"]}]`,
+		"bad format":       `jobs: [{name: a, index_formats: [htm]}]`,
+		"bad template url": `jobs: [{name: a, template_url: "https://example.com/templates"}]`,
+		"malformed input":  `jobs: [`,
+	}
+
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			configFile, err := ParseConfigFile("config.yaml", []byte(data))
+			if err == nil {
+				_, err = configFile.Configs(testCLIConfig())
+			}
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestJobConfigsFromLocalFile(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(configPath, []byte(testConfigFileYAML), 0644)
+	if err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+
+	base := testCLIConfig()
+	base.ConfigURL = &url.URL{Path: configPath}
+
+	jobs, err := jobConfigs(base)
+	if err != nil {
+		t.Fatalf("jobConfigs() error = %v", err)
+	}
+	assert.Len(t, jobs, 2)
+
+	jobs, err = jobConfigs(Config{Name: "env"})
+	if err != nil {
+		t.Fatalf("jobConfigs() error = %v", err)
+	}
+	assert.Equal(t, []Config{{Name: "env"}}, jobs)
+}
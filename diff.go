@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"regexp"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	CreatedOutput   = "created"
+	ChangedOutput   = "changed"
+	UnchangedOutput = "unchanged"
+
+	// nonceExpression matches the nonce rendered into HTML indexes, which
+	// differs on every render and is HTML escaped
+	nonceExpression = regexp.MustCompile(`(nonce-|nonce=")[^'"\s>]*`)
+)
+
+// OutputDiff describes how a rendered file differs from the existing output.
+type OutputDiff struct {
+	Path         string `json:"path"`
+	Change       string `json:"change"`
+	Size         int64  `json:"size"`
+	ExistingSize int64  `json:"existing_size,omitempty"`
+}
+
+// OutputPlan is the set of files a run would write, compared with those
+// already written.
+type OutputPlan struct {
+	Files     []OutputDiff `json:"files"`
+	Created   int          `json:"created"`
+	Changed   int          `json:"changed"`
+	Unchanged int          `json:"unchanged"`
+}
+
+func NewOutputPlan(diffs []OutputDiff) *OutputPlan {
+	p := &OutputPlan{Files: diffs}
+	for _, d := range diffs {
+		switch d.Change {
+		case CreatedOutput:
+			p.Created++
+		case ChangedOutput:
+			p.Changed++
+		case UnchangedOutput:
+			p.Unchanged++
+		}
+	}
+	return p
+}
+
+// WriteText writes the plan as one line per file followed by a summary.
+func (p *OutputPlan) WriteText(w io.Writer) error {
+	for _, d := range p.Files {
+		var err error
+		if d.Change == ChangedOutput {
+			_, err = fmt.Fprintf(w, "%-9v %v (%d -> %d bytes)\n", d.Change, d.Path, d.ExistingSize, d.Size)
+		} else {
+			_, err = fmt.Fprintf(w, "%-9v %v (%d bytes)\n", d.Change, d.Path, d.Size)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "%d created, %d changed, %d unchanged\n", p.Created, p.Changed, p.Unchanged)
+	return err
+}
+
+// WriteJSON writes the plan as JSON.
+func (p *OutputPlan) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(p)
+}
+
+// withoutNonce returns content with any rendered nonce blanked out, so that
+// otherwise identical renders compare equal.
+func withoutNonce(content []byte) []byte {
+	return nonceExpression.ReplaceAll(content, []byte("${1}"))
+}
+
+// DiffOutputs compares every file in rendered with the same path in existing,
+// ignoring nonces.
+func DiffOutputs(rendered afero.Fs, existing afero.Fs) ([]OutputDiff, error) {
+	diffs := make([]OutputDiff, 0)
+
+	err := afero.Walk(rendered, "/", func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		renderedContent, err := afero.ReadFile(rendered, filePath)
+		if err != nil {
+			return err
+		}
+
+		d := OutputDiff{
+			Path:   filePath,
+			Change: ChangedOutput,
+			Size:   int64(len(renderedContent)),
+		}
+
+		existingContent, err := afero.ReadFile(existing, filePath)
+		if errors.Is(err, fs.ErrNotExist) {
+			d.Change = CreatedOutput
+		} else if err != nil {
+			return err
+		} else {
+			d.ExistingSize = int64(len(existingContent))
+			if bytes.Equal(withoutNonce(renderedContent), withoutNonce(existingContent)) {
+				d.Change = UnchangedOutput
+			}
+		}
+
+		diffs = append(diffs, d)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return diffs, nil
+}
+
+// planIndexes runs index against an in-memory output rather than outputFS and
+// compares the result with outputFS. The enrichment cache isn't saved, so
+// nothing is written.
+func planIndexes(cfg Config, outputFS afero.Fs, index func(cfg Config, renderedFS afero.Fs) error) (*OutputPlan, error) {
+	cfg.EnrichmentCacheURL = nil
+
+	renderedFS := NewMemoryOutputFS()
+	err := index(cfg, renderedFS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate index files: %w", err)
+	}
+
+	diffs, err := DiffOutputs(renderedFS, outputFS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compare index files: %w", err)
+	}
+
+	return NewOutputPlan(diffs), nil
+}
+
+// logOutputPlan logs the files in plan that would be created or changed.
+func logOutputPlan(plan *OutputPlan) {
+	for _, d := range plan.Files {
+		if d.Change != UnchangedOutput {
+			log.Printf("DryRun: %v %v size:%d\n", d.Change, d.Path, d.Size)
+		}
+	}
+	log.Printf("DryRun: created:%d changed:%d unchanged:%d\n", plan.Created, plan.Changed, plan.Unchanged)
+}
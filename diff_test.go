@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithoutNonce(t *testing.T) {
+	a := []byte(`<meta content="style-src 'self' 'nonce-AbC&#43;/123'"><style nonce="zYx98765">`)
+	b := []byte(`<meta content="style-src 'self' 'nonce-QwErTy12'"><style nonce="00000000">`)
+
+	assert.Equal(t, string(withoutNonce(a)), string(withoutNonce(b)))
+}
+
+func TestDiffOutputs(t *testing.T) {
+	rendered := afero.NewMemMapFs()
+	existing := afero.NewMemMapFs()
+
+	afero.WriteFile(rendered, "/a/index.html", []byte("nonce-AAAAAAAA same"), 0644)
+	afero.WriteFile(rendered, "/a/index.json", []byte("new"), 0644)
+	afero.WriteFile(rendered, "/b/index.json", []byte("created"), 0644)
+
+	afero.WriteFile(existing, "/a/index.html", []byte("nonce-BBBBBBBB same"), 0644)
+	afero.WriteFile(existing, "/a/index.json", []byte("older"), 0644)
+
+	diffs, err := DiffOutputs(rendered, existing)
+	if err != nil {
+		t.Fatalf("DiffOutputs() error = %v", err)
+	}
+
+	assert.Equal(t, []OutputDiff{
+		{Path: "/a/index.html", Change: UnchangedOutput, Size: 19, ExistingSize: 19},
+		{Path: "/a/index.json", Change: ChangedOutput, Size: 3, ExistingSize: 5},
+		{Path: "/b/index.json", Change: CreatedOutput, Size: 7},
+	}, diffs)
+}
+
+func TestOutputPlan(t *testing.T) {
+	plan := NewOutputPlan([]OutputDiff{
+		{Path: "/a/index.html", Change: UnchangedOutput, Size: 19, ExistingSize: 19},
+		{Path: "/a/index.json", Change: ChangedOutput, Size: 3, ExistingSize: 5},
+		{Path: "/b/index.json", Change: CreatedOutput, Size: 7},
+	})
+
+	assert.Equal(t, 1, plan.Created)
+	assert.Equal(t, 1, plan.Changed)
+	assert.Equal(t, 1, plan.Unchanged)
+
+	var text bytes.Buffer
+	err := plan.WriteText(&text)
+	if err != nil {
+		t.Fatalf("WriteText() error = %v", err)
+	}
+	assert.Equal(t, `unchanged /a/index.html (19 bytes)
+changed   /a/index.json (5 -> 3 bytes)
+created   /b/index.json (7 bytes)
+1 created, 1 changed, 1 unchanged
+`, text.String())
+
+	var encoded bytes.Buffer
+	err = plan.WriteJSON(&encoded)
+	if err != nil {
+		t.Fatalf("WriteJSON() error = %v", err)
+	}
+
+	decoded := &OutputPlan{}
+	err = json.Unmarshal(encoded.Bytes(), decoded)
+	if err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	assert.Equal(t, plan, decoded)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+var (
+	ObjectCreatedDetailType = "Object Created"
+	ObjectDeletedDetailType = "Object Deleted"
+	ScheduledDetailType     = "Scheduled Event"
+)
+
+// eventEnvelope holds the fields used to tell apart the events the Lambda
+// accepts.
+type eventEnvelope struct {
+	Records []struct {
+		EventSource string `json:"eventSource"`
+	} `json:"Records"`
+	Source     string `json:"source"`
+	DetailType string `json:"detail-type"`
+}
+
+// S3EventBridgeDetail is the detail of an S3 Object Created or Object Deleted
+// event delivered through EventBridge.
+type S3EventBridgeDetail struct {
+	Bucket struct {
+		Name string `json:"name"`
+	} `json:"bucket"`
+	Object struct {
+		Key       string `json:"key"`
+		Size      int64  `json:"size"`
+		ETag      string `json:"etag"`
+		VersionID string `json:"version-id"`
+		Sequencer string `json:"sequencer"`
+	} `json:"object"`
+	Reason string `json:"reason"`
+}
+
+// s3EventFromEventBridge returns an S3 event with a single record describing
+// event, so that it's routed in the same way as an S3 event notification.
+func s3EventFromEventBridge(event events.EventBridgeEvent) (events.S3Event, error) {
+	var eventType string
+	switch event.DetailType {
+	case ObjectCreatedDetailType:
+		eventType = "ObjectCreated"
+	case ObjectDeletedDetailType:
+		eventType = "ObjectRemoved"
+	default:
+		return events.S3Event{}, fmt.Errorf("unsupported S3 event %q", event.DetailType)
+	}
+
+	detail := S3EventBridgeDetail{}
+	err := json.Unmarshal(event.Detail, &detail)
+	if err != nil {
+		return events.S3Event{}, fmt.Errorf("failed to parse %v detail: %w", event.DetailType, err)
+	}
+
+	// keys are URL encoded as they are in S3 event notifications
+	key, err := url.QueryUnescape(detail.Object.Key)
+	if err != nil {
+		return events.S3Event{}, fmt.Errorf("failed to decode key %v: %w", detail.Object.Key, err)
+	}
+
+	record := events.S3EventRecord{
+		EventSource: "aws:s3",
+		AWSRegion:   event.Region,
+		EventTime:   event.Time,
+		EventName:   fmt.Sprintf("%v:%v", eventType, detail.Reason),
+		S3: events.S3Entity{
+			Bucket: events.S3Bucket{Name: detail.Bucket.Name},
+			Object: events.S3Object{
+				Key:           detail.Object.Key,
+				URLDecodedKey: key,
+				Size:          detail.Object.Size,
+				ETag:          detail.Object.ETag,
+				VersionID:     detail.Object.VersionID,
+				Sequencer:     detail.Object.Sequencer,
+			},
+		},
+	}
+
+	return events.S3Event{Records: []events.S3EventRecord{record}}, nil
+}
+
+// s3EventFromPayload parses payload as either an S3 event notification or an
+// S3 event delivered through EventBridge.
+func s3EventFromPayload(payload []byte) (events.S3Event, error) {
+	envelope := eventEnvelope{}
+	err := json.Unmarshal(payload, &envelope)
+	if err != nil {
+		return events.S3Event{}, err
+	}
+
+	if envelope.Source == "aws.s3" {
+		event := events.EventBridgeEvent{}
+		err = json.Unmarshal(payload, &event)
+		if err != nil {
+			return events.S3Event{}, err
+		}
+		return s3EventFromEventBridge(event)
+	}
+
+	event := events.S3Event{}
+	err = json.Unmarshal(payload, &event)
+	return event, err
+}
+
+// handleScheduledEvent regenerates every job in full, repairing any drift
+// left by missed notifications. Jobs without a bucket can't be listed so are
+// skipped.
+func handleScheduledEvent(ctx context.Context, jobs []Config, event events.EventBridgeEvent, regenerate RegenerateFunc) (*EventSummary, error) {
+	summary := &EventSummary{
+		Regenerated: make([]*RegenerationTarget, 0),
+		Skipped:     make([]SkippedRecord, 0),
+	}
+
+	log.Printf("scheduled: resources:%v jobs:%d\n", event.Resources, len(jobs))
+
+	var errs []error
+	for _, cfg := range jobs {
+		if cfg.Bucket == "" {
+			reason := "job has no bucket to rebuild"
+			if cfg.Name != "" {
+				reason = fmt.Sprintf("%v: %v", cfg.Name, reason)
+			}
+			log.Printf("skipping: event:%v reason:%v\n", event.DetailType, reason)
+			summary.Skipped = append(summary.Skipped, SkippedRecord{EventName: event.DetailType, Reason: reason})
+			continue
+		}
+
+		target := &RegenerationTarget{
+			Job:               cfg.Name,
+			Bucket:            cfg.Bucket,
+			DestinationPrefix: cfg.DestinationBucketPrefix,
+			Keys:              make([]string, 0),
+		}
+
+		err := regenerate(ctx, cfg, nil)
+		if err != nil {
+			target.Error = err.Error()
+			errs = append(errs, fmt.Errorf("failed to rebuild %v/%v: %w", target.Bucket, target.DestinationPrefix, err))
+		}
+		summary.Regenerated = append(summary.Regenerated, target)
+	}
+
+	return summary, errors.Join(errs...)
+}
+
+// SyntheticScheduledEvent returns a scheduled event as sent by an EventBridge
+// schedule rule.
+func SyntheticScheduledEvent() events.EventBridgeEvent {
+	return events.EventBridgeEvent{
+		Version:    "0",
+		DetailType: ScheduledDetailType,
+		Source:     "aws.events",
+		Time:       time.Now().UTC(),
+		Resources:  []string{"arn:aws:events:::rule/s3-index-generator"},
+		Detail:     json.RawMessage("{}"),
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func eventBridgeS3Payload(detailType string, bucket string, key string, reason string) string {
+	return `{
+  "version": "0",
+  "id": "17793124-05d4-b198-2fde-7ededc63b103",
+  "detail-type": "` + detailType + `",
+  "source": "aws.s3",
+  "account": "123456789012",
+  "time": "2024-06-01T10:00:00Z",
+  "region": "eu-west-2",
+  "resources": ["arn:aws:s3:::` + bucket + `"],
+  "detail": {
+    "version": "0",
+    "bucket": {"name": "` + bucket + `"},
+    "object": {"key": "` + key + `", "size": 5, "etag": "b1946ac92492d2347c6235b4d2611184", "sequencer": "00617F08299329D189"},
+    "request-id": "N4N7GDK58NMKJ12R",
+    "requester": "123456789012",
+    "reason": "` + reason + `"
+  }
+}`
+}
+
+func TestS3EventFromPayload(t *testing.T) {
+	tests := map[string]struct {
+		payload   string
+		eventName string
+		key       string
+	}{
+		"created": {
+			payload:   eventBridgeS3Payload(ObjectCreatedDetailType, "bucket-a", "data/product+name/1.0.0/product.zip", "PutObject"),
+			eventName: "ObjectCreated:PutObject",
+			key:       "data/product name/1.0.0/product.zip",
+		},
+		"deleted": {
+			payload:   eventBridgeS3Payload(ObjectDeletedDetailType, "bucket-a", "data/product/1.0.0/product.zip", "DeleteObject"),
+			eventName: "ObjectRemoved:DeleteObject",
+			key:       "data/product/1.0.0/product.zip",
+		},
+		"notification": {
+			payload:   `{"Records":[{"eventSource":"aws:s3","eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"bucket-a"},"object":{"key":"data/product/1.0.0/product.zip"}}}]}`,
+			eventName: "ObjectCreated:Put",
+			key:       "data/product/1.0.0/product.zip",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			event, err := s3EventFromPayload([]byte(tt.payload))
+			if err != nil {
+				t.Fatalf("s3EventFromPayload() error = %v", err)
+			}
+
+			assert.Len(t, event.Records, 1)
+			assert.Equal(t, tt.eventName, event.Records[0].EventName)
+			assert.Equal(t, "bucket-a", event.Records[0].S3.Bucket.Name)
+			assert.Equal(t, tt.key, recordKey(event.Records[0]))
+		})
+	}
+
+	_, err := s3EventFromPayload([]byte(eventBridgeS3Payload("Object Restore Completed", "bucket-a", "file.zip", "")))
+	assert.Error(t, err)
+}
+
+func TestHandleSQSEventEventBridgeMessages(t *testing.T) {
+	cfg := Config{ObjectPrefix: "data"}
+	event := events.SQSEvent{
+		Records: []events.SQSMessage{
+			{MessageId: "created", Body: eventBridgeS3Payload(ObjectCreatedDetailType, "bucket-a", "data/product/1.0.0/product.zip", "PutObject")},
+			{MessageId: "deleted", Body: eventBridgeS3Payload(ObjectDeletedDetailType, "bucket-a", "data/product/0.9.0/product.zip", "DeleteObject")},
+		},
+	}
+
+	calls := make([]regenerateCall, 0)
+	summary, err := handleSQSEvent(context.Background(), []Config{cfg}, event, recordingRegenerate(&calls, nil))
+	if err != nil {
+		t.Fatalf("handleSQSEvent() error = %v", err)
+	}
+
+	assert.Equal(t, []regenerateCall{
+		{bucket: "bucket-a", keys: []string{"data/product/1.0.0/product.zip", "data/product/0.9.0/product.zip"}},
+	}, calls)
+	assert.Empty(t, summary.BatchItemFailures)
+}
+
+func TestHandleScheduledEvent(t *testing.T) {
+	jobs := []Config{
+		{Name: "releases", Bucket: "bucket-a", DestinationBucketPrefix: "site"},
+		{Name: "any"},
+		{Name: "broken", Bucket: "bucket-b"},
+	}
+
+	calls := make([]regenerateCall, 0)
+	regenerate := func(ctx context.Context, cfg Config, keys []string) error {
+		calls = append(calls, regenerateCall{bucket: cfg.Bucket, prefix: cfg.DestinationBucketPrefix, keys: keys})
+		if cfg.Name == "broken" {
+			return errors.New("boom")
+		}
+		return nil
+	}
+
+	summary, err := handleScheduledEvent(context.Background(), jobs, SyntheticScheduledEvent(), regenerate)
+	assert.ErrorContains(t, err, "boom")
+
+	assert.Equal(t, []regenerateCall{
+		{bucket: "bucket-a", prefix: "site"},
+		{bucket: "bucket-b"},
+	}, calls)
+	assert.Len(t, summary.Regenerated, 2)
+	assert.Equal(t, "boom", summary.Regenerated[1].Error)
+	assert.Len(t, summary.Skipped, 1)
+	assert.Contains(t, summary.Skipped[0].Reason, "any")
+}
+
+func TestHandleRequestUnsupportedEvents(t *testing.T) {
+	handler := HandleRequest(NewSessions(testCLIConfig()), []Config{testCLIConfig()})
+
+	for name, payload := range map[string]string{
+		"eventbridge": `{"source":"aws.events","detail-type":"EC2 Instance State-change Notification","detail":{}}`,
+		"unknown":     `{"source":"aws.ec2","detail-type":"EC2 Instance State-change Notification","detail":{}}`,
+		"empty":       `{}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := handler(context.Background(), json.RawMessage(payload))
+			assert.Error(t, err)
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
-import "strings"
+import (
+	"slices"
+	"strings"
+)
 
 // PredicateFunc is a function that excludes paths.
 type PredicateFunc func(string) bool
@@ -36,6 +39,31 @@ func (i Inclusions) Include(key string) bool {
 	return false
 }
 
+// ObjectPredicateFunc is a function that excludes objects based on more than
+// just their key.
+type ObjectPredicateFunc func(Object) bool
+
+// ObjectExclusions is a list of functions that exclude objects.
+type ObjectExclusions []ObjectPredicateFunc
+
+// Include returns true if the object should be included.
+func (e ObjectExclusions) Include(o Object) bool {
+	for _, excludeFunc := range e {
+		if excludeFunc(o) {
+			return false
+		}
+	}
+	return true
+}
+
+// HasStorageClass returns a function that excludes objects in any of the given
+// storage classes.
+func HasStorageClass(storageClasses ...string) ObjectPredicateFunc {
+	return func(o Object) bool {
+		return slices.Contains(storageClasses, o.StorageClass())
+	}
+}
+
 // HasKey returns a function that excludes paths with the given key.
 func HasKey(key string) PredicateFunc {
 	return func(path string) bool {
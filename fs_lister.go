@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/afero"
+)
+
+var fsListerPageSize = 1000
+
+// FSLister lists the files within an afero.Fs as objects, keyed by their path
+// relative to the root of the filesystem.
+type FSLister struct {
+	fs afero.Fs
+}
+
+func NewFSLister(fs afero.Fs) *FSLister {
+	return &FSLister{fs: fs}
+}
+
+// NewLocalLister returns an FSLister for a directory on disk.
+func NewLocalLister(dir string) *FSLister {
+	return NewFSLister(afero.NewBasePathFs(afero.NewOsFs(), dir))
+}
+
+func (l *FSLister) ListObjects(ctx context.Context, prefix string) ([]Object, error) {
+	return CollectPages(l.ListObjectPages)(ctx, prefix)
+}
+
+// ListObjectPages walks the directory containing prefix, passing the files
+// whose keys start with prefix to fn in pages.
+func (l *FSLister) ListObjectPages(ctx context.Context, prefix string, fn ObjectPageFunc) error {
+	// only walk the deepest directory that can contain keys with prefix
+	walkRoot := path.Join("/", path.Dir(prefix+"_"))
+
+	page := make([]Object, 0, fsListerPageSize)
+	err := afero.Walk(l.fs, walkRoot, func(filePath string, info os.FileInfo, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && filePath == walkRoot {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		key := strings.TrimPrefix(filepath.ToSlash(filePath), "/")
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		size := info.Size()
+		lastModified := info.ModTime()
+		page = append(page, NewObject(&s3.Object{
+			Key:          &key,
+			Size:         &size,
+			LastModified: &lastModified,
+		}))
+
+		if len(page) == fsListerPageSize {
+			pageErr := fn(page)
+			page = make([]Object, 0, fsListerPageSize)
+			return pageErr
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(page) > 0 {
+		return fn(page)
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFSLister(t *testing.T) {
+	localFS := afero.NewMemMapFs()
+	for name, content := range map[string]string{
+		"/connect/0.57.1/connect_linux_amd64.zip": "amd64",
+		"/connect/0.57.1/connect_linux_arm64.zip": "arm64",
+		"/connect/0.57.0/connect_linux_amd64.zip": "old",
+		"/README.md": "readme",
+	} {
+		err := afero.WriteFile(localFS, name, []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+
+	tests := map[string]struct {
+		prefix string
+		count  int
+	}{
+		"all":            {prefix: "", count: 4},
+		"product":        {prefix: "connect", count: 3},
+		"version":        {prefix: "connect/0.57.1/", count: 2},
+		"partial name":   {prefix: "connect/0.57.1/connect_linux_a", count: 2},
+		"missing prefix": {prefix: "missing/dir/", count: 0},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			objects, err := NewFSLister(localFS).ListObjects(context.Background(), tc.prefix)
+			if err != nil {
+				t.Fatalf("ListObjects() error = %v", err)
+			}
+			assert.Len(t, objects, tc.count)
+		})
+	}
+}
+
+func TestFSListerObjects(t *testing.T) {
+	localFS := afero.NewMemMapFs()
+	err := afero.WriteFile(localFS, "/connect/0.57.1/connect_linux_amd64.zip", []byte("amd64"), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	tree := NewRootObjectTree(ObjectTreeConfig{})
+	err = tree.AddAllObjectsFromPageLister(context.Background(), NewFSLister(localFS).ListObjectPages)
+	if err != nil {
+		t.Fatalf("AddAllObjectsFromPageLister() error = %v", err)
+	}
+
+	objects := tree.Lookup("/connect/0.57.1").Objects
+	if assert.Len(t, objects, 1) {
+		assert.Equal(t, "connect/0.57.1/connect_linux_amd64.zip", objects[0].Key())
+		assert.Equal(t, int64(5), objects[0].Size())
+		assert.False(t, objects[0].LastModified().IsZero())
+	}
+}
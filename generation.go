@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// generationMarkerFile holds the generation of the latest run to have started
+var generationMarkerFile = "/.latest-generation"
+
+// maxClaimAttempts is how many times a claim is retried when another run
+// writes the marker between it being read and replaced.
+var maxClaimAttempts = 10
+
+// ErrSuperseded is returned when a newer run has started writing to the
+// same output.
+var ErrSuperseded = errors.New("superseded by a newer generation")
+
+// errVersionMismatch is returned by WriteFileIfVersion when a file has
+// changed since it was read.
+var errVersionMismatch = errors.New("changed since it was read")
+
+// GenerationMarker records the latest run to have started writing to an
+// output.
+type GenerationMarker struct {
+	Generation string `json:"generation"`
+	// Full is set if the run regenerates every index, rather than only those
+	// for the keys that changed
+	Full bool `json:"full"`
+}
+
+// SupersededError is returned once a newer generation has started, and
+// describes that generation.
+type SupersededError struct {
+	Latest GenerationMarker
+}
+
+func (e *SupersededError) Error() string {
+	return fmt.Sprintf("%v %v", ErrSuperseded, e.Latest.Generation)
+}
+
+func (e *SupersededError) Is(target error) bool {
+	return target == ErrSuperseded
+}
+
+// newGeneration returns a generation for a run starting now. Generations
+// sort in the order they were created.
+func newGeneration() string {
+	return time.Now().UTC().Format("20060102T150405.000000000Z")
+}
+
+// VersionedFs is implemented by outputs that can replace a file only if it
+// hasn't changed since it was read.
+type VersionedFs interface {
+	// ReadFileVersion returns the content of name and its current version,
+	// or fs.ErrNotExist if there isn't one
+	ReadFileVersion(name string) ([]byte, string, error)
+	// WriteFileIfVersion writes name if its version is still version, or if
+	// it doesn't exist when version is empty, and otherwise fails with
+	// errVersionMismatch
+	WriteFileIfVersion(name string, data []byte, version string) error
+}
+
+// versionMu serialises conditional writes to outputs that aren't a
+// VersionedFs, which only protects against runs within this process.
+var versionMu sync.Mutex
+
+func contentVersion(content []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(content))
+}
+
+// readFileVersion returns the content of name in outputFS and its version,
+// a hash of its content unless outputFS is a VersionedFs.
+func readFileVersion(outputFS afero.Fs, name string) ([]byte, string, error) {
+	if versioned, ok := outputFS.(VersionedFs); ok {
+		return versioned.ReadFileVersion(name)
+	}
+
+	content, err := afero.ReadFile(outputFS, name)
+	if err != nil {
+		return nil, "", err
+	}
+	return content, contentVersion(content), nil
+}
+
+// writeFileIfVersion writes data to name in outputFS only if its version is
+// still version, or it doesn't exist when version is empty.
+func writeFileIfVersion(outputFS afero.Fs, name string, data []byte, version string) error {
+	if versioned, ok := outputFS.(VersionedFs); ok {
+		return versioned.WriteFileIfVersion(name, data, version)
+	}
+
+	versionMu.Lock()
+	defer versionMu.Unlock()
+
+	_, current, err := readFileVersion(outputFS, name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if current != version {
+		return fmt.Errorf("%w: %v", errVersionMismatch, name)
+	}
+
+	return afero.WriteFile(outputFS, name, data, 0644)
+}
+
+// latestGeneration returns the generation marker in outputFS along with its
+// version, or an empty marker if there isn't one.
+func latestGeneration(outputFS afero.Fs) (GenerationMarker, string, error) {
+	marker := GenerationMarker{}
+
+	content, version, err := readFileVersion(outputFS, generationMarkerFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return marker, "", nil
+	}
+	if err != nil {
+		return marker, "", fmt.Errorf("failed to read generation marker: %w", err)
+	}
+
+	err = json.Unmarshal(content, &marker)
+	if err != nil {
+		return marker, "", fmt.Errorf("failed to parse generation marker: %w", err)
+	}
+
+	return marker, version, nil
+}
+
+// checkGeneration returns a *SupersededError if a generation newer than
+// generation is recorded in outputFS.
+func checkGeneration(outputFS afero.Fs, generation string) error {
+	latest, _, err := latestGeneration(outputFS)
+	if err != nil {
+		return err
+	}
+
+	if latest.Generation > generation {
+		return &SupersededError{Latest: latest}
+	}
+
+	return nil
+}
+
+// ClaimGeneration records generation as the latest to have started writing
+// to outputFS, unless a newer one already has. Generations sort by the time
+// they started, so a run that listed older data always loses. The marker is
+// only replaced if it's unchanged since it was checked, so of two runs
+// claiming at once the older can't overwrite the newer.
+func ClaimGeneration(outputFS afero.Fs, generation string, full bool) error {
+	content, err := json.Marshal(GenerationMarker{Generation: generation, Full: full})
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; attempt < maxClaimAttempts; attempt++ {
+		latest, version, err := latestGeneration(outputFS)
+		if err != nil {
+			return err
+		}
+
+		if latest.Generation > generation {
+			return &SupersededError{Latest: latest}
+		}
+
+		err = writeFileIfVersion(outputFS, generationMarkerFile, content, version)
+		if errors.Is(err, errVersionMismatch) {
+			// another run claimed in between, so check again
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write generation marker: %w", err)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("failed to claim generation %v after %d attempts", generation, maxClaimAttempts)
+}
+
+// GenerationGuardFs is an afero.Fs that checks the generation marker before
+// every write or removal, failing with ErrSuperseded once a newer generation
+// has started so that older output can't overwrite newer.
+type GenerationGuardFs struct {
+	afero.Fs
+
+	generation string
+}
+
+func NewGenerationGuardFs(fs afero.Fs, generation string) *GenerationGuardFs {
+	return &GenerationGuardFs{
+		Fs:         fs,
+		generation: generation,
+	}
+}
+
+func (g *GenerationGuardFs) Create(name string) (afero.File, error) {
+	err := checkGeneration(g.Fs, g.generation)
+	if err != nil {
+		return nil, err
+	}
+	return g.Fs.Create(name)
+}
+
+func (g *GenerationGuardFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		err := checkGeneration(g.Fs, g.generation)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return g.Fs.OpenFile(name, flag, perm)
+}
+
+func (g *GenerationGuardFs) Remove(name string) error {
+	err := checkGeneration(g.Fs, g.generation)
+	if err != nil {
+		return err
+	}
+	return g.Fs.Remove(name)
+}
+
+func (g *GenerationGuardFs) Rename(oldname, newname string) error {
+	err := checkGeneration(g.Fs, g.generation)
+	if err != nil {
+		return err
+	}
+	return g.Fs.Rename(oldname, newname)
+}
+
+func (g *GenerationGuardFs) CopyFile(src string, dst string) error {
+	err := checkGeneration(g.Fs, g.generation)
+	if err != nil {
+		return err
+	}
+	return copyFile(g.Fs, src, dst)
+}
+
+// hashedGenerationGuardFs is a GenerationGuardFs over a HashedFs, which stays
+// a HashedFs so that SkipUnchangedFs can compare hashes through the guard.
+type hashedGenerationGuardFs struct {
+	*GenerationGuardFs
+
+	hashed HashedFs
+}
+
+// guardGeneration wraps outputFS in a GenerationGuardFs for generation,
+// keeping it a HashedFs if outputFS is one.
+func guardGeneration(outputFS afero.Fs, generation string) afero.Fs {
+	guard := NewGenerationGuardFs(outputFS, generation)
+	if hashed, ok := outputFS.(HashedFs); ok {
+		return &hashedGenerationGuardFs{GenerationGuardFs: guard, hashed: hashed}
+	}
+	return guard
+}
+
+func (g *hashedGenerationGuardFs) ReadFileHash(name string) (string, error) {
+	return g.hashed.ReadFileHash(name)
+}
+
+func (g *hashedGenerationGuardFs) WriteFileWithHash(name string, data []byte, hash string) error {
+	err := checkGeneration(g.Fs, g.generation)
+	if err != nil {
+		return err
+	}
+	return g.hashed.WriteFileWithHash(name, data, hash)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClaimGeneration(t *testing.T) {
+	outputFS := NewMemoryOutputFS()
+
+	assert.NoError(t, ClaimGeneration(outputFS, "20240601T100000.000000000Z", true))
+	assert.NoError(t, ClaimGeneration(outputFS, "20240601T100001.000000000Z", false))
+
+	err := ClaimGeneration(outputFS, "20240601T100000.500000000Z", true)
+	assert.ErrorIs(t, err, ErrSuperseded)
+	var supersededErr *SupersededError
+	if assert.ErrorAs(t, err, &supersededErr) {
+		assert.Equal(t, GenerationMarker{Generation: "20240601T100001.000000000Z"}, supersededErr.Latest)
+	}
+
+	latest, _, err := latestGeneration(outputFS)
+	if err != nil {
+		t.Fatalf("latestGeneration() error = %v", err)
+	}
+	assert.Equal(t, GenerationMarker{Generation: "20240601T100001.000000000Z", Full: false}, latest)
+}
+
+func TestClaimGenerationConcurrent(t *testing.T) {
+	outputFS := NewMemoryOutputFS()
+
+	generations := make([]string, 0)
+	for i := 0; i < 20; i++ {
+		generations = append(generations, fmt.Sprintf("20240601T1000%02d.000000000Z", i))
+	}
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, generation := range generations {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			err := ClaimGeneration(outputFS, generation, true)
+			if err != nil && !errors.Is(err, ErrSuperseded) {
+				t.Errorf("ClaimGeneration() error = %v", err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	// an older claim never replaces a newer one however they interleave
+	latest, _, err := latestGeneration(outputFS)
+	if err != nil {
+		t.Fatalf("latestGeneration() error = %v", err)
+	}
+	assert.Equal(t, generations[len(generations)-1], latest.Generation)
+}
+
+func TestS3OutputFsClaimGeneration(t *testing.T) {
+	server := newFakeS3Server(t)
+	outputFS := NewS3OutputFS(server.Session(), "bucket-a", "site", aws.String(""))
+
+	_, version, err := readFileVersion(outputFS, generationMarkerFile)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	assert.NoError(t, ClaimGeneration(outputFS, "20240601T100000.000000000Z", true))
+
+	// a claim made against a marker that has since changed is rejected
+	err = writeFileIfVersion(outputFS, generationMarkerFile, []byte("{}"), version)
+	assert.ErrorIs(t, err, errVersionMismatch)
+
+	assert.NoError(t, ClaimGeneration(outputFS, "20240601T100001.000000000Z", false))
+	assert.ErrorIs(t, ClaimGeneration(outputFS, "20240601T100000.500000000Z", true), ErrSuperseded)
+
+	latest, _, err := latestGeneration(outputFS)
+	if err != nil {
+		t.Fatalf("latestGeneration() error = %v", err)
+	}
+	assert.Equal(t, "20240601T100001.000000000Z", latest.Generation)
+}
+
+func TestGenerationGuardFs(t *testing.T) {
+	outputFS := NewMemoryOutputFS()
+	afero.WriteFile(outputFS, "/a/index.html", []byte("old"), 0644)
+
+	older := "20240601T100000.000000000Z"
+	assert.NoError(t, ClaimGeneration(outputFS, older, true))
+
+	guardFS := NewGenerationGuardFs(outputFS, older)
+	assert.NoError(t, afero.WriteFile(guardFS, "/index.html", []byte("older"), 0644))
+
+	assert.NoError(t, ClaimGeneration(outputFS, "20240601T100001.000000000Z", true))
+
+	assert.ErrorIs(t, afero.WriteFile(guardFS, "/index.html", []byte("stale"), 0644), ErrSuperseded)
+	assert.ErrorIs(t, guardFS.Remove("/a/index.html"), ErrSuperseded)
+
+	content, _ := afero.ReadFile(guardFS, "/index.html")
+	assert.Equal(t, "older", string(content))
+	exists, _ := afero.Exists(outputFS, "/a/index.html")
+	assert.True(t, exists)
+}
+
+func TestPublishIndexesSuperseded(t *testing.T) {
+	outputFS := NewMemoryOutputFS()
+	afero.WriteFile(outputFS, "/index.html", []byte("old"), 0644)
+
+	cfg := Config{GenerationGuard: true}
+	index := func(cfg Config, guardFS afero.Fs) error {
+		// a newer run starts while this one is listing
+		assert.NoError(t, ClaimGeneration(outputFS, newGeneration(), false))
+		return afero.WriteFile(guardFS, "/index.html", []byte("stale"), 0644)
+	}
+
+	err := publishIndexes(cfg, outputFS, true, index)
+	assert.ErrorIs(t, err, ErrSuperseded)
+
+	content, _ := afero.ReadFile(outputFS, "/index.html")
+	assert.Equal(t, "old", string(content))
+}
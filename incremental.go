@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// treePathForKey returns the FullPath of the ObjectTree node that AddObject
+// would place key in.
+func treePathForKey(cfg ObjectTreeConfig, key string) string {
+	parts := strings.Split(key, "/")
+	if len(parts) > 1 && parts[0] == cfg.PrefixToStrip {
+		parts = parts[1:]
+	}
+	return filepath.Join(append([]string{"/"}, parts[:len(parts)-1]...)...)
+}
+
+// prefixForTreePath returns the S3 prefix that lists the contents of the
+// ObjectTree node at treePath.
+func prefixForTreePath(cfg ObjectTreeConfig, treePath string) string {
+	parts := splitTreePath(treePath)
+	if cfg.PrefixToStrip != "" && !strings.Contains(cfg.PrefixToStrip, "/") {
+		parts = append([]string{cfg.PrefixToStrip}, parts...)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return strings.Join(parts, "/") + "/"
+}
+
+// DirtyTreePaths returns the ObjectTree paths containing keys, along with
+// all of their ancestors.
+func DirtyTreePaths(cfg ObjectTreeConfig, keys []string) []string {
+	dirty := make(map[string]bool)
+	for _, key := range keys {
+		p := treePathForKey(cfg, key)
+		for {
+			dirty[p] = true
+			if p == "/" {
+				break
+			}
+			p = filepath.Dir(p)
+		}
+	}
+
+	paths := make([]string, 0, len(dirty))
+	for p := range dirty {
+		paths = append(paths, p)
+	}
+	slices.Sort(paths)
+
+	return paths
+}
+
+// incrementalTreeBuilder populates a partial ObjectTree one directory at a
+// time.
+type incrementalTreeBuilder struct {
+	tree   *ObjectTree
+	lister DirectoryListerFunc
+	listed map[string]bool
+	// noObjects holds the listed paths that directly contain no objects
+	noObjects map[string]bool
+	mu        sync.Mutex
+}
+
+func (b *incrementalTreeBuilder) listPaths(ctx context.Context, paths []string) error {
+	errGroup, ctx := errgroup.WithContext(ctx)
+	errGroup.SetLimit(10)
+
+	for _, p := range paths {
+		if b.listed[p] {
+			continue
+		}
+		b.listed[p] = true
+
+		treePath := p
+		errGroup.Go(func() error {
+			return b.listPath(ctx, treePath)
+		})
+	}
+
+	return errGroup.Wait()
+}
+
+func (b *incrementalTreeBuilder) listPath(ctx context.Context, treePath string) error {
+	objects, commonPrefixes, err := b.lister(ctx, prefixForTreePath(b.tree.Config, treePath))
+	if err != nil {
+		return fmt.Errorf("error listing %v: %w", treePath, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(objects) == 0 {
+		b.noObjects[treePath] = true
+	}
+
+	if len(objects) == 0 && len(commonPrefixes) == 0 {
+		return nil
+	}
+
+	node := b.tree.AddPath(treePath)
+	if node == nil {
+		return nil
+	}
+
+	for _, commonPrefix := range commonPrefixes {
+		node.AddChild(filepath.Base(commonPrefix))
+	}
+
+	b.tree.AddObjects(objects)
+
+	return nil
+}
+
+// releaseIndexPaths returns the paths below the listed nodes at paths that
+// need to be listed for IndexForObjectTree to build product and archive
+// indexes.
+func (b *incrementalTreeBuilder) releaseIndexPaths(paths []string) []string {
+	expand := make([]string, 0)
+	for _, p := range paths {
+		node := b.tree.Lookup(p)
+		if node == nil {
+			continue
+		}
+
+		productTree := IsProductTree(node)
+		for _, child := range node.Children {
+			if !productTree || IsVersionTree(child) {
+				expand = append(expand, child.FullPath)
+			}
+		}
+	}
+	slices.Sort(expand)
+
+	return expand
+}
+
+// prune removes the listed nodes that contain neither objects nor children,
+// deepest first, such as a directory holding only index files that its
+// parent's listing added as a child. Nodes that weren't listed are left as
+// they are.
+func (b *incrementalTreeBuilder) prune() {
+	paths := make([]string, 0, len(b.noObjects))
+	for p := range b.noObjects {
+		paths = append(paths, p)
+	}
+	slices.SortFunc(paths, func(a, b string) int {
+		return strings.Count(b, "/") - strings.Count(a, "/")
+	})
+
+	for _, p := range paths {
+		if p == "/" {
+			continue
+		}
+
+		node := b.tree.Lookup(p)
+		if node == nil || len(node.Objects) > 0 || len(node.Children) > 0 {
+			continue
+		}
+
+		parent := b.tree.Lookup(filepath.Dir(p))
+		if parent != nil {
+			delete(parent.Children, filepath.Base(p))
+		}
+	}
+}
+
+// NewIncrementalObjectTree builds an ObjectTree containing only the nodes at
+// paths, listing each of them one level deep. If releaseIndexes is set the
+// product and version directories needed to build JSON release indexes
+// beneath those nodes are listed too.
+func NewIncrementalObjectTree(ctx context.Context, cfg ObjectTreeConfig, lister DirectoryListerFunc, paths []string, releaseIndexes bool) (*ObjectTree, error) {
+	b := &incrementalTreeBuilder{
+		tree:      NewRootObjectTree(cfg),
+		lister:    lister,
+		listed:    make(map[string]bool),
+		noObjects: make(map[string]bool),
+	}
+
+	err := b.listPaths(ctx, paths)
+	if err != nil {
+		return nil, err
+	}
+
+	if releaseIndexes {
+		children := b.releaseIndexPaths(paths)
+		err = b.listPaths(ctx, children)
+		if err != nil {
+			return nil, err
+		}
+
+		versions := b.releaseIndexPaths(productPaths(b.tree, children))
+		err = b.listPaths(ctx, versions)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	b.prune()
+
+	return b.tree, nil
+}
+
+func productPaths(tree *ObjectTree, paths []string) []string {
+	products := make([]string, 0)
+	for _, p := range paths {
+		node := tree.Lookup(p)
+		if node != nil && IsProductTree(node) {
+			products = append(products, p)
+		}
+	}
+	return products
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDirectoryLister lists keys as S3 would with a "/" delimiter, recording
+// each prefix it is asked for.
+func fakeDirectoryLister(keys []string, listed *[]string) DirectoryListerFunc {
+	var mu sync.Mutex
+	return func(ctx context.Context, prefix string) ([]Object, []string, error) {
+		mu.Lock()
+		*listed = append(*listed, prefix)
+		mu.Unlock()
+
+		objects := make([]Object, 0)
+		commonPrefixes := make([]string, 0)
+		for _, key := range keys {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			rest := strings.TrimPrefix(key, prefix)
+			if dir, _, found := strings.Cut(rest, "/"); found {
+				if !slices.Contains(commonPrefixes, prefix+dir+"/") {
+					commonPrefixes = append(commonPrefixes, prefix+dir+"/")
+				}
+				continue
+			}
+			objects = append(objects, simpleObject(key))
+		}
+		return objects, commonPrefixes, nil
+	}
+}
+
+func TestDirtyTreePaths(t *testing.T) {
+	cfg := ObjectTreeConfig{PrefixToStrip: "data"}
+	paths := DirtyTreePaths(cfg, []string{
+		"data/connect/0.57.1/connect_linux_amd64.zip",
+		"data/connect/0.57.1/connect_linux_arm64.zip",
+		"data/README.md",
+	})
+
+	assert.Equal(t, []string{"/", "/connect", "/connect/0.57.1"}, paths)
+}
+
+func TestPrefixForTreePath(t *testing.T) {
+	tests := map[string]struct {
+		prefixToStrip string
+		treePath      string
+		expected      string
+	}{
+		"root without prefix":  {prefixToStrip: "", treePath: "/", expected: ""},
+		"root with prefix":     {prefixToStrip: "data", treePath: "/", expected: "data/"},
+		"nested with prefix":   {prefixToStrip: "data", treePath: "/a/b", expected: "data/a/b/"},
+		"nested without strip": {prefixToStrip: "", treePath: "/a/b", expected: "a/b/"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg := ObjectTreeConfig{PrefixToStrip: tc.prefixToStrip}
+			assert.Equal(t, tc.expected, prefixForTreePath(cfg, tc.treePath))
+		})
+	}
+}
+
+func TestNewIncrementalObjectTree(t *testing.T) {
+	keys := []string{
+		"data/connect/0.57.0/connect_linux_amd64.zip",
+		"data/connect/0.57.1/connect_linux_amd64.zip",
+		"data/tunnel/1.0.0/tunnel_linux_amd64.zip",
+		"data/other/unrelated/file.txt",
+	}
+	cfg := ObjectTreeConfig{PrefixToStrip: "data"}
+	paths := DirtyTreePaths(cfg, []string{"data/connect/0.57.1/connect_linux_amd64.zip"})
+
+	listed := make([]string, 0)
+	tree, err := NewIncrementalObjectTree(context.Background(), cfg, fakeDirectoryLister(keys, &listed), paths, false)
+	if err != nil {
+		t.Fatalf("NewIncrementalObjectTree() error = %v", err)
+	}
+
+	assert.ElementsMatch(t, []string{"data/", "data/connect/", "data/connect/0.57.1/"}, listed)
+	assert.Len(t, tree.Lookup("/connect/0.57.1").Objects, 1)
+	assert.Len(t, tree.Lookup("/connect").Children, 2)
+	assert.Len(t, tree.Children, 3)
+	assert.Empty(t, tree.Lookup("/connect/0.57.0").Objects)
+}
+
+func TestNewIncrementalObjectTreeReleaseIndexes(t *testing.T) {
+	keys := []string{
+		"data/connect/0.57.0/connect_linux_amd64.zip",
+		"data/connect/0.57.1/connect_linux_amd64.zip",
+		"data/tunnel/1.0.0/tunnel_linux_amd64.zip",
+	}
+	cfg := ObjectTreeConfig{PrefixToStrip: "data"}
+	paths := DirtyTreePaths(cfg, []string{"data/connect/0.57.1/connect_linux_amd64.zip"})
+
+	listed := make([]string, 0)
+	tree, err := NewIncrementalObjectTree(context.Background(), cfg, fakeDirectoryLister(keys, &listed), paths, true)
+	if err != nil {
+		t.Fatalf("NewIncrementalObjectTree() error = %v", err)
+	}
+
+	archive := NewArchiveIndexForObjectTree(DioadIndexConfig, tree)
+	if archive == nil {
+		t.Fatalf("expected archive index")
+	}
+	assert.Len(t, archive.Product, 2)
+	assert.Len(t, archive.Product["connect"].Versions, 2)
+	assert.Len(t, archive.Product["connect"].Versions["0.57.0"].Builds, 1)
+	assert.Len(t, archive.Product["tunnel"].Versions["1.0.0"].Builds, 1)
+}
+
+func TestRenderObjectTreeIndexesForPaths(t *testing.T) {
+	tree := NewObjectTreeWithObjects(ObjectTreeConfig{}, []Object{
+		simpleObject("a/b/fileA"),
+		simpleObject("c/fileC"),
+	})
+
+	renderers := IndexRenderers{JSONIndexRenderer(DioadIndexConfig)}
+	destFS := afero.NewMemMapFs()
+
+	err := RenderObjectTreeIndexesForPaths(tree, renderers, destFS, []string{"/", "/a/b", "/missing"})
+	if err != nil {
+		t.Fatalf("RenderObjectTreeIndexesForPaths() error = %v", err)
+	}
+
+	for p, exists := range map[string]bool{
+		"/index.json":     true,
+		"/a/b/index.json": true,
+		"/a/index.json":   false,
+		"/c/index.json":   false,
+	} {
+		found, _ := afero.Exists(destFS, p)
+		assert.Equal(t, exists, found, p)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	aferos3 "github.com/fclairamb/afero-s3"
+	"github.com/spf13/afero"
+)
+
+var inventoryPageSize = 1000
+
+// InventoryManifest is the manifest.json written alongside an S3 Inventory
+// report.
+type InventoryManifest struct {
+	SourceBucket      string                  `json:"sourceBucket"`
+	DestinationBucket string                  `json:"destinationBucket"`
+	Version           string                  `json:"version"`
+	CreationTimestamp string                  `json:"creationTimestamp"`
+	FileFormat        string                  `json:"fileFormat"`
+	FileSchema        string                  `json:"fileSchema"`
+	Files             []InventoryManifestFile `json:"files"`
+}
+
+// InventoryManifestFile is a data file listed in an InventoryManifest.
+type InventoryManifestFile struct {
+	Key         string `json:"key"`
+	Size        int64  `json:"size"`
+	MD5Checksum string `json:"MD5checksum"`
+}
+
+// InventoryLister lists objects from an S3 Inventory report rather than the
+// bucket itself.
+type InventoryLister struct {
+	inventoryFS  afero.Fs
+	manifestPath string
+}
+
+// NewInventoryLister returns a lister for the inventory manifest at
+// manifestPath. Data files are read from their key within inventoryFS or,
+// if they aren't found there, from the data directory alongside the
+// manifest's parent as S3 lays them out.
+func NewInventoryLister(inventoryFS afero.Fs, manifestPath string) *InventoryLister {
+	return &InventoryLister{
+		inventoryFS:  inventoryFS,
+		manifestPath: manifestPath,
+	}
+}
+
+// NewInventoryListerFromURL returns a lister for the manifest at an s3:// URL
+// or local path.
+func NewInventoryListerFromURL(sess *session.Session, manifestURL *url.URL) *InventoryLister {
+	if manifestURL.Scheme == "s3" {
+		return NewInventoryLister(aferos3.NewFs(manifestURL.Host, sess), manifestURL.Path)
+	}
+	return NewInventoryLister(afero.NewOsFs(), manifestURL.Path)
+}
+
+func (l *InventoryLister) readManifest() (*InventoryManifest, error) {
+	data, err := afero.ReadFile(l.inventoryFS, l.manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read inventory manifest %v: %w", l.manifestPath, err)
+	}
+
+	manifest := &InventoryManifest{}
+	err = json.Unmarshal(data, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse inventory manifest %v: %w", l.manifestPath, err)
+	}
+
+	if manifest.FileFormat != "CSV" {
+		return nil, fmt.Errorf("unsupported inventory file format %v", manifest.FileFormat)
+	}
+
+	return manifest, nil
+}
+
+func (l *InventoryLister) openDataFile(key string) (afero.File, error) {
+	f, err := l.inventoryFS.Open(key)
+	if errors.Is(err, fs.ErrNotExist) {
+		localPath := path.Join(path.Dir(l.manifestPath), "..", "data", path.Base(key))
+		f, err = l.inventoryFS.Open(localPath)
+	}
+	return f, err
+}
+
+func (l *InventoryLister) ListObjects(ctx context.Context, prefix string) ([]Object, error) {
+	return CollectPages(l.ListObjectPages)(ctx, prefix)
+}
+
+// ListObjectPages reads each data file in the manifest, passing the objects
+// under prefix to fn in pages.
+func (l *InventoryLister) ListObjectPages(ctx context.Context, prefix string, fn ObjectPageFunc) error {
+	manifest, err := l.readManifest()
+	if err != nil {
+		return err
+	}
+
+	columns := inventoryColumns(manifest.FileSchema)
+	for _, required := range []string{"Key", "Size", "LastModifiedDate"} {
+		if _, exists := columns[required]; !exists {
+			return fmt.Errorf("inventory schema is missing %v column: %v", required, manifest.FileSchema)
+		}
+	}
+
+	for _, dataFile := range manifest.Files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err = l.listDataFile(dataFile.Key, columns, prefix, fn)
+		if err != nil {
+			return fmt.Errorf("failed to read inventory data file %v: %w", dataFile.Key, err)
+		}
+	}
+
+	return nil
+}
+
+func (l *InventoryLister) listDataFile(key string, columns map[string]int, prefix string, fn ObjectPageFunc) error {
+	f, err := l.openDataFile(key)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gzipReader, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gzipReader.Close()
+
+	csvReader := csv.NewReader(gzipReader)
+	csvReader.FieldsPerRecord = -1
+
+	page := make([]Object, 0, inventoryPageSize)
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		obj, err := inventoryObject(record, columns)
+		if err != nil {
+			return err
+		}
+
+		if obj == nil || !strings.HasPrefix(obj.Key(), prefix) {
+			continue
+		}
+
+		page = append(page, obj)
+		if len(page) == inventoryPageSize {
+			err = fn(page)
+			if err != nil {
+				return err
+			}
+			page = make([]Object, 0, inventoryPageSize)
+		}
+	}
+
+	if len(page) > 0 {
+		return fn(page)
+	}
+
+	return nil
+}
+
+// inventoryColumns maps the column names in an inventory file schema to
+// their positions.
+func inventoryColumns(fileSchema string) map[string]int {
+	columns := make(map[string]int)
+	for i, name := range strings.Split(fileSchema, ",") {
+		columns[strings.TrimSpace(name)] = i
+	}
+	return columns
+}
+
+// inventoryObject creates an Object from an inventory record, returning nil
+// for delete markers and non-current versions.
+func inventoryObject(record []string, columns map[string]int) (Object, error) {
+	field := func(name string) string {
+		i, exists := columns[name]
+		if !exists || i >= len(record) {
+			return ""
+		}
+		return record[i]
+	}
+
+	if field("IsLatest") == "false" || field("IsDeleteMarker") == "true" {
+		return nil, nil
+	}
+
+	key, err := url.QueryUnescape(field("Key"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode key %v: %w", field("Key"), err)
+	}
+
+	size, err := strconv.ParseInt(field("Size"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse size for %v: %w", key, err)
+	}
+
+	lastModified, err := time.Parse(time.RFC3339, field("LastModifiedDate"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse last modified date for %v: %w", key, err)
+	}
+
+	obj := &s3.Object{
+		Key:          &key,
+		Size:         &size,
+		LastModified: &lastModified,
+	}
+
+	if etag := field("ETag"); etag != "" {
+		obj.ETag = &etag
+	}
+
+	if storageClass := field("StorageClass"); storageClass != "" {
+		obj.StorageClass = &storageClass
+	}
+
+	return NewObject(obj), nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeInventoryDataFile(t *testing.T, inventoryFS afero.Fs, name string, rows string) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write([]byte(rows))
+	if err != nil {
+		t.Fatalf("failed to compress inventory data: %v", err)
+	}
+	w.Close()
+
+	err = afero.WriteFile(inventoryFS, name, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatalf("failed to write inventory data: %v", err)
+	}
+}
+
+func writeInventoryManifest(t *testing.T, inventoryFS afero.Fs, name string, manifest InventoryManifest) {
+	t.Helper()
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("failed to encode inventory manifest: %v", err)
+	}
+
+	err = afero.WriteFile(inventoryFS, name, data, 0644)
+	if err != nil {
+		t.Fatalf("failed to write inventory manifest: %v", err)
+	}
+}
+
+func TestInventoryLister(t *testing.T) {
+	inventoryFS := afero.NewMemMapFs()
+
+	writeInventoryDataFile(t, inventoryFS, "/inventory/bucket/config/data/one.csv.gz",
+		`"bucket","data/connect/0.57.1/connect_linux_amd64.zip","1024","2024-06-01T10:00:00.000Z","abc123","STANDARD"
+"bucket","data/connect/0.57.1/connect+linux+arm64.zip","2048","2024-06-01T10:00:00.000Z","def456","GLACIER"
+"bucket","other/file.txt","1","2024-06-01T10:00:00.000Z","ghi789","STANDARD"
+`)
+	writeInventoryDataFile(t, inventoryFS, "/inventory/bucket/config/data/two.csv.gz",
+		`"bucket","data/tunnel/1.0.0/tunnel_linux_amd64.zip","512","2024-06-02T10:00:00.000Z","jkl012","STANDARD"
+`)
+
+	writeInventoryManifest(t, inventoryFS, "/inventory/bucket/config/2024-06-03T00-00Z/manifest.json", InventoryManifest{
+		SourceBucket: "bucket",
+		FileFormat:   "CSV",
+		FileSchema:   "Bucket, Key, Size, LastModifiedDate, ETag, StorageClass",
+		Files: []InventoryManifestFile{
+			{Key: "inventory/bucket/config/data/one.csv.gz"},
+			{Key: "elsewhere/two.csv.gz"},
+		},
+	})
+
+	lister := NewInventoryLister(inventoryFS, "/inventory/bucket/config/2024-06-03T00-00Z/manifest.json")
+
+	objects, err := lister.ListObjects(context.Background(), "data")
+	if err != nil {
+		t.Fatalf("ListObjects() error = %v", err)
+	}
+
+	assert.Len(t, objects, 3)
+	assert.Equal(t, "data/connect/0.57.1/connect_linux_amd64.zip", objects[0].Key())
+	assert.Equal(t, int64(1024), objects[0].Size())
+	assert.Equal(t, "abc123", objects[0].ETag())
+	assert.False(t, objects[0].LastModified().IsZero())
+	assert.Equal(t, "data/connect/0.57.1/connect linux arm64.zip", objects[1].Key())
+	assert.Equal(t, "GLACIER", objects[1].StorageClass())
+	assert.Equal(t, "data/tunnel/1.0.0/tunnel_linux_amd64.zip", objects[2].Key())
+}
+
+func TestInventoryListerSkipsOldVersions(t *testing.T) {
+	inventoryFS := afero.NewMemMapFs()
+
+	writeInventoryDataFile(t, inventoryFS, "/data/one.csv.gz",
+		`"bucket","a/file","v2","true","false","1","2024-06-01T10:00:00.000Z"
+"bucket","a/file","v1","false","false","1","2024-05-01T10:00:00.000Z"
+"bucket","a/deleted","v1","true","true","","2024-05-01T10:00:00.000Z"
+`)
+
+	writeInventoryManifest(t, inventoryFS, "/manifest.json", InventoryManifest{
+		FileFormat: "CSV",
+		FileSchema: "Bucket, Key, VersionId, IsLatest, IsDeleteMarker, Size, LastModifiedDate",
+		Files:      []InventoryManifestFile{{Key: "data/one.csv.gz"}},
+	})
+
+	objects, err := NewInventoryLister(inventoryFS, "/manifest.json").ListObjects(context.Background(), "")
+	if err != nil {
+		t.Fatalf("ListObjects() error = %v", err)
+	}
+
+	assert.Len(t, objects, 1)
+}
+
+func TestInventoryListerUnsupportedFormat(t *testing.T) {
+	inventoryFS := afero.NewMemMapFs()
+
+	writeInventoryManifest(t, inventoryFS, "/manifest.json", InventoryManifest{
+		FileFormat: "Parquet",
+	})
+
+	_, err := NewInventoryLister(inventoryFS, "/manifest.json").ListObjects(context.Background(), "")
+	if err == nil {
+		t.Fatalf("ListObjects() expected error")
+	}
+}
@@ -1 +1,538 @@
 package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/spf13/afero"
+)
+
+// RegenerateFunc regenerates the indexes described by cfg in response to
+// changes to the given keys.
+type RegenerateFunc func(ctx context.Context, cfg Config, keys []string) error
+
+// EventSummary describes what was done, and what was skipped, while handling
+// an event.
+type EventSummary struct {
+	Records     int                   `json:"records"`
+	Regenerated []*RegenerationTarget `json:"regenerated,omitempty"`
+	Skipped     []SkippedRecord       `json:"skipped,omitempty"`
+}
+
+// RegenerationTarget is a distinct job, bucket and destination prefix that
+// was regenerated, along with the keys that caused it.
+type RegenerationTarget struct {
+	Job               string   `json:"job,omitempty"`
+	Bucket            string   `json:"bucket"`
+	DestinationPrefix string   `json:"destination_prefix"`
+	Keys              []string `json:"keys"`
+	Error             string   `json:"error,omitempty"`
+
+	cfg Config
+}
+
+// SkippedRecord is an event record that did not result in a regeneration.
+type SkippedRecord struct {
+	Bucket    string `json:"bucket"`
+	Key       string `json:"key"`
+	EventName string `json:"event_name"`
+	Reason    string `json:"reason"`
+}
+
+func (s *EventSummary) skip(record events.S3EventRecord, reason string) {
+	log.Printf("skipping: bucket:%v key:%v event:%v reason:%v\n",
+		record.S3.Bucket.Name, recordKey(record), record.EventName, reason)
+
+	s.Skipped = append(s.Skipped, SkippedRecord{
+		Bucket:    record.S3.Bucket.Name,
+		Key:       recordKey(record),
+		EventName: record.EventName,
+		Reason:    reason,
+	})
+}
+
+func recordKey(record events.S3EventRecord) string {
+	if record.S3.Object.URLDecodedKey != "" {
+		return record.S3.Object.URLDecodedKey
+	}
+	return record.S3.Object.Key
+}
+
+// destinationRelativeKey returns key relative to the destination prefix of
+// cfg, or false if key is outside it.
+func destinationRelativeKey(cfg Config, key string) (string, bool) {
+	relativeKey := strings.TrimPrefix(key, "/")
+
+	destinationPrefix := strings.Trim(cfg.DestinationBucketPrefix, "/")
+	if destinationPrefix == "" {
+		return relativeKey, true
+	}
+
+	return strings.CutPrefix(relativeKey, destinationPrefix+"/")
+}
+
+// generatedDirectory returns true if relativeKey is within a directory the
+// generator writes to, such as staged generations and static assets.
+func generatedDirectory(cfg Config, relativeKey string) bool {
+	if stagedKey(relativeKey) {
+		return true
+	}
+
+	return slices.Contains(cfg.IndexFormats, HTMLIndex) && strings.HasPrefix(relativeKey, "static/")
+}
+
+// stagedKey returns true if relativeKey is within a staged generation.
+func stagedKey(relativeKey string) bool {
+	return strings.HasPrefix(relativeKey, strings.TrimPrefix(stagingDirectory, "/")+"/")
+}
+
+// generatorFileKey returns true if relativeKey is one of the files the
+// generator keeps alongside the indexes to track its own runs.
+func generatorFileKey(relativeKey string) bool {
+	return slices.ContainsFunc([]string{generationManifestFile, generationMarkerFile, checkpointFile}, func(generatorFile string) bool {
+		return relativeKey == strings.TrimPrefix(generatorFile, "/")
+	})
+}
+
+// enrichmentCacheKey returns the key of the enrichment cache cfg keeps in
+// bucket, or an empty string if it's kept elsewhere.
+func enrichmentCacheKey(cfg Config, bucket string) string {
+	if cfg.EnrichmentCacheURL != nil && cfg.EnrichmentCacheURL.Scheme == "s3" && cfg.EnrichmentCacheURL.Host == bucket {
+		return strings.TrimPrefix(cfg.EnrichmentCacheURL.Path, "/")
+	}
+	return ""
+}
+
+// indexesInSource returns true if the indexes cfg writes land among the
+// objects it lists, which is when the destination prefix is the object
+// prefix or beneath it.
+func indexesInSource(cfg Config) bool {
+	objectPrefix := strings.Trim(cfg.ObjectPrefix, "/")
+	destinationPrefix := strings.Trim(cfg.DestinationBucketPrefix, "/")
+
+	return objectPrefix == "" || destinationPrefix == objectPrefix || strings.HasPrefix(destinationPrefix, objectPrefix+"/")
+}
+
+// staticFileKeys returns the destination relative keys of the static files
+// copied alongside HTML indexes. Files from a StaticBucketURL aren't known
+// until they're copied, so only the default static files are returned.
+func staticFileKeys(cfg Config) []string {
+	keys := make([]string, 0)
+	if !slices.Contains(cfg.IndexFormats, HTMLIndex) || cfg.StaticBucketURL != nil {
+		return keys
+	}
+
+	_ = fs.WalkDir(defaultStaticFS, "static", func(filePath string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			keys = append(keys, filePath)
+		}
+		return err
+	})
+
+	return keys
+}
+
+// generatedPrefixPredicate returns a predicate matching the prefixes, such as
+// the common prefixes of a directory listing, that only contain keys cfg
+// writes to bucket.
+func generatedPrefixPredicate(cfg Config, bucket string) PredicateFunc {
+	return func(prefix string) bool {
+		relativePrefix, found := destinationRelativeKey(cfg, prefix)
+		return found && stagedKey(relativePrefix)
+	}
+}
+
+// staticPrefixPredicate returns a predicate matching the prefixes that the
+// static files cfg copies are written beneath, which may hold objects of
+// their own.
+func staticPrefixPredicate(cfg Config) PredicateFunc {
+	return func(prefix string) bool {
+		relativePrefix, found := destinationRelativeKey(cfg, prefix)
+		return found && slices.Contains(cfg.IndexFormats, HTMLIndex) && strings.HasPrefix(relativePrefix, "static/")
+	}
+}
+
+// generatedKeyPredicate returns a predicate matching the keys of index files,
+// directory markers, static assets and caches that cfg writes to bucket, so
+// events caused by the generator's own output can be ignored.
+func generatedKeyPredicate(cfg Config, bucket string) PredicateFunc {
+	cacheKey := enrichmentCacheKey(cfg, bucket)
+	indexFiles := indexFileNames(cfg.IndexFormats)
+
+	return func(key string) bool {
+		if cacheKey != "" && strings.TrimPrefix(key, "/") == cacheKey {
+			return true
+		}
+
+		relativeKey, found := destinationRelativeKey(cfg, key)
+		if !found {
+			return false
+		}
+
+		if strings.HasSuffix(relativeKey, "/") || generatedDirectory(cfg, relativeKey) || generatorFileKey(relativeKey) {
+			return true
+		}
+
+		return slices.Contains(indexFiles, path.Base(relativeKey))
+	}
+}
+
+// listedKeyPredicate returns a predicate matching the keys cfg writes to
+// bucket that turn up when listing its objects: the indexes and directory
+// markers of the directories it renders, the default static files, staged
+// generations, the files tracking its runs and the enrichment cache.
+// Anything else is a user's object, even if it's named like an index or kept
+// in static/, so is left to be indexed.
+func listedKeyPredicate(cfg Config, bucket string) PredicateFunc {
+	cacheKey := enrichmentCacheKey(cfg, bucket)
+	staticKeys := staticFileKeys(cfg)
+	inSource := indexesInSource(cfg)
+	indexFiles := indexFileNames(cfg.IndexFormats)
+
+	return func(key string) bool {
+		if cacheKey != "" && strings.TrimPrefix(key, "/") == cacheKey {
+			return true
+		}
+
+		relativeKey, found := destinationRelativeKey(cfg, key)
+		if !found {
+			return false
+		}
+
+		if stagedKey(relativeKey) || generatorFileKey(relativeKey) || slices.Contains(staticKeys, relativeKey) {
+			return true
+		}
+
+		// the indexes only replace objects when they're written among them
+		return inSource && (strings.HasSuffix(relativeKey, "/") || slices.Contains(indexFiles, path.Base(relativeKey)))
+	}
+}
+
+// jobSkipReason returns why record doesn't match the job described by cfg,
+// or an empty string if it does.
+func jobSkipReason(cfg Config, record events.S3EventRecord) string {
+	bucket := record.S3.Bucket.Name
+	key := recordKey(record)
+
+	if cfg.Bucket != "" && bucket != cfg.Bucket {
+		return fmt.Sprintf("bucket does not match %v", cfg.Bucket)
+	}
+
+	if !strings.HasPrefix(key, cfg.ObjectPrefix) {
+		return fmt.Sprintf("key does not match prefix %v", cfg.ObjectPrefix)
+	}
+
+	return ""
+}
+
+// groupS3EventRecords groups the records of event that should be acted upon
+// by job, bucket and destination prefix, recording any others as skipped.
+// Keys generated by any of the jobs are skipped so that one job's output
+// can't trigger another.
+func groupS3EventRecords(jobs []Config, event events.S3Event, summary *EventSummary) []*RegenerationTarget {
+	targets := make([]*RegenerationTarget, 0)
+	targetIndex := make(map[string]*RegenerationTarget)
+
+	for _, record := range event.Records {
+		bucket := record.S3.Bucket.Name
+		key := recordKey(record)
+
+		log.Printf("record: bucket:%v key:%v event:%v\n", bucket, key, record.EventName)
+
+		generated := slices.ContainsFunc(jobs, func(cfg Config) bool {
+			return (cfg.Bucket == "" || cfg.Bucket == bucket) && generatedKeyPredicate(cfg, bucket)(key)
+		})
+		if generated {
+			summary.skip(record, "key was generated by s3-index-generator")
+			continue
+		}
+
+		reasons := make([]string, 0)
+		for i, cfg := range jobs {
+			if reason := jobSkipReason(cfg, record); reason != "" {
+				if cfg.Name != "" {
+					reason = fmt.Sprintf("%v: %v", cfg.Name, reason)
+				}
+				reasons = append(reasons, reason)
+				continue
+			}
+
+			targetKey := fmt.Sprintf("%d/%v/%v", i, bucket, cfg.DestinationBucketPrefix)
+			target, exists := targetIndex[targetKey]
+			if !exists {
+				target = &RegenerationTarget{
+					Job:               cfg.Name,
+					Bucket:            bucket,
+					DestinationPrefix: cfg.DestinationBucketPrefix,
+					Keys:              make([]string, 0),
+					cfg:               cfg,
+				}
+				targetIndex[targetKey] = target
+				targets = append(targets, target)
+			}
+			target.Keys = append(target.Keys, key)
+		}
+
+		if len(reasons) == len(jobs) {
+			summary.skip(record, strings.Join(reasons, "; "))
+		}
+	}
+
+	return targets
+}
+
+// handleS3Event regenerates the indexes of each job affected by event.
+func handleS3Event(ctx context.Context, jobs []Config, event events.S3Event, regenerate RegenerateFunc) (*EventSummary, error) {
+	summary := &EventSummary{
+		Records:     len(event.Records),
+		Regenerated: make([]*RegenerationTarget, 0),
+		Skipped:     make([]SkippedRecord, 0),
+	}
+
+	log.Printf("records length: %d\n", len(event.Records))
+
+	var errs []error
+	for _, target := range groupS3EventRecords(jobs, event, summary) {
+		targetCfg := target.cfg
+		targetCfg.Bucket = target.Bucket
+		targetCfg.DestinationBucketPrefix = target.DestinationPrefix
+
+		err := regenerate(ctx, targetCfg, target.Keys)
+		if err != nil {
+			target.Error = err.Error()
+			errs = append(errs, fmt.Errorf("failed to regenerate %v/%v: %w", target.Bucket, target.DestinationPrefix, err))
+		}
+		summary.Regenerated = append(summary.Regenerated, target)
+	}
+
+	return summary, errors.Join(errs...)
+}
+
+// lambdaRegenerate returns the RegenerateFunc used by the Lambda handler. It
+// writes to the destination bucket, or beneath the local output directory
+// when one is configured, as when invoked locally.
+func lambdaRegenerate(sessions *Sessions) RegenerateFunc {
+	return func(ctx context.Context, cfg Config, keys []string) error {
+		var outputFS afero.Fs
+		if cfg.LocalOutputDirectory != "" {
+			var err error
+			outputFS, err = NewLocalOutputFS(filepath.Join(cfg.LocalOutputDirectory, cfg.DestinationBucketPrefix))
+			if err != nil {
+				return fmt.Errorf("failed to create local output FS: %w", err)
+			}
+		} else {
+			outputFS = NewS3OutputFS(sessions.Destination, cfg.Bucket, cfg.DestinationBucketPrefix, &cfg.ServerSideEncryption)
+		}
+
+		checkpoint, err := LoadCheckpoint(outputFS)
+		if err != nil {
+			return err
+		}
+
+		resumeRequest := isResumeRequest(ctx)
+		if resumeRequest && checkpoint == nil {
+			log.Printf("resume: bucket:%v prefix:%v no checkpoint to resume\n", cfg.Bucket, cfg.DestinationBucketPrefix)
+			return nil
+		}
+
+		// a single page index embeds the whole tree so can't be regenerated
+		// incrementally. A full rebuild covers everything a checkpoint does
+		// so it starts over rather than resuming
+		resume := checkpoint != nil && cfg.IndexType == MultiPageIdentifier && (resumeRequest || len(keys) > 0)
+		incremental := resume || (cfg.Incremental && cfg.IndexType == MultiPageIdentifier && len(keys) > 0)
+
+		// pending directories beyond the batch resumed by this run
+		var deferred []string
+		batchSize := ResumeBatchSize
+		if checkpoint != nil {
+			batchSize = checkpoint.batchSize()
+		}
+
+		index := func(cfg Config, outputFS afero.Fs) error {
+			if resume {
+				pending := checkpoint.Pending
+				if len(pending) > batchSize {
+					pending, deferred = pending[:batchSize], pending[batchSize:]
+				}
+
+				paths := append(DirtyTreePaths(objectTreeConfig(cfg), keys), pending...)
+				slices.Sort(paths)
+				paths = slices.Compact(paths)
+				log.Printf("resuming: bucket:%v prefix:%v pending:%d deferred:%d paths:%d\n", cfg.Bucket, cfg.DestinationBucketPrefix, len(pending), len(deferred), len(paths))
+				return indexS3BucketPaths(ctx, sessions, cfg, outputFS, paths)
+			}
+
+			if incremental {
+				return indexS3BucketIncremental(ctx, sessions, cfg, outputFS, keys)
+			}
+
+			return indexS3Bucket(ctx, sessions, cfg, outputFS)
+		}
+
+		if cfg.DryRun {
+			plan, err := planIndexes(cfg, outputFS, index)
+			if err != nil {
+				return err
+			}
+			logOutputPlan(plan)
+			return nil
+		}
+
+		err = publishIndexes(cfg, outputFS, !incremental, index)
+		var publishErr *PublishError
+		if errors.As(err, &publishErr) {
+			log.Printf("publish failed: bucket:%v prefix:%v generation:%v promoted:%d files:%d\n", cfg.Bucket, cfg.DestinationBucketPrefix, publishErr.Generation, publishErr.Promoted, publishErr.Files)
+			return err
+		}
+
+		var supersededErr *SupersededError
+		if errors.As(err, &supersededErr) {
+			log.Printf("superseded: bucket:%v prefix:%v incremental:%v latest:%v full:%v\n", cfg.Bucket, cfg.DestinationBucketPrefix, incremental, supersededErr.Latest.Generation, supersededErr.Latest.Full)
+			// a newer full regeneration lists everything, but a newer
+			// incremental one only covers its own keys so this run is retried
+			if supersededErr.Latest.Full {
+				return nil
+			}
+			return err
+		}
+
+		var deadlineErr *DeadlineError
+		if errors.As(err, &deadlineErr) {
+			progressed := deadlineErr.Rendered > 0
+			if !progressed {
+				// list fewer directories next time so rendering is reached
+				batchSize = max(batchSize/2, 1)
+			}
+			return saveDeadlineCheckpoint(ctx, sessions, cfg, outputFS, append(deadlineErr.Pending, deferred...), batchSize, progressed)
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(deferred) > 0 {
+			return saveDeadlineCheckpoint(ctx, sessions, cfg, outputFS, deferred, batchSize, true)
+		}
+		if checkpoint != nil {
+			return RemoveCheckpoint(outputFS)
+		}
+		return nil
+	}
+}
+
+// reinvokeFunction resumes from a checkpoint in a new invocation.
+var reinvokeFunction = ReinvokeFunction
+
+// saveDeadlineCheckpoint records the directories still to render and how
+// many of them the next run should resume. If cfg.ReinvokeOnDeadline is set
+// it invokes the function again to resume from them, unless this run
+// rendered nothing, so that a job that can't make progress doesn't keep
+// invoking itself. The keys that caused the run are covered by the
+// checkpoint so the event isn't retried.
+func saveDeadlineCheckpoint(ctx context.Context, sessions *Sessions, cfg Config, outputFS afero.Fs, pending []string, batchSize int, progressed bool) error {
+	slices.Sort(pending)
+
+	checkpoint := &Checkpoint{
+		Job:               cfg.Name,
+		Bucket:            cfg.Bucket,
+		DestinationPrefix: cfg.DestinationBucketPrefix,
+		CreatedAt:         time.Now().UTC(),
+		Pending:           slices.Compact(pending),
+		BatchSize:         batchSize,
+	}
+
+	err := SaveCheckpoint(outputFS, checkpoint)
+	if err != nil {
+		return err
+	}
+	log.Printf("checkpoint: bucket:%v prefix:%v pending:%d progressed:%v\n", cfg.Bucket, cfg.DestinationBucketPrefix, len(checkpoint.Pending), progressed)
+
+	if cfg.ReinvokeOnDeadline && progressed {
+		// the checkpoint is picked up by the next event if this fails
+		err = reinvokeFunction(context.WithoutCancel(ctx), sessions.Lambda, checkpoint)
+		if err != nil {
+			log.Printf("failed to reinvoke: bucket:%v prefix:%v err:%v\n", cfg.Bucket, cfg.DestinationBucketPrefix, err)
+		}
+	}
+
+	return nil
+}
+
+// eventSource returns the source of payload, that of its first record for S3
+// and SQS events, such as aws:s3 or aws:sqs, or of the event itself for
+// EventBridge events, such as aws.s3 or aws.events.
+func eventSource(payload json.RawMessage) (string, error) {
+	envelope := eventEnvelope{}
+	err := json.Unmarshal(payload, &envelope)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse event: %w", err)
+	}
+
+	if len(envelope.Records) > 0 {
+		return envelope.Records[0].EventSource, nil
+	}
+
+	return envelope.Source, nil
+}
+
+// HandleRequest returns a Lambda handler that routes S3 events, SQS events
+// whose messages wrap S3 events, and S3 events delivered through EventBridge
+// to each of jobs whose bucket and prefix match. Scheduled events rebuild
+// every job in full, and resume events continue a job from its checkpoint.
+func HandleRequest(sessions *Sessions, jobs []Config) func(ctx context.Context, payload json.RawMessage) (any, error) {
+	regenerate := lambdaRegenerate(sessions)
+
+	return func(ctx context.Context, payload json.RawMessage) (any, error) {
+		source, err := eventSource(payload)
+		if err != nil {
+			return nil, err
+		}
+
+		switch source {
+		case "aws:sqs":
+			event := events.SQSEvent{}
+			err = json.Unmarshal(payload, &event)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse SQS event: %w", err)
+			}
+			return handleSQSEvent(ctx, jobs, event, regenerate)
+		case "aws:s3", "aws.s3":
+			event, err := s3EventFromPayload(payload)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse S3 event: %w", err)
+			}
+			return handleS3Event(ctx, jobs, event, regenerate)
+		case "aws.events":
+			event := events.EventBridgeEvent{}
+			err = json.Unmarshal(payload, &event)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse scheduled event: %w", err)
+			}
+			if event.DetailType != ScheduledDetailType {
+				return nil, fmt.Errorf("unsupported event %q", event.DetailType)
+			}
+			return handleScheduledEvent(ctx, jobs, event, regenerate)
+		case ResumeEventSource:
+			event := events.EventBridgeEvent{}
+			err = json.Unmarshal(payload, &event)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse resume event: %w", err)
+			}
+			if event.DetailType != ResumeDetailType {
+				return nil, fmt.Errorf("unsupported event %q", event.DetailType)
+			}
+			return handleResumeEvent(ctx, jobs, event, regenerate)
+		default:
+			return nil, fmt.Errorf("unsupported event source %q", source)
+		}
+	}
+}
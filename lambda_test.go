@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func s3EventRecord(bucket, key, eventName string) events.S3EventRecord {
+	return events.S3EventRecord{
+		EventName: eventName,
+		S3: events.S3Entity{
+			Bucket: events.S3Bucket{Name: bucket},
+			Object: events.S3Object{Key: key, URLDecodedKey: key},
+		},
+	}
+}
+
+type regenerateCall struct {
+	bucket string
+	prefix string
+	keys   []string
+}
+
+func recordingRegenerate(calls *[]regenerateCall, err error) RegenerateFunc {
+	return func(ctx context.Context, cfg Config, keys []string) error {
+		*calls = append(*calls, regenerateCall{
+			bucket: cfg.Bucket,
+			prefix: cfg.DestinationBucketPrefix,
+			keys:   keys,
+		})
+		return err
+	}
+}
+
+func TestHandleS3EventGroupsRecords(t *testing.T) {
+	cfg := Config{ObjectPrefix: "data"}
+	event := events.S3Event{
+		Records: []events.S3EventRecord{
+			s3EventRecord("bucket-a", "data/product/1.0.0/product_linux_amd64.zip", "ObjectCreated:Put"),
+			s3EventRecord("bucket-b", "data/product/1.0.0/product_linux_arm64.zip", "ObjectCreated:Put"),
+			s3EventRecord("bucket-a", "data/product/1.0.0/product_SHA256SUMS", "ObjectRemoved:Delete"),
+			s3EventRecord("bucket-a", "other/file.zip", "ObjectCreated:Put"),
+		},
+	}
+
+	calls := make([]regenerateCall, 0)
+	summary, err := handleS3Event(context.Background(), []Config{cfg}, event, recordingRegenerate(&calls, nil))
+	if err != nil {
+		t.Fatalf("handleS3Event() error = %v", err)
+	}
+
+	assert.Equal(t, []regenerateCall{
+		{bucket: "bucket-a", keys: []string{"data/product/1.0.0/product_linux_amd64.zip", "data/product/1.0.0/product_SHA256SUMS"}},
+		{bucket: "bucket-b", keys: []string{"data/product/1.0.0/product_linux_arm64.zip"}},
+	}, calls)
+
+	assert.Equal(t, 4, summary.Records)
+	assert.Len(t, summary.Regenerated, 2)
+	assert.Len(t, summary.Skipped, 1)
+	assert.Equal(t, "other/file.zip", summary.Skipped[0].Key)
+}
+
+func TestHandleS3EventBucketMismatch(t *testing.T) {
+	cfg := Config{Bucket: "bucket-a"}
+	event := events.S3Event{
+		Records: []events.S3EventRecord{
+			s3EventRecord("bucket-b", "file.zip", "ObjectCreated:Put"),
+		},
+	}
+
+	calls := make([]regenerateCall, 0)
+	summary, err := handleS3Event(context.Background(), []Config{cfg}, event, recordingRegenerate(&calls, nil))
+	if err != nil {
+		t.Fatalf("handleS3Event() error = %v", err)
+	}
+
+	assert.Empty(t, calls)
+	assert.Len(t, summary.Skipped, 1)
+}
+
+func TestHandleS3EventNoRecords(t *testing.T) {
+	calls := make([]regenerateCall, 0)
+	summary, err := handleS3Event(context.Background(), []Config{{}}, events.S3Event{}, recordingRegenerate(&calls, nil))
+	if err != nil {
+		t.Fatalf("handleS3Event() error = %v", err)
+	}
+
+	assert.Empty(t, calls)
+	assert.Equal(t, 0, summary.Records)
+}
+
+func TestHandleS3EventRegenerateError(t *testing.T) {
+	event := events.S3Event{
+		Records: []events.S3EventRecord{
+			s3EventRecord("bucket-a", "file.zip", "ObjectCreated:Put"),
+			s3EventRecord("bucket-b", "file.zip", "ObjectCreated:Put"),
+		},
+	}
+
+	calls := make([]regenerateCall, 0)
+	summary, err := handleS3Event(context.Background(), []Config{{}}, event, recordingRegenerate(&calls, errors.New("boom")))
+	if err == nil {
+		t.Fatalf("handleS3Event() expected error")
+	}
+
+	assert.Len(t, calls, 2)
+	assert.Equal(t, "boom", summary.Regenerated[0].Error)
+}
+
+func TestGeneratedKeyPredicate(t *testing.T) {
+	cfg := Config{
+		DestinationBucketPrefix: "site",
+		IndexFormats:            []IndexFormat{HTMLIndex, JSONIndex},
+		EnrichmentCacheURL:      &url.URL{Scheme: "s3", Host: "bucket", Path: "/.s3-index-generator/cache.json"},
+	}
+	isGenerated := generatedKeyPredicate(cfg, "bucket")
+
+	tests := map[string]bool{
+		"site/index.html":                         true,
+		".s3-index-generator/cache.json":          true,
+		"site/data/product/index.json":            true,
+		"site/static/style.css":                   true,
+		"site/data/product/":                      true,
+		"site/.staging/20240601T100000Z/a.txt":    true,
+		"site/.generation.json":                   true,
+		"site/.latest-generation":                 true,
+		"site/.checkpoint.json":                   true,
+		"data/product/1.0.0/product_linux_amd64":  false,
+		"other/index.html":                        false,
+		"site/data/product/1.0.0/product.tar.gz":  false,
+		"site/data/product/1.0.0/index.htmlx.zip": false,
+	}
+
+	for key, expected := range tests {
+		t.Run(key, func(t *testing.T) {
+			assert.Equal(t, expected, isGenerated(key))
+		})
+	}
+}
+
+func TestListedKeyPredicate(t *testing.T) {
+	tests := map[string]struct {
+		cfg  Config
+		keys map[string]bool
+	}{
+		"indexes written among the objects": {
+			cfg: Config{
+				IndexFormats:       []IndexFormat{HTMLIndex, JSONIndex},
+				EnrichmentCacheURL: &url.URL{Scheme: "s3", Host: "bucket", Path: "/.s3-index-generator/cache.json"},
+			},
+			keys: map[string]bool{
+				"index.json":                             true,
+				"product/1.0/index.json":                 true,
+				"product/1.0/":                           true,
+				"static/style.css":                       true,
+				".staging/20240601T100000Z/index.json":   true,
+				".latest-generation":                     true,
+				".checkpoint.json":                       true,
+				".s3-index-generator/cache.json":         true,
+				"static/logo.png":                        false,
+				"product/1.0/product_1.0_linux_amd64.gz": false,
+			},
+		},
+		"indexes written elsewhere": {
+			cfg: Config{
+				ObjectPrefix:            "data",
+				DestinationBucketPrefix: "site",
+				IndexFormats:            []IndexFormat{HTMLIndex, JSONIndex},
+			},
+			keys: map[string]bool{
+				"data/product/1.0/index.json": false,
+				"data/static/style.css":       false,
+				"data/product/1.0/":           false,
+				"site/.latest-generation":     true,
+			},
+		},
+		"indexes written above the objects": {
+			cfg: Config{
+				ObjectPrefix: "data",
+				IndexFormats: []IndexFormat{JSONIndex},
+			},
+			keys: map[string]bool{
+				"data/product/1.0/index.json": false,
+				".checkpoint.json":            true,
+			},
+		},
+		"static files from a bucket": {
+			cfg: Config{
+				IndexFormats:    []IndexFormat{HTMLIndex},
+				StaticBucketURL: &url.URL{Scheme: "s3", Host: "static"},
+			},
+			keys: map[string]bool{
+				"static/style.css": false,
+				"index.html":       true,
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			isListed := listedKeyPredicate(tt.cfg, "bucket")
+			for key, expected := range tt.keys {
+				assert.Equal(t, expected, isListed(key), key)
+			}
+		})
+	}
+}
+
+func TestListedKeyPredicateKeepsUserIndexObjects(t *testing.T) {
+	// the indexes are written to the bucket root, above the objects
+	cfg := Config{
+		ObjectPrefix: "data",
+		IndexFormats: []IndexFormat{HTMLIndex, JSONIndex},
+	}
+	objects := []Object{
+		simpleObject("data/product/1.0/product_1.0_linux_amd64.zip"),
+		simpleObject("data/product/1.0/index.json"),
+	}
+	pageLister := FilteredPageLister(PagesFromLister(func(ctx context.Context, prefix string) ([]Object, error) {
+		return objects, nil
+	}), listedKeyPredicate(cfg, "bucket"))
+
+	objectTree := NewRootObjectTree(objectTreeConfig(cfg))
+	err := objectTree.AddAllObjectsFromPageLister(context.Background(), pageLister)
+	if err != nil {
+		t.Fatalf("AddAllObjectsFromPageLister() error = %v", err)
+	}
+
+	node := objectTree.Lookup("/product/1.0")
+	if node == nil {
+		t.Fatalf("Lookup() expected /product/1.0")
+	}
+	keys := make([]string, 0)
+	for _, o := range node.Objects {
+		keys = append(keys, o.Key())
+	}
+	assert.ElementsMatch(t, []string{"data/product/1.0/product_1.0_linux_amd64.zip", "data/product/1.0/index.json"}, keys)
+}
+
+func TestHandleS3EventIgnoresGeneratedKeys(t *testing.T) {
+	cfg := Config{
+		IndexFormats: []IndexFormat{HTMLIndex, JSONIndex},
+	}
+	event := events.S3Event{
+		Records: []events.S3EventRecord{
+			s3EventRecord("bucket-a", "data/index.html", "ObjectCreated:Put"),
+			s3EventRecord("bucket-a", "data/index.json", "ObjectCreated:Put"),
+			s3EventRecord("bucket-a", "static/style.css", "ObjectCreated:Put"),
+		},
+	}
+
+	calls := make([]regenerateCall, 0)
+	summary, err := handleS3Event(context.Background(), []Config{cfg}, event, recordingRegenerate(&calls, nil))
+	if err != nil {
+		t.Fatalf("handleS3Event() error = %v", err)
+	}
+
+	assert.Empty(t, calls)
+	assert.Len(t, summary.Skipped, 3)
+}
+
+func TestHandleS3EventRoutesToJobs(t *testing.T) {
+	jobs := []Config{
+		{Name: "releases", ObjectPrefix: "data", DestinationBucketPrefix: "site", IndexFormats: []IndexFormat{HTMLIndex}},
+		{Name: "all", DestinationBucketPrefix: "everything", IndexFormats: []IndexFormat{JSONIndex}},
+		{Name: "docs", ObjectPrefix: "docs"},
+	}
+	event := events.S3Event{
+		Records: []events.S3EventRecord{
+			s3EventRecord("bucket-a", "data/product/1.0.0/product_linux_amd64.zip", "ObjectCreated:Put"),
+			s3EventRecord("bucket-a", "other/file.zip", "ObjectCreated:Put"),
+			// generated by the releases job, so must not trigger the all job
+			s3EventRecord("bucket-a", "site/data/index.html", "ObjectCreated:Put"),
+		},
+	}
+
+	calls := make([]regenerateCall, 0)
+	summary, err := handleS3Event(context.Background(), jobs, event, recordingRegenerate(&calls, nil))
+	if err != nil {
+		t.Fatalf("handleS3Event() error = %v", err)
+	}
+
+	assert.Equal(t, []regenerateCall{
+		{bucket: "bucket-a", prefix: "site", keys: []string{"data/product/1.0.0/product_linux_amd64.zip"}},
+		{bucket: "bucket-a", prefix: "everything", keys: []string{"data/product/1.0.0/product_linux_amd64.zip", "other/file.zip"}},
+	}, calls)
+
+	assert.Equal(t, "releases", summary.Regenerated[0].Job)
+	assert.Len(t, summary.Skipped, 1)
+	assert.Equal(t, "site/data/index.html", summary.Skipped[0].Key)
+}
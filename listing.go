@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+var (
+	SequentialListing = "sequential"
+	ShardedListing    = "sharded"
+
+	DefaultListingWorkers = 8
+)
+
+// discoverShards lists prefix with a delimiter to find the common prefixes to
+// shard across, descending while there is only a single common prefix and no
+// objects so that a prefix such as "data" still yields useful shards.
+func discoverShards(ctx context.Context, directoryLister DirectoryListerFunc, prefix string) ([]Object, []string, error) {
+	for {
+		objects, commonPrefixes, err := directoryLister(ctx, prefix)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(objects) > 0 || len(commonPrefixes) != 1 {
+			return objects, commonPrefixes, nil
+		}
+
+		prefix = commonPrefixes[0]
+	}
+}
+
+// ShardedPageLister returns an ObjectPageListerFunc that discovers the common
+// prefixes below prefix using directoryLister, then lists each of them with
+// pageLister using at most workers concurrent shards. Objects found while
+// discovering shards are passed to fn first. fn is never called concurrently.
+func ShardedPageLister(directoryLister DirectoryListerFunc, pageLister ObjectPageListerFunc, workers int) ObjectPageListerFunc {
+	if workers < 1 {
+		workers = DefaultListingWorkers
+	}
+
+	return func(ctx context.Context, prefix string, fn ObjectPageFunc) error {
+		objects, shards, err := discoverShards(ctx, directoryLister, prefix)
+		if err != nil {
+			return fmt.Errorf("error discovering shards for %v: %w", prefix, err)
+		}
+
+		if len(objects) > 0 {
+			err = fn(objects)
+			if err != nil {
+				return err
+			}
+		}
+
+		var mu sync.Mutex
+		serialisedFn := func(objects []Object) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return fn(objects)
+		}
+
+		errGroup, ctx := errgroup.WithContext(ctx)
+		errGroup.SetLimit(workers)
+
+		for _, shard := range shards {
+			shardPrefix := shard
+			errGroup.Go(func() error {
+				err := pageLister(ctx, shardPrefix, serialisedFn)
+				if err != nil {
+					return fmt.Errorf("error listing shard %v: %w", shardPrefix, err)
+				}
+				return nil
+			})
+		}
+
+		return errGroup.Wait()
+	}
+}
+
+// ShardedLister is ShardedPageLister for an ObjectListerFunc, collecting the
+// objects from every shard before returning.
+func ShardedLister(directoryLister DirectoryListerFunc, lister ObjectListerFunc, workers int) ObjectListerFunc {
+	return CollectPages(ShardedPageLister(directoryLister, PagesFromLister(lister), workers))
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/afero"
+)
+
+var (
+	JSONListing = "json"
+	CSVListing  = "csv"
+
+	listingFilePageSize = 1000
+
+	listingCSVHeader = []string{"key", "size", "last_modified", "etag", "storage_class", "tags"}
+)
+
+// ListingEntry is a single object in a dumped listing file.
+type ListingEntry struct {
+	Key          string            `json:"key"`
+	Size         int64             `json:"size"`
+	LastModified time.Time         `json:"last_modified"`
+	ETag         string            `json:"etag,omitempty"`
+	StorageClass string            `json:"storage_class,omitempty"`
+	Tags         map[string]string `json:"tags,omitempty"`
+}
+
+func NewListingEntry(o Object) ListingEntry {
+	return ListingEntry{
+		Key:          o.Key(),
+		Size:         o.Size(),
+		LastModified: o.LastModified().UTC(),
+		ETag:         o.ETag(),
+		StorageClass: o.StorageClass(),
+		Tags:         o.Tags(),
+	}
+}
+
+// Object returns the entry as an Object, as it would have been listed from
+// the bucket.
+func (e ListingEntry) Object() Object {
+	obj := &s3.Object{
+		Key:          &e.Key,
+		Size:         &e.Size,
+		LastModified: &e.LastModified,
+	}
+
+	if e.ETag != "" {
+		etag := e.ETag
+		obj.ETag = &etag
+	}
+
+	if e.StorageClass != "" {
+		storageClass := e.StorageClass
+		obj.StorageClass = &storageClass
+	}
+
+	tags := e.Tags
+	if tags == nil {
+		tags = make(map[string]string)
+	}
+
+	return NewObjectWithTags(obj, tags)
+}
+
+// ListingFormat returns the listing format for a file based on its
+// extension, either json or csv.
+func ListingFormat(filePath string) (string, error) {
+	switch strings.ToLower(path.Ext(filePath)) {
+	case ".json":
+		return JSONListing, nil
+	case ".csv":
+		return CSVListing, nil
+	default:
+		return "", fmt.Errorf("unsupported listing file %v, expected .json or .csv", filePath)
+	}
+}
+
+// IsListingFile reports whether filePath looks like a listing file rather
+// than a directory of objects.
+func IsListingFile(filePath string) bool {
+	_, err := ListingFormat(filePath)
+	return err == nil
+}
+
+// WriteListing writes objects to w as a listing in format.
+func WriteListing(w io.Writer, format string, objects []Object) error {
+	entries := make([]ListingEntry, 0, len(objects))
+	for _, o := range objects {
+		entries = append(entries, NewListingEntry(o))
+	}
+
+	switch format {
+	case JSONListing:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	case CSVListing:
+		return writeCSVListing(w, entries)
+	default:
+		return fmt.Errorf("unsupported listing format %v", format)
+	}
+}
+
+func writeCSVListing(w io.Writer, entries []ListingEntry) error {
+	csvWriter := csv.NewWriter(w)
+
+	err := csvWriter.Write(listingCSVHeader)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		tags := url.Values{}
+		for k, v := range e.Tags {
+			tags.Set(k, v)
+		}
+
+		err = csvWriter.Write([]string{
+			e.Key,
+			strconv.FormatInt(e.Size, 10),
+			e.LastModified.Format(time.RFC3339),
+			e.ETag,
+			e.StorageClass,
+			tags.Encode(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// ReadListing reads the entries of a listing in format from r.
+func ReadListing(r io.Reader, format string) ([]ListingEntry, error) {
+	switch format {
+	case JSONListing:
+		entries := make([]ListingEntry, 0)
+		err := json.NewDecoder(r).Decode(&entries)
+		if err != nil {
+			return nil, err
+		}
+		return entries, nil
+	case CSVListing:
+		return readCSVListing(r)
+	default:
+		return nil, fmt.Errorf("unsupported listing format %v", format)
+	}
+}
+
+func readCSVListing(r io.Reader) ([]ListingEntry, error) {
+	csvReader := csv.NewReader(r)
+	csvReader.FieldsPerRecord = -1
+
+	header, err := csvReader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read listing header: %w", err)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+
+	for _, required := range []string{"key", "size", "last_modified"} {
+		if _, exists := columns[required]; !exists {
+			return nil, fmt.Errorf("listing is missing %v column", required)
+		}
+	}
+
+	entries := make([]ListingEntry, 0)
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		field := func(name string) string {
+			i, exists := columns[name]
+			if !exists || i >= len(record) {
+				return ""
+			}
+			return record[i]
+		}
+
+		e := ListingEntry{
+			Key:          field("key"),
+			ETag:         field("etag"),
+			StorageClass: field("storage_class"),
+		}
+
+		e.Size, err = strconv.ParseInt(field("size"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse size for %v: %w", e.Key, err)
+		}
+
+		e.LastModified, err = time.Parse(time.RFC3339, field("last_modified"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse last modified for %v: %w", e.Key, err)
+		}
+
+		if encodedTags := field("tags"); encodedTags != "" {
+			tags, err := url.ParseQuery(encodedTags)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse tags for %v: %w", e.Key, err)
+			}
+			e.Tags = make(map[string]string)
+			for k := range tags {
+				e.Tags[k] = tags.Get(k)
+			}
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// ListingFileLister lists objects from a listing file written by
+// dump-listing rather than a live bucket.
+type ListingFileLister struct {
+	fs       afero.Fs
+	filePath string
+}
+
+func NewListingFileLister(fs afero.Fs, filePath string) *ListingFileLister {
+	return &ListingFileLister{
+		fs:       fs,
+		filePath: filePath,
+	}
+}
+
+func (l *ListingFileLister) ListObjects(ctx context.Context, prefix string) ([]Object, error) {
+	return CollectPages(l.ListObjectPages)(ctx, prefix)
+}
+
+// ListObjectPages reads the listing file, passing the objects under prefix to
+// fn in pages.
+func (l *ListingFileLister) ListObjectPages(ctx context.Context, prefix string, fn ObjectPageFunc) error {
+	format, err := ListingFormat(l.filePath)
+	if err != nil {
+		return err
+	}
+
+	f, err := l.fs.Open(l.filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open listing %v: %w", l.filePath, err)
+	}
+	defer f.Close()
+
+	entries, err := ReadListing(f, format)
+	if err != nil {
+		return fmt.Errorf("failed to read listing %v: %w", l.filePath, err)
+	}
+
+	page := make([]Object, 0, listingFilePageSize)
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if !strings.HasPrefix(e.Key, prefix) {
+			continue
+		}
+
+		page = append(page, e.Object())
+		if len(page) == listingFilePageSize {
+			err = fn(page)
+			if err != nil {
+				return err
+			}
+			page = make([]Object, 0, listingFilePageSize)
+		}
+	}
+
+	if len(page) > 0 {
+		return fn(page)
+	}
+
+	return nil
+}
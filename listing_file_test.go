@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func listingTestObjects() []Object {
+	lastModified := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+	newObject := func(key string, size int64, etag string, tags map[string]string) Object {
+		storageClass := "STANDARD"
+		return NewObjectWithTags(&s3.Object{
+			Key:          &key,
+			Size:         &size,
+			LastModified: &lastModified,
+			ETag:         &etag,
+			StorageClass: &storageClass,
+		}, tags)
+	}
+
+	return []Object{
+		newObject("data/connect/0.57.1/connect_linux_amd64.zip", 1024, `"abc123"`, map[string]string{"Dioad/OS": "linux", "Dioad/Arch": "amd64"}),
+		newObject("data/connect/0.57.1/connect, linux.txt", 12, `"def456"`, map[string]string{}),
+		newObject("other/file.txt", 1, `"ghi789"`, map[string]string{"a&b": "c=d"}),
+	}
+}
+
+func TestListingRoundTrip(t *testing.T) {
+	for _, format := range []string{JSONListing, CSVListing} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := WriteListing(&buf, format, listingTestObjects())
+			if err != nil {
+				t.Fatalf("WriteListing() error = %v", err)
+			}
+
+			entries, err := ReadListing(&buf, format)
+			if err != nil {
+				t.Fatalf("ReadListing() error = %v", err)
+			}
+
+			expected := make([]ListingEntry, 0)
+			for _, o := range listingTestObjects() {
+				e := NewListingEntry(o)
+				if len(e.Tags) == 0 {
+					e.Tags = nil
+				}
+				expected = append(expected, e)
+			}
+
+			assert.Equal(t, expected, entries)
+		})
+	}
+}
+
+func TestListingFormat(t *testing.T) {
+	tests := map[string]string{
+		"listing.json": JSONListing,
+		"listing.CSV":  CSVListing,
+		"listing.txt":  "",
+		"releases":     "",
+	}
+
+	for filePath, expected := range tests {
+		t.Run(filePath, func(t *testing.T) {
+			format, err := ListingFormat(filePath)
+			if expected == "" {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, expected, format)
+		})
+	}
+}
+
+func TestListingFileLister(t *testing.T) {
+	listingFS := afero.NewMemMapFs()
+
+	var buf bytes.Buffer
+	err := WriteListing(&buf, CSVListing, listingTestObjects())
+	if err != nil {
+		t.Fatalf("WriteListing() error = %v", err)
+	}
+	err = afero.WriteFile(listingFS, "/listing.csv", buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatalf("failed to write listing: %v", err)
+	}
+
+	lister := NewListingFileLister(listingFS, "/listing.csv")
+	objects, err := lister.ListObjects(context.Background(), "data/")
+	if err != nil {
+		t.Fatalf("ListObjects() error = %v", err)
+	}
+
+	assert.Len(t, objects, 2)
+	assert.Equal(t, "data/connect/0.57.1/connect_linux_amd64.zip", objects[0].Key())
+	assert.Equal(t, int64(1024), objects[0].Size())
+	assert.Equal(t, "abc123", objects[0].ETag())
+	assert.Equal(t, "STANDARD", objects[0].StorageClass())
+	assert.Equal(t, "amd64", objects[0].Tags()["Dioad/Arch"])
+	assert.NotNil(t, objects[1].Tags())
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fakePageLister(keys []string, listed *[]string) ObjectPageListerFunc {
+	var mu sync.Mutex
+	return func(ctx context.Context, prefix string, fn ObjectPageFunc) error {
+		mu.Lock()
+		*listed = append(*listed, prefix)
+		mu.Unlock()
+
+		for _, key := range keys {
+			if strings.HasPrefix(key, prefix) {
+				err := fn([]Object{simpleObject(key)})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+}
+
+func TestShardedPageLister(t *testing.T) {
+	keys := []string{
+		"data/README.md",
+		"data/connect/0.57.0/connect_linux_amd64.zip",
+		"data/connect/0.57.1/connect_linux_amd64.zip",
+		"data/tunnel/1.0.0/tunnel_linux_amd64.zip",
+		"data/tunnel/1.0.1/tunnel_linux_amd64.zip",
+	}
+
+	discovered := make([]string, 0)
+	listed := make([]string, 0)
+	lister := ShardedPageLister(fakeDirectoryLister(keys, &discovered), fakePageLister(keys, &listed), 2)
+
+	tree := NewRootObjectTree(ObjectTreeConfig{PrefixToStrip: "data"})
+	err := tree.AddAllObjectsFromPageLister(context.Background(), lister)
+	if err != nil {
+		t.Fatalf("AddAllObjectsFromPageLister() error = %v", err)
+	}
+
+	assert.Equal(t, []string{"data", "data/"}, discovered)
+	assert.ElementsMatch(t, []string{"data/connect/", "data/tunnel/"}, listed)
+
+	assert.Len(t, tree.Objects, 1)
+	assert.Len(t, tree.Children["connect"].Children, 2)
+	assert.Len(t, tree.Children["tunnel"].Children, 2)
+}
+
+func TestShardedLister(t *testing.T) {
+	keys := []string{
+		"a/fileA",
+		"b/fileB",
+		"fileC",
+	}
+
+	discovered := make([]string, 0)
+	listed := make([]string, 0)
+	lister := ShardedLister(fakeDirectoryLister(keys, &discovered), CollectPages(fakePageLister(keys, &listed)), 0)
+
+	objects, err := lister(context.Background(), "")
+	if err != nil {
+		t.Fatalf("ShardedLister() error = %v", err)
+	}
+
+	assert.Len(t, objects, 3)
+	assert.ElementsMatch(t, []string{"a/", "b/"}, listed)
+}
@@ -2,17 +2,18 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/url"
 	"os"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/spf13/afero"
 )
 
@@ -26,7 +27,52 @@ var (
 	HTMLIndex IndexFormat = "html"
 )
 
+// IndexFile returns the name of the index file generated for the format.
+func (f IndexFormat) IndexFile() string {
+	return fmt.Sprintf("index.%v", f)
+}
+
+// EnrichmentConfig selects the objects that an enrichment pass, such as
+// fetching tags or metadata, is applied to. When both prefixes and suffixes
+// are given an object must match one of each.
+type EnrichmentConfig struct {
+	// Prefixes are the key prefixes of objects to enrich
+	Prefixes []string
+	// Suffixes are the key suffixes of objects to enrich
+	Suffixes []string
+}
+
+// Enabled returns true if any objects are selected for enrichment.
+func (c EnrichmentConfig) Enabled() bool {
+	return len(c.Prefixes) > 0 || len(c.Suffixes) > 0
+}
+
+// Include returns true if the key is selected for enrichment.
+func (c EnrichmentConfig) Include(key string) bool {
+	if !c.Enabled() {
+		return false
+	}
+
+	prefixes := make(Inclusions, 0, len(c.Prefixes))
+	for _, prefix := range c.Prefixes {
+		prefixes = append(prefixes, HasPrefix(prefix))
+	}
+
+	suffixes := make(Inclusions, 0, len(c.Suffixes))
+	for _, suffix := range c.Suffixes {
+		suffixes = append(suffixes, HasSuffix(suffix))
+	}
+
+	return (len(prefixes) == 0 || prefixes.Include(key)) &&
+		(len(suffixes) == 0 || suffixes.Include(key))
+}
+
 type Config struct {
+	// Name identifies the job in a config file
+	Name string
+	// ConfigURL is a config file defining jobs, either an s3:// URL or a
+	// local path
+	ConfigURL *url.URL
 	// Bucket is the S3 bucket to be indexed
 	Bucket string
 	// BucketDestinationPrefix is the prefix within the bucket to root the generated indexes
@@ -40,10 +86,206 @@ type Config struct {
 	IndexFormats         []IndexFormat
 	ServerSideEncryption string
 	LocalOutputDirectory string
+	// destinationPrefixFlag is set if the destination prefix was given as a
+	// command line flag, which the legacy bucket/prefix source doesn't replace
+	destinationPrefixFlag bool
+	// Incremental limits regeneration triggered by events to the directories
+	// containing the changed keys and their ancestors
+	Incremental bool
+	// ListingStrategy selects how the bucket is listed, either sequential or sharded
+	ListingStrategy string
+	// ListingWorkers is the number of shards listed concurrently by the sharded strategy
+	ListingWorkers int
+	// ExcludedStorageClasses are storage classes whose objects are left out of
+	// the indexes, e.g. GLACIER or DEEP_ARCHIVE objects that can't be downloaded
+	ExcludedStorageClasses []string
+	// ExcludedPrefixes are key prefixes of objects to leave out of the indexes
+	ExcludedPrefixes []string
+	// ExcludedSuffixes are key suffixes of objects to leave out of the indexes
+	ExcludedSuffixes []string
+	// ReleaseKeyExtractors are regular expressions used to extract release
+	// details from keys, replacing the default extractor
+	ReleaseKeyExtractors []string
+	// MetadataEnrichment selects objects to call HeadObject for, to fetch
+	// their content type, user metadata and checksums
+	MetadataEnrichment EnrichmentConfig
+	// TagEnrichment selects objects to fetch tags for
+	TagEnrichment EnrichmentConfig
+	// EnrichmentCacheURL is where fetched tags and metadata are cached between
+	// runs, either an s3:// URL or a local path
+	EnrichmentCacheURL *url.URL
+	// InventoryManifestURL is the manifest.json of an S3 Inventory report to
+	// list objects from instead of listing the bucket, either an s3:// URL or
+	// a local path
+	InventoryManifestURL *url.URL
+	// S3 configures the S3 endpoint, for S3 compatible stores
+	S3 S3Options
+	// SourceRole is assumed to list the source bucket
+	SourceRole RoleConfig
+	// TemplateRole is assumed to load templates from TemplateBucketURL
+	TemplateRole RoleConfig
+	// StaticRole is assumed to load static files from StaticBucketURL
+	StaticRole RoleConfig
+	// DestinationRole is assumed to write indexes
+	DestinationRole RoleConfig
+	// DryRun renders indexes in memory and reports the files that would be
+	// created or changed instead of writing them
+	DryRun bool
+	// SkipUnchanged leaves existing files alone when their rendered content,
+	// ignoring nonces, hasn't changed
+	SkipUnchanged bool
+	// RemoveStaleIndexes removes index files from directories that no longer
+	// contain any objects after a full regeneration
+	RemoveStaleIndexes bool
+	// StagedPublish renders each generation into a staging directory and only
+	// copies it into place once it has fully succeeded
+	StagedPublish bool
+	// GenerationGuard records each run as a new generation and makes a run
+	// give up once a newer one has started writing to the same output
+	GenerationGuard bool
+	// DeadlineMargin is how long before the Lambda deadline rendering stops
+	// and a checkpoint of the directories still to render is saved
+	DeadlineMargin time.Duration
+	// ReinvokeOnDeadline invokes the function again to resume from the
+	// checkpoint rather than waiting for the next event
+	ReinvokeOnDeadline bool
+}
+
+// Validate checks cfg, returning an error describing every problem found.
+func (cfg Config) Validate() error {
+	var errs []error
+
+	if cfg.IndexType != MultiPageIdentifier && cfg.IndexType != SinglePageIdentifier {
+		errs = append(errs, fmt.Errorf("INDEX_TYPE: expected multipage or singlepage, found %v", cfg.IndexType))
+	}
+
+	if len(cfg.IndexFormats) == 0 {
+		errs = append(errs, errors.New("INDEX_FORMATS: expected at least one of html or json"))
+	}
+
+	if slices.Contains(cfg.IndexFormats, HTMLIndex) && cfg.IndexTemplate == "" {
+		errs = append(errs, errors.New("INDEX_TEMPLATE: expected a template name"))
+	}
+
+	errs = append(errs,
+		checkBucketURL("TEMPLATE_BUCKET_URL", cfg.TemplateBucketURL),
+		checkBucketURL("STATIC_BUCKET_URL", cfg.StaticBucketURL),
+		checkLocationURL("CONFIG_URL", cfg.ConfigURL),
+		checkLocationURL("ENRICHMENT_CACHE_URL", cfg.EnrichmentCacheURL),
+		checkLocationURL("INVENTORY_MANIFEST_URL", cfg.InventoryManifestURL),
+	)
+
+	if cfg.ListingStrategy != SequentialListing && cfg.ListingStrategy != ShardedListing {
+		errs = append(errs, fmt.Errorf("LISTING_STRATEGY: expected sequential or sharded, found %v", cfg.ListingStrategy))
+	}
+
+	if cfg.ListingWorkers < 1 {
+		errs = append(errs, fmt.Errorf("LISTING_WORKERS: expected a positive integer, found %v", cfg.ListingWorkers))
+	}
+
+	if cfg.DeadlineMargin < 0 {
+		errs = append(errs, fmt.Errorf("DEADLINE_MARGIN: expected a positive duration, found %v", cfg.DeadlineMargin))
+	}
+
+	for _, extractor := range cfg.ReleaseKeyExtractors {
+		_, err := regexp.Compile(extractor)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid release key extractor %v: %w", extractor, err))
+		}
+	}
+
+	return errors.Join(errs...)
 }
 
-func parseConfigFromEnvironment() Config {
+// checkBucketURL requires u, if set, to be an s3:// URL with a bucket.
+func checkBucketURL(name string, u *url.URL) error {
+	if u == nil {
+		return nil
+	}
+
+	if u.Scheme != "s3" {
+		return fmt.Errorf("%v: expected an s3:// URL, found %v", name, u.Redacted())
+	}
+
+	if u.Host == "" {
+		return fmt.Errorf("%v: expected a bucket in %v", name, u.Redacted())
+	}
+
+	return nil
+}
+
+// checkLocationURL requires u, if set, to be an s3:// URL with a bucket or a
+// local path.
+func checkLocationURL(name string, u *url.URL) error {
+	if u == nil || u.Scheme == "s3" {
+		return checkBucketURL(name, u)
+	}
+
+	if u.Scheme != "" && u.Scheme != "file" {
+		return fmt.Errorf("%v: expected an s3:// URL or local path, found %v", name, u.Redacted())
+	}
+
+	if u.Path == "" {
+		return fmt.Errorf("%v: expected a path", name)
+	}
+
+	return nil
+}
+
+// urlFromEnvironment parses the URL in the variable name, returning nil if it
+// isn't set.
+// EnvironmentError is a value in the environment variable Variable that
+// couldn't be parsed.
+type EnvironmentError struct {
+	Variable string
+	Err      error
+}
+
+func (e *EnvironmentError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Variable, e.Err)
+}
+
+func (e *EnvironmentError) Unwrap() error {
+	return e.Err
+}
+
+func urlFromEnvironment(name string) (*url.URL, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, nil
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, &EnvironmentError{Variable: name, Err: fmt.Errorf("unable to parse as URL: %w", err)}
+	}
+
+	return u, nil
+}
+
+// boolFromEnvironment parses the bool in the variable name, returning false
+// if it isn't set.
+func boolFromEnvironment(name string) (bool, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, &EnvironmentError{Variable: name, Err: fmt.Errorf("unable to parse as bool: %w", err)}
+	}
+
+	return b, nil
+}
+
+// parseConfigFromEnvironment reads cfg from the environment, returning an
+// EnvironmentError for every value that can't be parsed alongside the config.
+// The config isn't validated, as the command line may still override it.
+func parseConfigFromEnvironment() (Config, error) {
 	var cfg Config
+	var errs []error
+	var err error
 
 	var ok bool
 
@@ -53,14 +295,13 @@ func parseConfigFromEnvironment() Config {
 
 	if cfg.IndexType, ok = os.LookupEnv("INDEX_TYPE"); !ok {
 		cfg.IndexType = MultiPageIdentifier
-	} else {
-		if cfg.IndexType != MultiPageIdentifier && cfg.IndexType != SinglePageIdentifier {
-			log.Fatalf("err: expected multipage or singlepage, found %v", cfg.IndexType)
-		}
 	}
 
 	if indexFormatValue, ok := os.LookupEnv("INDEX_FORMATS"); ok {
-		cfg.IndexFormats = indexFormats(indexFormatValue)
+		cfg.IndexFormats, err = indexFormats(indexFormatValue)
+		if err != nil {
+			errs = append(errs, &EnvironmentError{Variable: "INDEX_FORMATS", Err: err})
+		}
 	}
 
 	if len(cfg.IndexFormats) == 0 {
@@ -71,100 +312,284 @@ func parseConfigFromEnvironment() Config {
 		cfg.IndexTemplate = fmt.Sprintf("%v.index.html.tmpl", cfg.IndexType)
 	}
 
-	if templateBucketURLString, ok := os.LookupEnv("TEMPLATE_BUCKET_URL"); ok {
-		tmpURL, err := url.Parse(templateBucketURLString)
+	cfg.TemplateBucketURL, err = urlFromEnvironment("TEMPLATE_BUCKET_URL")
+	errs = append(errs, err)
+
+	cfg.StaticBucketURL, err = urlFromEnvironment("STATIC_BUCKET_URL")
+	errs = append(errs, err)
+
+	// Can we figure these details out by looking at bucket config?
+	cfg.ServerSideEncryption, _ = os.LookupEnv("SSE")
+
+	cfg.Incremental, err = boolFromEnvironment("INCREMENTAL")
+	errs = append(errs, err)
+
+	cfg.DryRun, err = boolFromEnvironment("DRY_RUN")
+	errs = append(errs, err)
+
+	cfg.SkipUnchanged, err = boolFromEnvironment("SKIP_UNCHANGED")
+	errs = append(errs, err)
+
+	cfg.RemoveStaleIndexes, err = boolFromEnvironment("REMOVE_STALE_INDEXES")
+	errs = append(errs, err)
+
+	cfg.StagedPublish, err = boolFromEnvironment("STAGED_PUBLISH")
+	errs = append(errs, err)
+
+	cfg.GenerationGuard, err = boolFromEnvironment("GENERATION_GUARD")
+	errs = append(errs, err)
+
+	if cfg.ListingStrategy, ok = os.LookupEnv("LISTING_STRATEGY"); !ok {
+		cfg.ListingStrategy = SequentialListing
+	}
+
+	if excludedStorageClassesValue, ok := os.LookupEnv("EXCLUDE_STORAGE_CLASSES"); ok {
+		cfg.ExcludedStorageClasses = commaSeparated(excludedStorageClassesValue)
+	}
+
+	if excludedPrefixesValue, ok := os.LookupEnv("EXCLUDE_PREFIXES"); ok {
+		cfg.ExcludedPrefixes = commaSeparated(excludedPrefixesValue)
+	}
+
+	if excludedSuffixesValue, ok := os.LookupEnv("EXCLUDE_SUFFIXES"); ok {
+		cfg.ExcludedSuffixes = commaSeparated(excludedSuffixesValue)
+	}
+
+	cfg.ConfigURL, err = urlFromEnvironment("CONFIG_URL")
+	errs = append(errs, err)
+
+	cfg.MetadataEnrichment = enrichmentConfigFromEnvironment("METADATA")
+	cfg.TagEnrichment = enrichmentConfigFromEnvironment("TAG")
+
+	cfg.InventoryManifestURL, err = urlFromEnvironment("INVENTORY_MANIFEST_URL")
+	errs = append(errs, err)
+
+	cfg.EnrichmentCacheURL, err = urlFromEnvironment("ENRICHMENT_CACHE_URL")
+	errs = append(errs, err)
+
+	cfg.ListingWorkers = DefaultListingWorkers
+	if listingWorkersValue, ok := os.LookupEnv("LISTING_WORKERS"); ok {
+		cfg.ListingWorkers, err = strconv.Atoi(listingWorkersValue)
 		if err != nil {
-			log.Fatalf("err: unable to parse TEMPLATE_BUCKET_URL as URL: %v", err)
+			errs = append(errs, &EnvironmentError{Variable: "LISTING_WORKERS", Err: fmt.Errorf("expected a positive integer, found %v", listingWorkersValue)})
+			cfg.ListingWorkers = DefaultListingWorkers
 		}
-		cfg.TemplateBucketURL = tmpURL
 	}
 
-	if staticBucketURLString, ok := os.LookupEnv("STATIC_BUCKET_URL"); ok {
-		tmpURL, err := url.Parse(staticBucketURLString)
+	cfg.DeadlineMargin = DefaultDeadlineMargin
+	if deadlineMarginValue, ok := os.LookupEnv("DEADLINE_MARGIN"); ok {
+		cfg.DeadlineMargin, err = time.ParseDuration(deadlineMarginValue)
 		if err != nil {
-			log.Fatalf("err: unable to parse STATIC_BUCKET_URL as URL: %v", err)
+			errs = append(errs, &EnvironmentError{Variable: "DEADLINE_MARGIN", Err: fmt.Errorf("expected a duration such as 30s, found %v", deadlineMarginValue)})
+			cfg.DeadlineMargin = DefaultDeadlineMargin
 		}
-		cfg.StaticBucketURL = tmpURL
 	}
 
-	// Can we figure these details out by looking at bucket config?
-	cfg.ServerSideEncryption, _ = os.LookupEnv("SSE")
+	cfg.ReinvokeOnDeadline, err = boolFromEnvironment("REINVOKE_ON_DEADLINE")
+	errs = append(errs, err)
+
+	cfg.S3, err = s3OptionsFromEnvironment()
+	errs = append(errs, err)
+
+	cfg.SourceRole = roleConfigFromEnvironment("SOURCE")
+	cfg.TemplateRole = roleConfigFromEnvironment("TEMPLATE")
+	cfg.StaticRole = roleConfigFromEnvironment("STATIC")
+	cfg.DestinationRole = roleConfigFromEnvironment("DESTINATION")
+
+	return cfg, errors.Join(errs...)
+}
+
+// roleConfigFromEnvironment reads the ${name}_ROLE_ARN,
+// ${name}_ROLE_EXTERNAL_ID and ${name}_ROLE_SESSION_NAME variables.
+func roleConfigFromEnvironment(name string) RoleConfig {
+	var role RoleConfig
+
+	role.RoleARN, _ = os.LookupEnv(name + "_ROLE_ARN")
+	role.ExternalID, _ = os.LookupEnv(name + "_ROLE_EXTERNAL_ID")
+	role.SessionName, _ = os.LookupEnv(name + "_ROLE_SESSION_NAME")
+
+	return role
+}
+
+// s3OptionsFromEnvironment reads the S3_ENDPOINT, S3_REGION,
+// S3_FORCE_PATH_STYLE and S3_INSECURE_SKIP_VERIFY variables.
+func s3OptionsFromEnvironment() (S3Options, error) {
+	var opts S3Options
+	var forcePathStyleErr, insecureSkipVerifyErr error
+
+	opts.Endpoint, _ = os.LookupEnv("S3_ENDPOINT")
+	opts.Region, _ = os.LookupEnv("S3_REGION")
+	opts.ForcePathStyle, forcePathStyleErr = boolFromEnvironment("S3_FORCE_PATH_STYLE")
+	opts.InsecureSkipVerify, insecureSkipVerifyErr = boolFromEnvironment("S3_INSECURE_SKIP_VERIFY")
+
+	return opts, errors.Join(forcePathStyleErr, insecureSkipVerifyErr)
+}
+
+// enrichmentConfigFromEnvironment reads the ${name}_PREFIXES and
+// ${name}_SUFFIXES variables.
+func enrichmentConfigFromEnvironment(name string) EnrichmentConfig {
+	var cfg EnrichmentConfig
+
+	if prefixesValue, ok := os.LookupEnv(name + "_PREFIXES"); ok {
+		cfg.Prefixes = commaSeparated(prefixesValue)
+	}
+
+	if suffixesValue, ok := os.LookupEnv(name + "_SUFFIXES"); ok {
+		cfg.Suffixes = commaSeparated(suffixesValue)
+	}
 
 	return cfg
 }
 
-func indexFormats(indexFormat string) []IndexFormat {
-	formats := make([]IndexFormat, 0)
-	indexFormatStrings := strings.Split(indexFormat, ",")
-	for _, format := range indexFormatStrings {
-		if format == "json" {
-			formats = append(formats, JSONIndex)
-		}
-		if format == "html" {
-			formats = append(formats, HTMLIndex)
+// commaSeparated splits value on commas, dropping any empty items.
+func commaSeparated(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
 		}
 	}
-	return formats
+	return items
 }
 
-func HandleRequest(sess *session.Session, cfg Config) func(ctx context.Context, event events.S3Event) error {
-	return func(ctx context.Context, event events.S3Event) error {
-		//lc, _ := lambdacontext.FromContext(ctx)
-		fmt.Printf("records length: %d", len(event.Records))
-		fmt.Printf("record[0]: bucket: %v, key: %v, event: %v",
-			event.Records[0].S3.Bucket.Name,
-			event.Records[0].S3.Object.Key,
-			event.Records[0].EventName,
-		)
-
-		if !strings.HasPrefix(event.Records[0].S3.Object.Key, cfg.ObjectPrefix) {
-			fmt.Printf("skipping: key %v does not match prefix %v", event.Records[0].S3.Object.Key, cfg.ObjectPrefix)
-			return nil
+// indexFormats parses a comma separated list of index formats, rejecting any
+// that aren't supported.
+func indexFormats(indexFormat string) ([]IndexFormat, error) {
+	formats := make([]IndexFormat, 0)
+	unknown := make([]string, 0)
+	for _, format := range commaSeparated(indexFormat) {
+		switch IndexFormat(format) {
+		case JSONIndex, HTMLIndex:
+			formats = append(formats, IndexFormat(format))
+		default:
+			unknown = append(unknown, format)
 		}
+	}
 
-		outputFS := NewS3OutputFS(sess, cfg.Bucket, cfg.DestinationBucketPrefix, &cfg.ServerSideEncryption)
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("unknown index formats %v, expected html or json", strings.Join(unknown, ","))
+	}
 
-		err := indexS3Bucket(ctx, sess, cfg, outputFS)
-		if err != nil {
-			return err
-		}
+	return formats, nil
+}
 
-		return err
+func objectTreeConfig(cfg Config) ObjectTreeConfig {
+	exclusions := Exclusions{
+		HasKey("favicon.ico"),
+		HasKey("index.html"),
+		HasPrefix("."),
+		HasSuffix("/"),
+		HasSuffix("/index.html"),
+	}
+	directoryExclusions := Exclusions{}
+	for _, prefix := range cfg.ExcludedPrefixes {
+		exclusions = append(exclusions, HasPrefix(prefix))
+		directoryExclusions = append(directoryExclusions, HasPrefix(prefix))
+	}
+	for _, suffix := range cfg.ExcludedSuffixes {
+		exclusions = append(exclusions, HasSuffix(suffix))
+	}
+
+	return ObjectTreeConfig{
+		PrefixToStrip: cfg.ObjectPrefix,
+		Exclusions:    exclusions,
+		ObjectExclusions: ObjectExclusions{
+			HasStorageClass(cfg.ExcludedStorageClasses...),
+		},
+		DirectoryExclusions: directoryExclusions,
 	}
 }
 
-func indexS3Bucket(ctx context.Context, sess *session.Session, cfg Config, outputFS afero.Fs) error {
-	s3Bucket := NewS3Bucket(sess, cfg.Bucket, cfg.ServerSideEncryption)
+// indexConfig returns the release index config for cfg, using the default
+// key extractor unless others are configured.
+func indexConfig(cfg Config) IndexConfig {
+	if len(cfg.ReleaseKeyExtractors) == 0 {
+		return DioadIndexConfig
+	}
+
+	extractors := make(ReleaseDetailKeyExtractions, 0, len(cfg.ReleaseKeyExtractors))
+	for _, extractor := range cfg.ReleaseKeyExtractors {
+		extractors = append(extractors, ReleaseDetailsKeyExtractor(extractor))
+	}
+
+	return IndexConfig{KeyExtractions: extractors}
+}
 
-	renderers, err := indexRenderers(sess, cfg)
+// prepareOutput loads the renderers for cfg and copies any static files they
+// depend on to outputFS.
+func prepareOutput(sessions *Sessions, cfg Config, outputFS afero.Fs) (IndexRenderers, error) {
+	renderers, err := indexRenderers(sessions, cfg)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if slices.Contains(cfg.IndexFormats, HTMLIndex) {
-		err := CopyStaticFiles(sess, outputFS, cfg.StaticBucketURL)
+		err := CopyStaticFiles(sessions.Static, outputFS, cfg.StaticBucketURL)
 		if err != nil {
-			return fmt.Errorf("failed to copy static files: %w", err)
+			return nil, fmt.Errorf("failed to copy static files: %w", err)
 		}
 	}
 
-	objectTreeCfg := ObjectTreeConfig{
-		PrefixToStrip: cfg.ObjectPrefix,
-		Exclusions: Exclusions{
-			HasKey("favicon.ico"),
-			HasKey("index.html"),
-			HasPrefix("."),
-			HasSuffix("/"),
-			HasSuffix("/index.html"),
-		},
+	return renderers, nil
+}
+
+// objectEnrichers returns the enrichment passes enabled by cfg.
+func objectEnrichers(s3Bucket *S3Bucket, cfg Config) []ObjectEnricherFunc {
+	enrichers := make([]ObjectEnricherFunc, 0)
+	if cfg.TagEnrichment.Enabled() {
+		enrichers = append(enrichers, s3Bucket.TagEnricher(cfg.TagEnrichment))
+	}
+	if cfg.MetadataEnrichment.Enabled() {
+		enrichers = append(enrichers, s3Bucket.MetadataEnricher(cfg.MetadataEnrichment))
+	}
+	return enrichers
+}
+
+// objectPageLister returns the lister for the configured inventory report or
+// listing strategy.
+func objectPageLister(sessions *Sessions, s3Bucket *S3Bucket, cfg Config) ObjectPageListerFunc {
+	var pageLister ObjectPageListerFunc = s3Bucket.ListObjectPages
+	if cfg.InventoryManifestURL != nil {
+		pageLister = NewInventoryListerFromURL(sessions.Source, cfg.InventoryManifestURL).ListObjectPages
+	} else if cfg.ListingStrategy == ShardedListing {
+		pageLister = ShardedPageLister(s3Bucket.ListDirectory, s3Bucket.ListObjectPages, cfg.ListingWorkers)
+	}
+	// indexes are written to the bucket so must not be indexed themselves
+	pageLister = FilteredPageLister(pageLister, listedKeyPredicate(cfg, cfg.Bucket))
+	return EnrichedPageLister(pageLister, objectEnrichers(s3Bucket, cfg)...)
+}
+
+// generateIndexes builds an ObjectTree from the objects listed by pageLister
+// and renders its indexes to outputFS.
+func generateIndexes(ctx context.Context, sessions *Sessions, cfg Config, pageLister ObjectPageListerFunc, outputFS afero.Fs) error {
+	renderers, err := prepareOutput(sessions, cfg, outputFS)
+	if err != nil {
+		return err
 	}
-	objectTree := NewRootObjectTree(objectTreeCfg)
+
+	objectTree := NewRootObjectTree(objectTreeConfig(cfg))
+
+	cutoff := renderCutoff(ctx, cfg)
 
 	duration, err := TimeFunc(func() error {
-		// return objectTree.AddObjectsWithPrefixFromLister(ctx, s3Bucket.ListObjectsWithTags, "s3-index-generator/")
-		return objectTree.AddAllObjectsFromLister(ctx, s3Bucket.ListObjects)
+		return listBefore(ctx, cutoff, func(ctx context.Context) error {
+			return objectTree.AddAllObjectsFromPageLister(ctx, pageLister)
+		})
 	})
 	log.Printf("CreateObjectTree: duration:%v\n", duration)
+	if errors.Is(err, errRenderCutoff) {
+		// nothing has been rendered, so the directories listed so far are
+		// left to resume. Those past where the listing stopped aren't known,
+		// so they're only covered by a later event or full run that finishes
+		pending, pathsErr := ObjectTreePaths(objectTree, cfg.IndexType != SinglePageIdentifier)
+		if pathsErr != nil {
+			return pathsErr
+		}
+		slices.Sort(pending)
+		log.Printf("CreateObjectTree: listing stopped before the deadline, listed:%d\n", len(pending))
+		return &DeadlineError{Pending: pending}
+	}
 	if err != nil {
 		return fmt.Errorf("failed to create object tree: %w", err)
 	}
@@ -177,28 +602,180 @@ func indexS3Bucket(ctx context.Context, sess *session.Session, cfg Config, outpu
 	// end select renderer
 
 	duration, err = TimeFunc(func() error {
-		return RenderObjectTreeIndexes(objectTree, renderers, outputFS, recursive)
+		return RenderObjectTreeIndexesBefore(cutoff, objectTree, renderers, outputFS, recursive)
 	})
 	log.Printf("RenderObjectTreeIndexes: duration:%v\n", duration)
 	if err != nil {
 		return fmt.Errorf("failed to render object tree indexes: %w", err)
 	}
 
+	if cfg.RemoveStaleIndexes {
+		duration, err = TimeFunc(func() error {
+			return removeStaleIndexes(cfg, outputFS, objectTree, recursive)
+		})
+		log.Printf("RemoveStaleIndexes: duration:%v\n", duration)
+		if err != nil {
+			return fmt.Errorf("failed to remove stale indexes: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func indexS3Bucket(ctx context.Context, sessions *Sessions, cfg Config, outputFS afero.Fs) error {
+	s3Bucket := NewS3Bucket(sessions.Source, cfg.Bucket, cfg.ServerSideEncryption)
+
+	cache, err := loadEnrichmentCache(sessions.Destination, cfg)
+	if err != nil {
+		return err
+	}
+	s3Bucket.SetEnrichmentCache(cache)
+
+	// the whole bucket was listed even if rendering stopped before the deadline
+	err = generateIndexes(ctx, sessions, cfg, objectPageLister(sessions, s3Bucket, cfg), outputFS)
+	var deadlineErr *DeadlineError
+	if err != nil && !errors.As(err, &deadlineErr) {
+		return err
+	}
+
+	cacheErr := saveEnrichmentCache(sessions.Destination, cfg, cache, true)
+	if cacheErr != nil {
+		return fmt.Errorf("failed to save enrichment cache: %w", cacheErr)
+	}
+
+	return err
+}
+
+// indexLocalDirectory generates indexes for the files within dir.
+func indexLocalDirectory(ctx context.Context, sessions *Sessions, cfg Config, dir string, outputFS afero.Fs) error {
+	// without an output directory the indexes are written into dir, so the
+	// files from earlier runs are left out rather than indexed as objects
+	outputCfg := cfg
+	outputCfg.DestinationBucketPrefix = ""
+	pageLister := FilteredPageLister(NewLocalLister(dir).ListObjectPages, listedKeyPredicate(outputCfg, ""))
+
+	return generateIndexes(ctx, sessions, cfg, pageLister, outputFS)
+}
+
+// indexListingFile generates indexes for the objects in a listing file
+// written by dump-listing.
+func indexListingFile(ctx context.Context, sessions *Sessions, cfg Config, listingPath string, outputFS afero.Fs) error {
+	return generateIndexes(ctx, sessions, cfg, NewListingFileLister(afero.NewOsFs(), listingPath).ListObjectPages, outputFS)
+}
+
+// indexSource generates indexes for the objects at sourceURL, either an s3://
+// bucket, a file:// directory or a file:// listing file.
+func indexSource(ctx context.Context, sessions *Sessions, cfg Config, sourceURL *url.URL, outputFS afero.Fs) error {
+	switch sourceURL.Scheme {
+	case "s3":
+		return indexS3Bucket(ctx, sessions, cfg, outputFS)
+	case "file":
+		if IsListingFile(sourceURL.Path) {
+			return indexListingFile(ctx, sessions, cfg, sourceURL.Path, outputFS)
+		}
+		return indexLocalDirectory(ctx, sessions, cfg, sourceURL.Path, outputFS)
+	default:
+		return fmt.Errorf("unsupported source %v", sourceURL.Redacted())
+	}
+}
+
+// indexS3BucketIncremental regenerates only the indexes for the directories
+// containing keys and their ancestors.
+func indexS3BucketIncremental(ctx context.Context, sessions *Sessions, cfg Config, outputFS afero.Fs, keys []string) error {
+	return indexS3BucketPaths(ctx, sessions, cfg, outputFS, DirtyTreePaths(objectTreeConfig(cfg), keys))
+}
+
+// indexS3BucketPaths regenerates only the indexes for the directories at
+// paths, listing each of them rather than the whole bucket.
+func indexS3BucketPaths(ctx context.Context, sessions *Sessions, cfg Config, outputFS afero.Fs, paths []string) error {
+	s3Bucket := NewS3Bucket(sessions.Source, cfg.Bucket, cfg.ServerSideEncryption)
+
+	renderers, err := prepareOutput(sessions, cfg, outputFS)
+	if err != nil {
+		return err
+	}
+
+	cache, err := loadEnrichmentCache(sessions.Destination, cfg)
+	if err != nil {
+		return err
+	}
+	s3Bucket.SetEnrichmentCache(cache)
+
+	treeCfg := objectTreeConfig(cfg)
+	cutoff := renderCutoff(ctx, cfg)
+
+	var objectTree *ObjectTree
+	duration, err := TimeFunc(func() error {
+		releaseIndexes := slices.Contains(cfg.IndexFormats, JSONIndex)
+		directoryLister := FilteredDirectoryLister(s3Bucket.ListDirectory, listedKeyPredicate(cfg, cfg.Bucket), generatedPrefixPredicate(cfg, cfg.Bucket))
+		directoryLister = NonEmptyDirectoryLister(directoryLister, staticPrefixPredicate(cfg))
+		directoryLister = EnrichedDirectoryLister(directoryLister, objectEnrichers(s3Bucket, cfg)...)
+		return listBefore(ctx, cutoff, func(ctx context.Context) error {
+			objectTree, err = NewIncrementalObjectTree(ctx, treeCfg, directoryLister, paths, releaseIndexes)
+			return err
+		})
+	})
+	log.Printf("CreateIncrementalObjectTree: paths:%d duration:%v\n", len(paths), duration)
+	var deadlineErr *DeadlineError
+	if errors.Is(err, errRenderCutoff) {
+		// nothing has been rendered so every path is still to do
+		pending := slices.Clone(paths)
+		slices.Sort(pending)
+		deadlineErr = &DeadlineError{Pending: pending}
+	} else if err != nil {
+		return fmt.Errorf("failed to create object tree: %w", err)
+	}
+
+	if deadlineErr == nil {
+		duration, err = TimeFunc(func() error {
+			return RenderObjectTreeIndexesForPathsBefore(cutoff, objectTree, renderers, outputFS, paths)
+		})
+		log.Printf("RenderObjectTreeIndexesForPaths: duration:%v\n", duration)
+		if err != nil && !errors.As(err, &deadlineErr) {
+			return fmt.Errorf("failed to render object tree indexes: %w", err)
+		}
+	}
+
+	// directories emptied by removed objects are no longer in the tree, but
+	// they stay pending until a run renders everything
+	if deadlineErr == nil {
+		err = removeMissingIndexes(cfg, outputFS, objectTree, paths)
+		if err != nil {
+			return fmt.Errorf("failed to remove stale indexes: %w", err)
+		}
+	}
+
+	// only part of the bucket was listed so entries can't be pruned
+	cacheErr := saveEnrichmentCache(sessions.Destination, cfg, cache, false)
+	if cacheErr != nil {
+		return fmt.Errorf("failed to save enrichment cache: %w", cacheErr)
+	}
+
+	if deadlineErr != nil {
+		return deadlineErr
+	}
+
 	return nil
 }
 
-func indexRenderers(sess *session.Session, cfg Config) (IndexRenderers, error) {
+func indexRenderers(sessions *Sessions, cfg Config) (IndexRenderers, error) {
 	renderers := make(IndexRenderers, 0)
 
 	for _, format := range cfg.IndexFormats {
 		switch format {
 		case JSONIndex:
-			renderers = append(renderers, JSONIndexRenderer(DioadIndexConfig))
+			renderers = append(renderers, JSONIndexRenderer(indexConfig(cfg)))
 		case HTMLIndex:
-			tmpl, err := LoadTemplates(sess, cfg.TemplateBucketURL)
+			tmpl, err := LoadTemplates(sessions.Template, cfg.TemplateBucketURL)
 			if err != nil {
 				return nil, fmt.Errorf("failed to load templates: %w", err)
 			}
+
+			// check the templates before anything is listed
+			err = ValidateTemplates(tmpl, cfg.IndexTemplate, cfg.IndexType != SinglePageIdentifier)
+			if err != nil {
+				return nil, err
+			}
 			renderers = append(renderers, HTMLIndexRenderer(tmpl, cfg.IndexTemplate))
 		}
 	}
@@ -212,18 +789,102 @@ func TimeFunc(f func() error) (time.Duration, error) {
 	return time.Since(start), err
 }
 
-func localOutputFS(args []string) (afero.Fs, error) {
-	var outputFS afero.Fs
-	var err error
-	if len(os.Args) == 3 {
-		localOutputDirectory := args[2]
-		outputFS, err = NewLocalOutputFS(localOutputDirectory)
+// parseSourceArg parses a source argument of the form s3://bucket/prefix,
+// file:///path or the legacy bucket/destination-prefix, updating cfg to match.
+func parseSourceArg(arg string, cfg *Config) (*url.URL, error) {
+	if !strings.Contains(arg, "://") {
+		// as originally, indexes are written to the root of the bucket and
+		// the prefix is ignored unless a destination prefix flag was given
+		cfg.Bucket, _, _ = strings.Cut(arg, "/")
+		if !cfg.destinationPrefixFlag {
+			cfg.DestinationBucketPrefix = ""
+		}
+		return &url.URL{Scheme: "s3", Host: cfg.Bucket}, nil
+	}
+
+	sourceURL, err := url.Parse(arg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse source %v as URL: %w", arg, err)
+	}
+
+	switch sourceURL.Scheme {
+	case "s3":
+		cfg.Bucket = sourceURL.Host
+		if prefix := strings.Trim(sourceURL.Path, "/"); prefix != "" {
+			cfg.ObjectPrefix = prefix
+		}
+	case "file":
+		if sourceURL.Path == "" {
+			return nil, fmt.Errorf("source %v has no path", arg)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported source scheme %v, expected s3 or file", sourceURL.Scheme)
+	}
+
+	return sourceURL, nil
+}
+
+// defaultOutputFS returns the output used when no local output directory is
+// given, which for a local source is the source directory itself. Listing
+// files have no directory to write to so require an output directory.
+func defaultOutputFS(sessions *Sessions, cfg Config, sourceURL *url.URL) (afero.Fs, error) {
+	if sourceURL.Scheme == "file" {
+		if IsListingFile(sourceURL.Path) {
+			return nil, fmt.Errorf("an output directory is required when indexing listing file %v", sourceURL.Path)
+		}
+		return NewLocalOutputFS(sourceURL.Path)
+	}
+	return NewS3OutputFS(sessions.Destination, cfg.Bucket, cfg.DestinationBucketPrefix, &cfg.ServerSideEncryption), nil
+}
+
+// dumpListing writes the objects and tags at the s3:// source in sourceArg to
+// outputPath as a listing file, or to stdout as JSON if outputPath is empty.
+func dumpListing(ctx context.Context, sessions *Sessions, cfg Config, sourceArg string, outputPath string) error {
+	sourceURL, err := parseSourceArg(sourceArg, &cfg)
+	if err != nil {
+		return err
+	}
+	if sourceURL.Scheme != "s3" {
+		return fmt.Errorf("can only dump listings of s3 sources, got %v", sourceArg)
+	}
+
+	format := JSONListing
+	if outputPath != "" {
+		format, err = ListingFormat(outputPath)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create local output FS: %w", err)
+			return err
 		}
 	}
 
-	return outputFS, nil
+	s3Bucket := NewS3Bucket(sessions.Source, cfg.Bucket, cfg.ServerSideEncryption)
+
+	var objects []Object
+	duration, err := TimeFunc(func() error {
+		var listErr error
+		objects, listErr = s3Bucket.ListObjectsWithTags(ctx, cfg.ObjectPrefix)
+		return listErr
+	})
+	log.Printf("ListObjectsWithTags: duration:%v\n", duration)
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	if outputPath == "" {
+		return WriteListing(os.Stdout, format, objects)
+	}
+
+	f, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create listing %v: %w", outputPath, err)
+	}
+
+	err = WriteListing(f, format, objects)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write listing %v: %w", outputPath, err)
+	}
+
+	return f.Close()
 }
 
 func main() {
@@ -237,30 +898,26 @@ func main() {
 	//
 	//defer pprof.StopCPUProfile()
 	//
-	sess := s3Session()
-
-	cfg := parseConfigFromEnvironment()
+	cfg, err := parseConfigFromEnvironment()
 
 	if os.Getenv("_HANDLER") != "" {
-		lambda.Start(HandleRequest(sess, cfg))
-	} else {
-		if len(os.Args) >= 2 {
-			cfg.Bucket, cfg.DestinationBucketPrefix, _ = strings.Cut(os.Args[1], "/")
-
-			outputFS, err := localOutputFS(os.Args)
-			if err != nil {
-				log.Fatalf("failed to create local output FS: %v", err)
-			}
-
-			if outputFS == nil {
-				outputFS = NewS3OutputFS(sess, cfg.Bucket, "", &cfg.ServerSideEncryption)
-			}
+		// the command line validates once its flags have been applied
+		err = errors.Join(err, cfg.Validate())
+		if err != nil {
+			log.Fatalf("invalid configuration:\n%v", err)
+		}
 
-			err = indexS3Bucket(context.Background(), sess, cfg, outputFS)
-			//	pprof.WriteHeapProfile(heapProf)
-			if err != nil {
-				log.Fatalf("failed to generate index files: %v", err)
-			}
+		jobs, err := jobConfigs(cfg)
+		if err != nil {
+			log.Fatalf("failed to load config file: %v", err)
+		}
+		lambda.Start(HandleRequest(NewSessions(cfg), jobs))
+	} else {
+		// flags may override the values that couldn't be parsed
+		err = runCLI(context.Background(), cfg, err, os.Args[1:], os.Stdout, os.Stderr)
+		//	pprof.WriteHeapProfile(heapProf)
+		if err != nil {
+			log.Fatalf("%v: %v", cliName, err)
 		}
 	}
 }
@@ -1,15 +1,226 @@
 package main
 
 import (
+	"errors"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestIndexFormats(t *testing.T) {
 	// Test the index formats
 	format := "json"
 
-	formats := indexFormats(format)
+	formats, err := indexFormats(format)
+	if err != nil {
+		t.Fatalf("indexFormats() error = %v", err)
+	}
 	if len(formats) != 1 {
 		t.Errorf("Expected 1, got %d", len(formats))
 	}
 }
+
+func TestEnrichmentConfigInclude(t *testing.T) {
+	tests := map[string]struct {
+		cfg     EnrichmentConfig
+		key     string
+		include bool
+	}{
+		"disabled": {
+			cfg:     EnrichmentConfig{},
+			key:     "data/product/1.0.0/product_linux_amd64.zip",
+			include: false,
+		},
+		"prefix match": {
+			cfg:     EnrichmentConfig{Prefixes: []string{"data/product/"}},
+			key:     "data/product/1.0.0/product_linux_amd64.zip",
+			include: true,
+		},
+		"prefix mismatch": {
+			cfg:     EnrichmentConfig{Prefixes: []string{"data/other/"}},
+			key:     "data/product/1.0.0/product_linux_amd64.zip",
+			include: false,
+		},
+		"prefix and suffix match": {
+			cfg:     EnrichmentConfig{Prefixes: []string{"data/"}, Suffixes: []string{".tar.gz", ".zip"}},
+			key:     "data/product/1.0.0/product_linux_amd64.zip",
+			include: true,
+		},
+		"prefix match suffix mismatch": {
+			cfg:     EnrichmentConfig{Prefixes: []string{"data/"}, Suffixes: []string{".tar.gz"}},
+			key:     "data/product/1.0.0/product_linux_amd64.zip",
+			include: false,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if include := tc.cfg.Include(tc.key); include != tc.include {
+				t.Fatalf("got %v, expected %v", include, tc.include)
+			}
+		})
+	}
+}
+
+func TestParseSourceArg(t *testing.T) {
+	tests := map[string]struct {
+		arg               string
+		scheme            string
+		path              string
+		bucket            string
+		objectPrefix      string
+		destinationPrefix string
+		cfg               Config
+		wantErr           bool
+	}{
+		// the legacy form writes to the root of the bucket
+		"bucket and destination prefix": {
+			arg:    "bucket/site",
+			scheme: "s3",
+			bucket: "bucket",
+			cfg:    Config{DestinationBucketPrefix: "env"},
+		},
+		"bucket and destination prefix flag": {
+			arg:               "bucket/site",
+			scheme:            "s3",
+			bucket:            "bucket",
+			destinationPrefix: "flag",
+			cfg:               Config{DestinationBucketPrefix: "flag", destinationPrefixFlag: true},
+		},
+		"s3 url with destination prefix": {
+			arg:               "s3://bucket/data",
+			scheme:            "s3",
+			bucket:            "bucket",
+			objectPrefix:      "data",
+			destinationPrefix: "env",
+			cfg:               Config{DestinationBucketPrefix: "env"},
+		},
+		"s3 url": {
+			arg:          "s3://bucket/data/product/",
+			scheme:       "s3",
+			bucket:       "bucket",
+			objectPrefix: "data/product",
+		},
+		"s3 url without prefix": {
+			arg:    "s3://bucket",
+			scheme: "s3",
+			bucket: "bucket",
+		},
+		"file url": {
+			arg:    "file:///tmp/releases",
+			scheme: "file",
+			path:   "/tmp/releases",
+		},
+		"file url without path": {
+			arg:     "file://",
+			wantErr: true,
+		},
+		"unsupported scheme": {
+			arg:     "https://example.com/releases",
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg := tc.cfg
+			sourceURL, err := parseSourceArg(tc.arg, &cfg)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSourceArg() error = %v", err)
+			}
+
+			if sourceURL.Scheme != tc.scheme {
+				t.Errorf("scheme: got %v, expected %v", sourceURL.Scheme, tc.scheme)
+			}
+			if tc.scheme == "file" && sourceURL.Path != tc.path {
+				t.Errorf("path: got %v, expected %v", sourceURL.Path, tc.path)
+			}
+			if cfg.Bucket != tc.bucket {
+				t.Errorf("bucket: got %v, expected %v", cfg.Bucket, tc.bucket)
+			}
+			if cfg.ObjectPrefix != tc.objectPrefix {
+				t.Errorf("object prefix: got %v, expected %v", cfg.ObjectPrefix, tc.objectPrefix)
+			}
+			if cfg.DestinationBucketPrefix != tc.destinationPrefix {
+				t.Errorf("destination prefix: got %v, expected %v", cfg.DestinationBucketPrefix, tc.destinationPrefix)
+			}
+		})
+	}
+}
+
+func TestParseConfigFromEnvironment(t *testing.T) {
+	t.Setenv("INDEX_FORMATS", "json")
+	t.Setenv("TEMPLATE_BUCKET_URL", "s3://bucket/templates")
+	t.Setenv("LISTING_WORKERS", "4")
+
+	cfg, err := parseConfigFromEnvironment()
+	if err != nil {
+		t.Fatalf("parseConfigFromEnvironment() error = %v", err)
+	}
+
+	assert.Equal(t, []IndexFormat{JSONIndex}, cfg.IndexFormats)
+	assert.Equal(t, "bucket", cfg.TemplateBucketURL.Host)
+	assert.Equal(t, 4, cfg.ListingWorkers)
+	assert.Equal(t, "multipage.index.html.tmpl", cfg.IndexTemplate)
+}
+
+func TestParseConfigFromEnvironmentErrors(t *testing.T) {
+	t.Setenv("INDEX_TYPE", "other")
+	t.Setenv("INDEX_FORMATS", "htm,json")
+	t.Setenv("TEMPLATE_BUCKET_URL", "https://example.com/templates")
+	t.Setenv("STATIC_BUCKET_URL", "s3:///static")
+	t.Setenv("INCREMENTAL", "maybe")
+	t.Setenv("LISTING_STRATEGY", "parallel")
+	t.Setenv("LISTING_WORKERS", "many")
+	t.Setenv("S3_FORCE_PATH_STYLE", "sometimes")
+
+	cfg, err := parseConfigFromEnvironment()
+	if err == nil {
+		t.Fatalf("parseConfigFromEnvironment() expected error")
+	}
+
+	// values that parse but aren't valid are left to Validate
+	assert.NotContains(t, err.Error(), "INDEX_TYPE")
+	assert.NotContains(t, err.Error(), "LISTING_STRATEGY")
+	err = errors.Join(err, cfg.Validate())
+
+	// every problem is reported at once
+	for _, name := range []string{
+		"INDEX_TYPE",
+		"INDEX_FORMATS: unknown index formats htm",
+		"TEMPLATE_BUCKET_URL: expected an s3:// URL",
+		"STATIC_BUCKET_URL: expected a bucket",
+		"INCREMENTAL",
+		"LISTING_STRATEGY",
+		"LISTING_WORKERS",
+		"S3_FORCE_PATH_STYLE",
+	} {
+		assert.ErrorContains(t, err, name)
+	}
+}
+
+func TestIndexFormatsUnknown(t *testing.T) {
+	_, err := indexFormats("html,htm")
+	assert.ErrorContains(t, err, "htm")
+
+	formats, err := indexFormats(" html , json ")
+	assert.NoError(t, err)
+	assert.Equal(t, []IndexFormat{HTMLIndex, JSONIndex}, formats)
+}
+
+func TestIndexRenderersChecksTemplate(t *testing.T) {
+	cfg := Config{
+		IndexType:     MultiPageIdentifier,
+		IndexFormats:  []IndexFormat{HTMLIndex},
+		IndexTemplate: "missing.index.html.tmpl",
+	}
+
+	_, err := indexRenderers(&Sessions{}, cfg)
+	assert.ErrorContains(t, err, "missing.index.html.tmpl")
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -12,14 +14,31 @@ type Object interface {
 	Key() string
 	LastModified() time.Time
 	Size() int64
+	ETag() string
+	StorageClass() string
+	Owner() string
 	BaseName() string
 	Tags() map[string]string
 	SetTags(tags map[string]string)
+	Metadata() ObjectMetadata
+	SetMetadata(metadata ObjectMetadata)
+}
+
+// ObjectMetadata holds the details of an object that are only available from
+// HeadObject rather than a listing.
+type ObjectMetadata struct {
+	ContentType    string            `json:"content_type,omitempty"`
+	UserMetadata   map[string]string `json:"user_metadata,omitempty"`
+	ChecksumSHA256 string            `json:"checksum_sha256,omitempty"`
+	ChecksumSHA1   string            `json:"checksum_sha1,omitempty"`
+	ChecksumCRC32  string            `json:"checksum_crc32,omitempty"`
+	ChecksumCRC32C string            `json:"checksum_crc32c,omitempty"`
 }
 
 type object struct {
-	obj  *s3.Object
-	tags map[string]string
+	obj      *s3.Object
+	tags     map[string]string
+	metadata ObjectMetadata
 }
 
 func (o *object) Key() string {
@@ -43,6 +62,36 @@ func (o *object) Size() int64 {
 	return *o.obj.Size
 }
 
+// ETag returns the object's ETag without the surrounding quotes.
+func (o *object) ETag() string {
+	if o.obj == nil || o.obj.ETag == nil {
+		return ""
+	}
+	return strings.Trim(*o.obj.ETag, `"`)
+}
+
+func (o *object) StorageClass() string {
+	if o.obj == nil || o.obj.StorageClass == nil {
+		return ""
+	}
+	return *o.obj.StorageClass
+}
+
+// Owner returns the display name of the object's owner, falling back to the
+// owner's canonical ID if no display name is available.
+func (o *object) Owner() string {
+	if o.obj == nil || o.obj.Owner == nil {
+		return ""
+	}
+	if o.obj.Owner.DisplayName != nil && *o.obj.Owner.DisplayName != "" {
+		return *o.obj.Owner.DisplayName
+	}
+	if o.obj.Owner.ID != nil {
+		return *o.obj.Owner.ID
+	}
+	return ""
+}
+
 func (o *object) BaseName() string {
 	return filepath.Base(o.Key())
 }
@@ -55,6 +104,14 @@ func (o *object) SetTags(tags map[string]string) {
 	o.tags = tags
 }
 
+func (o *object) Metadata() ObjectMetadata {
+	return o.metadata
+}
+
+func (o *object) SetMetadata(metadata ObjectMetadata) {
+	o.metadata = metadata
+}
+
 func NewObject(obj *s3.Object) Object {
 	return &object{
 		obj:  obj,
@@ -73,8 +130,144 @@ func NewObjectWithTags(obj *s3.Object, tags map[string]string) Object {
 type ObjectTagSetter interface {
 }
 
+// ObjectEnricherFunc adds detail to a page of objects that isn't available
+// from a listing, such as tags or metadata.
+type ObjectEnricherFunc func(ctx context.Context, objects []Object) error
+
+// EnrichedPageLister passes each page listed by pageLister through enrichers
+// before handing it to fn.
+func EnrichedPageLister(pageLister ObjectPageListerFunc, enrichers ...ObjectEnricherFunc) ObjectPageListerFunc {
+	return func(ctx context.Context, prefix string, fn ObjectPageFunc) error {
+		return pageLister(ctx, prefix, func(objects []Object) error {
+			err := enrichObjects(ctx, objects, enrichers)
+			if err != nil {
+				return err
+			}
+			return fn(objects)
+		})
+	}
+}
+
+// EnrichedDirectoryLister passes the objects listed by directoryLister
+// through enrichers before returning them.
+func EnrichedDirectoryLister(directoryLister DirectoryListerFunc, enrichers ...ObjectEnricherFunc) DirectoryListerFunc {
+	return func(ctx context.Context, prefix string) ([]Object, []string, error) {
+		objects, commonPrefixes, err := directoryLister(ctx, prefix)
+		if err != nil {
+			return objects, commonPrefixes, err
+		}
+		return objects, commonPrefixes, enrichObjects(ctx, objects, enrichers)
+	}
+}
+
+// FilteredPageLister drops the objects whose keys match exclude from the
+// pages listed by pageLister.
+func FilteredPageLister(pageLister ObjectPageListerFunc, exclude PredicateFunc) ObjectPageListerFunc {
+	return func(ctx context.Context, prefix string, fn ObjectPageFunc) error {
+		return pageLister(ctx, prefix, func(objects []Object) error {
+			return fn(filterObjects(objects, exclude))
+		})
+	}
+}
+
+// FilteredDirectoryLister drops the objects whose keys match exclude, and the
+// common prefixes matching excludePrefix, from those listed by
+// directoryLister.
+func FilteredDirectoryLister(directoryLister DirectoryListerFunc, exclude PredicateFunc, excludePrefix PredicateFunc) DirectoryListerFunc {
+	return func(ctx context.Context, prefix string) ([]Object, []string, error) {
+		objects, commonPrefixes, err := directoryLister(ctx, prefix)
+		if err != nil {
+			return objects, commonPrefixes, err
+		}
+		return filterObjects(objects, exclude), slices.DeleteFunc(commonPrefixes, excludePrefix), nil
+	}
+}
+
+// NonEmptyDirectoryLister drops the common prefixes matching check from those
+// listed by directoryLister if listing them through directoryLister finds
+// nothing, such as a directory whose only objects have been filtered out.
+func NonEmptyDirectoryLister(directoryLister DirectoryListerFunc, check PredicateFunc) DirectoryListerFunc {
+	var nonEmpty DirectoryListerFunc
+	nonEmpty = func(ctx context.Context, prefix string) ([]Object, []string, error) {
+		objects, commonPrefixes, err := directoryLister(ctx, prefix)
+		if err != nil {
+			return objects, commonPrefixes, err
+		}
+
+		kept := make([]string, 0, len(commonPrefixes))
+		for _, commonPrefix := range commonPrefixes {
+			if check(commonPrefix) {
+				prefixObjects, prefixCommonPrefixes, err := nonEmpty(ctx, commonPrefix)
+				if err != nil {
+					return nil, nil, err
+				}
+				if len(prefixObjects) == 0 && len(prefixCommonPrefixes) == 0 {
+					continue
+				}
+			}
+			kept = append(kept, commonPrefix)
+		}
+
+		return objects, kept, nil
+	}
+
+	return nonEmpty
+}
+
+func filterObjects(objects []Object, exclude PredicateFunc) []Object {
+	return slices.DeleteFunc(objects, func(o Object) bool {
+		return o != nil && exclude(o.Key())
+	})
+}
+
+func enrichObjects(ctx context.Context, objects []Object, enrichers []ObjectEnricherFunc) error {
+	for _, enricher := range enrichers {
+		err := enricher(ctx, objects)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type ObjectListerFunc func(ctx context.Context, prefix string) ([]Object, error)
 
+// ObjectPageFunc is called with each page of objects as it is listed.
+type ObjectPageFunc func(objects []Object) error
+
+// ObjectPageListerFunc lists the objects under prefix, passing each page to fn
+// as soon as it is available rather than collecting them all first.
+type ObjectPageListerFunc func(ctx context.Context, prefix string, fn ObjectPageFunc) error
+
+// PagesFromLister adapts an ObjectListerFunc into an ObjectPageListerFunc
+// that returns everything as a single page.
+func PagesFromLister(lister ObjectListerFunc) ObjectPageListerFunc {
+	return func(ctx context.Context, prefix string, fn ObjectPageFunc) error {
+		objects, err := lister(ctx, prefix)
+		if err != nil {
+			return err
+		}
+		return fn(objects)
+	}
+}
+
+// CollectPages adapts an ObjectPageListerFunc into an ObjectListerFunc that
+// collects every page before returning.
+func CollectPages(pageLister ObjectPageListerFunc) ObjectListerFunc {
+	return func(ctx context.Context, prefix string) ([]Object, error) {
+		items := make([]Object, 0)
+		err := pageLister(ctx, prefix, func(objects []Object) error {
+			items = append(items, objects...)
+			return nil
+		})
+		return items, err
+	}
+}
+
+// DirectoryListerFunc lists the objects directly within prefix and the common
+// prefixes of its sub-directories.
+type DirectoryListerFunc func(ctx context.Context, prefix string) ([]Object, []string, error)
+
 type ObjectLister interface {
 	ListObjects(ctx context.Context, prefix string) ([]Object, error)
 }
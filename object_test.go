@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestNewObject(t *testing.T) {
@@ -63,6 +66,58 @@ func TestIndexEntry(t *testing.T) {
 	}
 }
 
+func TestEnrichedPageLister(t *testing.T) {
+	pages := [][]Object{
+		{simpleObject("a/fileA"), simpleObject("b/fileB")},
+	}
+
+	enricher := func(ctx context.Context, objects []Object) error {
+		for _, o := range objects {
+			o.SetMetadata(ObjectMetadata{ContentType: "application/zip"})
+		}
+		return nil
+	}
+
+	objects, err := CollectPages(EnrichedPageLister(pagedLister(pages, nil), enricher))(context.Background(), "")
+	if err != nil {
+		t.Fatalf("EnrichedPageLister() error = %v", err)
+	}
+
+	for _, o := range objects {
+		if o.Metadata().ContentType != "application/zip" {
+			t.Errorf("Metadata().ContentType = %v, want %v", o.Metadata().ContentType, "application/zip")
+		}
+	}
+}
+
+func TestIndexEntryMetadata(t *testing.T) {
+	o := simpleObject("data/TestProduct/1.0.0/TestProduct_linux_amd64.zip")
+	o.SetMetadata(ObjectMetadata{
+		ContentType:    "application/zip",
+		ChecksumSHA256: "checksum",
+		ChecksumSHA1:   "sha1",
+		ChecksumCRC32:  "crc32",
+		ChecksumCRC32C: "crc32c",
+	})
+
+	entry, err := NewIndexEntry(DioadIndexConfig, o)
+	if err != nil {
+		t.Fatalf("NewIndexEntry() failed, %v", err)
+	}
+
+	if entry.ContentType != "application/zip" || entry.ChecksumSHA256 != "checksum" {
+		t.Errorf("NewIndexEntry() failed, metadata fields not correctly set")
+	}
+
+	content, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatalf("json.Marshal() failed, %v", err)
+	}
+	assert.Contains(t, string(content), `"checksum_sha1":"sha1"`)
+	assert.Contains(t, string(content), `"checksum_crc32":"crc32"`)
+	assert.Contains(t, string(content), `"checksum_crc32c":"crc32c"`)
+}
+
 // Helper functions to create pointers to string, time.Time, and int64
 func stringToPointer(s string) *string {
 	return &s
@@ -75,3 +130,54 @@ func timeToPointer(t time.Time) *time.Time {
 func int64ToPointer(i int64) *int64 {
 	return &i
 }
+
+func TestObjectStorageDetails(t *testing.T) {
+	obj := &s3.Object{
+		Key:          stringToPointer("testKey"),
+		ETag:         stringToPointer(`"d41d8cd98f00b204e9800998ecf8427e"`),
+		StorageClass: stringToPointer("GLACIER"),
+		Owner: &s3.Owner{
+			ID: stringToPointer("owner-id"),
+		},
+	}
+	o := NewObject(obj)
+	if o.ETag() != "d41d8cd98f00b204e9800998ecf8427e" {
+		t.Errorf("ETag() = %v, want %v", o.ETag(), "d41d8cd98f00b204e9800998ecf8427e")
+	}
+	if o.StorageClass() != "GLACIER" {
+		t.Errorf("StorageClass() = %v, want %v", o.StorageClass(), "GLACIER")
+	}
+	if o.Owner() != "owner-id" {
+		t.Errorf("Owner() = %v, want %v", o.Owner(), "owner-id")
+	}
+}
+
+func TestNonEmptyDirectoryLister(t *testing.T) {
+	cfg := Config{IndexFormats: []IndexFormat{HTMLIndex}}
+	keys := []string{
+		"product/1.0/product_1.0_linux_amd64.zip",
+		"static/style.css",
+		"assets/static/logo.png",
+	}
+
+	listed := make([]string, 0)
+	lister := FilteredDirectoryLister(fakeDirectoryLister(keys, &listed), listedKeyPredicate(cfg, ""), generatedPrefixPredicate(cfg, ""))
+	lister = NonEmptyDirectoryLister(lister, staticPrefixPredicate(cfg))
+
+	_, commonPrefixes, err := lister(context.Background(), "")
+	if err != nil {
+		t.Fatalf("lister() error = %v", err)
+	}
+
+	// static/ only holds the generator's static files
+	assert.ElementsMatch(t, []string{"product/", "assets/"}, commonPrefixes)
+
+	keys = append(keys, "static/logo.png")
+	lister = NonEmptyDirectoryLister(FilteredDirectoryLister(fakeDirectoryLister(keys, &listed), listedKeyPredicate(cfg, ""), generatedPrefixPredicate(cfg, "")), staticPrefixPredicate(cfg))
+
+	_, commonPrefixes, err = lister(context.Background(), "")
+	if err != nil {
+		t.Fatalf("lister() error = %v", err)
+	}
+	assert.ElementsMatch(t, []string{"product/", "assets/", "static/"}, commonPrefixes)
+}
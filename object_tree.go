@@ -44,6 +44,40 @@ func (t *ObjectTree) ParentFullPath() string {
 	return filepath.Clean(filepath.Join(t.FullPath, ".."))
 }
 
+// Lookup returns the node at fullPath, or nil if it doesn't exist.
+func (t *ObjectTree) Lookup(fullPath string) *ObjectTree {
+	node := t
+	for _, part := range splitTreePath(fullPath) {
+		child, exists := node.Children[part]
+		if !exists {
+			return nil
+		}
+		node = child
+	}
+	return node
+}
+
+// AddPath adds the node at fullPath, and any missing parents, returning nil
+// if any part of the path is excluded.
+func (t *ObjectTree) AddPath(fullPath string) *ObjectTree {
+	node := t
+	for _, part := range splitTreePath(fullPath) {
+		node = node.AddChild(part)
+		if node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+func splitTreePath(fullPath string) []string {
+	trimmed := strings.Trim(filepath.ToSlash(filepath.Clean(fullPath)), "/")
+	if trimmed == "" || trimmed == "." {
+		return nil
+	}
+	return strings.Split(trimmed, "/")
+}
+
 func (t *ObjectTree) addPathToTree(pathParts []string, obj Object) {
 	if len(pathParts) == 1 {
 		t.addSinglePartObject(obj)
@@ -61,7 +95,7 @@ func (t *ObjectTree) addSinglePartObject(obj Object) {
 		t.Objects = make([]Object, 0)
 	}
 
-	if t.Config.Exclusions.Include(obj.Key()) {
+	if t.Config.Exclusions.Include(obj.Key()) && t.Config.ObjectExclusions.Include(obj) {
 		t.Objects = append(t.Objects, obj)
 	}
 }
@@ -108,6 +142,54 @@ func (t *ObjectTree) AddObjectsWithPrefixFromLister(ctx context.Context, objectL
 	return nil
 }
 
+// AddAllObjectsFromPageLister adds every object under the tree's prefix as
+// each page is listed.
+func (t *ObjectTree) AddAllObjectsFromPageLister(ctx context.Context, pageLister ObjectPageListerFunc) error {
+	return t.addObjectsFromPageLister(ctx, pageLister, t.Config.PrefixToStrip)
+}
+
+// AddObjectsWithPrefixFromPageLister adds the objects under prefix, relative to
+// the tree's prefix, as each page is listed.
+func (t *ObjectTree) AddObjectsWithPrefixFromPageLister(ctx context.Context, pageLister ObjectPageListerFunc, prefix string) error {
+	return t.addObjectsFromPageLister(ctx, pageLister, filepath.Join(t.Config.PrefixToStrip, prefix))
+}
+
+// addObjectsFromPageLister consumes pages as they are listed so that listing
+// overlaps with building the tree, and at most one page is held in memory
+// waiting to be added.
+func (t *ObjectTree) addObjectsFromPageLister(ctx context.Context, pageLister ObjectPageListerFunc, prefix string) error {
+	pages := make(chan []Object, 1)
+
+	errGroup, ctx := errgroup.WithContext(ctx)
+
+	errGroup.Go(func() error {
+		defer close(pages)
+
+		return pageLister(ctx, prefix, func(objects []Object) error {
+			select {
+			case pages <- objects:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	})
+
+	errGroup.Go(func() error {
+		for page := range pages {
+			t.AddObjects(page)
+		}
+		return nil
+	})
+
+	err := errGroup.Wait()
+	if err != nil {
+		return fmt.Errorf("error listing objects: %w", err)
+	}
+
+	return nil
+}
+
 type ObjectTreeWalker func(objTree *ObjectTree) error
 type ObjectWalker func(obj *Object) error
 
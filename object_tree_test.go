@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"path/filepath"
 	"testing"
@@ -77,6 +79,20 @@ func TestExclusions(t *testing.T) {
 	}
 }
 
+func TestObjectExclusions(t *testing.T) {
+	cfg := ObjectTreeConfig{
+		ObjectExclusions: ObjectExclusions{HasStorageClass("GLACIER", "DEEP_ARCHIVE")},
+	}
+	tree := NewRootObjectTree(cfg)
+	tree.AddObject(&object{obj: &s3.Object{Key: stringToPointer("a/standard"), StorageClass: stringToPointer("STANDARD")}})
+	tree.AddObject(&object{obj: &s3.Object{Key: stringToPointer("a/glacier"), StorageClass: stringToPointer("GLACIER")}})
+	tree.AddObject(&object{obj: &s3.Object{Key: stringToPointer("a/deep"), StorageClass: stringToPointer("DEEP_ARCHIVE")}})
+
+	if len(tree.Children["a"].Objects) != 1 {
+		t.Fatalf("expected 1 object, got %v", len(tree.Children["a"].Objects))
+	}
+}
+
 func TestAddObject(t *testing.T) {
 	tree := &ObjectTree{}
 	obj := &object{obj: &s3.Object{Key: stringToPointer("testKey")}}
@@ -135,4 +151,68 @@ func TestWalker(t *testing.T) {
 	fmt.Printf("%v\n", paths)
 }
 
+func pagedLister(pages [][]Object, err error) ObjectPageListerFunc {
+	return func(ctx context.Context, prefix string, fn ObjectPageFunc) error {
+		for _, page := range pages {
+			pageErr := fn(page)
+			if pageErr != nil {
+				return pageErr
+			}
+		}
+		return err
+	}
+}
+
+func TestAddAllObjectsFromPageLister(t *testing.T) {
+	pages := [][]Object{
+		{simpleObject("a/b/fileA"), simpleObject("a/b/fileB")},
+		{simpleObject("a/fileC")},
+		{},
+		{simpleObject("d/fileD")},
+	}
+
+	tree := NewRootObjectTree(ObjectTreeConfig{})
+	err := tree.AddAllObjectsFromPageLister(context.Background(), pagedLister(pages, nil))
+	if err != nil {
+		t.Fatalf("AddAllObjectsFromPageLister() error = %v", err)
+	}
+
+	if len(tree.Children["a"].Children["b"].Objects) != 2 {
+		t.Errorf("expected 2 objects in a/b, got %v", len(tree.Children["a"].Children["b"].Objects))
+	}
+	if len(tree.Children["a"].Objects) != 1 {
+		t.Errorf("expected 1 object in a, got %v", len(tree.Children["a"].Objects))
+	}
+	if len(tree.Children["d"].Objects) != 1 {
+		t.Errorf("expected 1 object in d, got %v", len(tree.Children["d"].Objects))
+	}
+}
+
+func TestAddAllObjectsFromPageListerError(t *testing.T) {
+	pages := [][]Object{
+		{simpleObject("a/b/fileA")},
+	}
+
+	tree := NewRootObjectTree(ObjectTreeConfig{})
+	err := tree.AddAllObjectsFromPageLister(context.Background(), pagedLister(pages, errors.New("listing failed")))
+	if err == nil {
+		t.Fatalf("AddAllObjectsFromPageLister() expected error")
+	}
+}
+
+func TestCollectPages(t *testing.T) {
+	pages := [][]Object{
+		{simpleObject("fileA")},
+		{simpleObject("fileB"), simpleObject("fileC")},
+	}
+
+	objects, err := CollectPages(pagedLister(pages, nil))(context.Background(), "")
+	if err != nil {
+		t.Fatalf("CollectPages() error = %v", err)
+	}
+	if len(objects) != 3 {
+		t.Errorf("expected 3 objects, got %v", len(objects))
+	}
+}
+
 // Continue with the rest of the tests...
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	// stagingDirectory holds each generation while it's being rendered
+	stagingDirectory = "/.staging"
+	// generationManifestFile describes the generation that was last published
+	generationManifestFile = "/.generation.json"
+)
+
+// GenerationManifest is written alongside the indexes once a generation has
+// been published.
+type GenerationManifest struct {
+	Generation  string    `json:"generation"`
+	PublishedAt time.Time `json:"published_at"`
+	Files       int       `json:"files"`
+	Removed     int       `json:"removed"`
+}
+
+// PublishError is returned when copying a staged generation into place fails
+// after it has rendered, which may leave the live indexes a mix of
+// generations. It should be retried even if the copy stopped because a newer
+// generation started, as the newer one may not cover every directory this
+// one changed.
+type PublishError struct {
+	Generation string
+	Promoted   int
+	Files      int
+	Err        error
+}
+
+func (e *PublishError) Error() string {
+	if e.Promoted > 0 {
+		return fmt.Sprintf("failed to publish generation %v after copying %d of %d files, live indexes are partly from this generation: %v", e.Generation, e.Promoted, e.Files, e.Err)
+	}
+	return fmt.Sprintf("failed to publish generation %v: %v", e.Generation, e.Err)
+}
+
+func (e *PublishError) Unwrap() error {
+	return e.Err
+}
+
+// CopyFs is implemented by outputs that can copy a file without it being read
+// back and written again, so publishing a staged generation only uploads each
+// file once.
+type CopyFs interface {
+	// CopyFile copies src to dst, along with anything stored alongside it
+	CopyFile(src string, dst string) error
+}
+
+// copyFile copies src to dst within outputFS, using CopyFile if outputFS is a
+// CopyFs.
+func copyFile(outputFS afero.Fs, src string, dst string) error {
+	if copier, ok := outputFS.(CopyFs); ok {
+		return copier.CopyFile(src, dst)
+	}
+
+	content, err := afero.ReadFile(outputFS, src)
+	if err != nil {
+		return fmt.Errorf("failed to read %v: %w", src, err)
+	}
+
+	err = outputFS.MkdirAll(path.Dir(dst), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create directory %v: %w", path.Dir(dst), err)
+	}
+
+	return afero.WriteFile(outputFS, dst, content, 0644)
+}
+
+// StagingFs is an afero.Fs that writes to staging while reading from the
+// live output, so that a generation can be rendered without changing what's
+// live. Removals are recorded rather than applied so they can be made once
+// the generation is published.
+type StagingFs struct {
+	afero.Fs
+
+	staging afero.Fs
+	removed []string
+	mu      sync.Mutex
+}
+
+func NewStagingFs(live afero.Fs, staging afero.Fs) *StagingFs {
+	return &StagingFs{
+		Fs:      live,
+		staging: staging,
+		removed: make([]string, 0),
+	}
+}
+
+// Removed returns the paths removed while staging.
+func (s *StagingFs) Removed() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.removed)
+}
+
+func (s *StagingFs) Name() string {
+	return "StagingFs"
+}
+
+func (s *StagingFs) Create(name string) (afero.File, error) {
+	return s.staging.Create(name)
+}
+
+func (s *StagingFs) Mkdir(name string, perm os.FileMode) error {
+	return s.staging.Mkdir(name, perm)
+}
+
+func (s *StagingFs) MkdirAll(name string, perm os.FileMode) error {
+	return s.staging.MkdirAll(name, perm)
+}
+
+func (s *StagingFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		return s.staging.OpenFile(name, flag, perm)
+	}
+	return s.Fs.OpenFile(name, flag, perm)
+}
+
+func (s *StagingFs) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removed = append(s.removed, name)
+	return nil
+}
+
+func (s *StagingFs) RemoveAll(name string) error {
+	return errors.New("RemoveAll is not supported while staging")
+}
+
+func (s *StagingFs) Rename(oldname, newname string) error {
+	return errors.New("Rename is not supported while staging")
+}
+
+func (s *StagingFs) Chmod(name string, mode os.FileMode) error {
+	return s.staging.Chmod(name, mode)
+}
+
+func (s *StagingFs) Chown(name string, uid, gid int) error {
+	return s.staging.Chown(name, uid, gid)
+}
+
+func (s *StagingFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return s.staging.Chtimes(name, atime, mtime)
+}
+
+// hashedStagingFs is a StagingFs over a HashedFs, which compares hashes with
+// the live files and stores them with the staged ones, so that only changed
+// files are staged and their hashes are kept once they're copied into place.
+type hashedStagingFs struct {
+	*StagingFs
+
+	hashed     HashedFs
+	stagingDir string
+}
+
+// stagingFs returns staged, as a HashedFs if outputFS is one.
+func stagingFs(staged *StagingFs, outputFS afero.Fs, stagingDir string) afero.Fs {
+	if hashed, ok := outputFS.(HashedFs); ok {
+		return &hashedStagingFs{StagingFs: staged, hashed: hashed, stagingDir: stagingDir}
+	}
+	return staged
+}
+
+func (s *hashedStagingFs) ReadFileHash(name string) (string, error) {
+	return s.hashed.ReadFileHash(name)
+}
+
+func (s *hashedStagingFs) WriteFileWithHash(name string, data []byte, hash string) error {
+	return s.hashed.WriteFileWithHash(path.Join(s.stagingDir, name), data, hash)
+}
+
+// stagedFiles returns the files within stagingFS, deepest first so that
+// directories are populated before the indexes that link to them.
+func stagedFiles(stagingFS afero.Fs) ([]string, error) {
+	files := make([]string, 0)
+
+	err := afero.Walk(stagingFS, "/", func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, filePath)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(files, func(a, b string) int {
+		if depth := strings.Count(b, "/") - strings.Count(a, "/"); depth != 0 {
+			return depth
+		}
+		return strings.Compare(a, b)
+	})
+
+	return files, nil
+}
+
+// promoteFiles copies each of files from stagingDir within outputFS into
+// place, returning how many were copied. The files are copied one at a time,
+// so if a copy fails those before it are already live.
+func promoteFiles(outputFS afero.Fs, stagingDir string, files []string) (int, error) {
+	for i, filePath := range files {
+		err := copyFile(outputFS, path.Join(stagingDir, filePath), filePath)
+		if err != nil {
+			return i, fmt.Errorf("failed to publish %v: %w", filePath, err)
+		}
+	}
+
+	return len(files), nil
+}
+
+// discardGeneration removes the staging directory of generation.
+func discardGeneration(outputFS afero.Fs, generation string) {
+	err := outputFS.RemoveAll(path.Join(stagingDirectory, generation))
+	if err != nil {
+		log.Printf("failed to remove staged generation %v: %v\n", generation, err)
+	}
+}
+
+// PublishGeneration runs index against a staging directory within outputFS
+// and only once it has succeeded copies the staged files into place, applies
+// any removals and writes the generation manifest. If index fails the
+// previous generation is left untouched. Files that are unchanged aren't
+// staged when cfg.SkipUnchanged is set, and the rest are copied within the
+// output if it's a CopyFs, so each is only uploaded once. S3 can't switch
+// several keys at once, so if the copy fails part way the live indexes are a
+// mix of both generations and a PublishError is returned so the run is
+// retried. The staging directory is removed either way.
+func PublishGeneration(cfg Config, outputFS afero.Fs, generation string, index func(cfg Config, outputFS afero.Fs) error) error {
+	stagingDir := path.Join(stagingDirectory, generation)
+	stagingFS := afero.NewBasePathFs(outputFS, stagingDir)
+	defer discardGeneration(outputFS, generation)
+
+	staged := NewStagingFs(outputFS, stagingFS)
+
+	duration, err := TimeFunc(func() error {
+		return writeIndexes(cfg, stagingFs(staged, outputFS, stagingDir), index)
+	})
+	log.Printf("StageGeneration: generation:%v duration:%v\n", generation, duration)
+	if err != nil {
+		return fmt.Errorf("generation %v failed, previous generation left in place: %w", generation, err)
+	}
+
+	files, err := stagedFiles(stagingFS)
+	if err != nil {
+		return fmt.Errorf("failed to list generation %v: %w", generation, err)
+	}
+
+	var removed []string
+	promoted := 0
+	duration, err = TimeFunc(func() error {
+		var err error
+		promoted, err = promoteFiles(outputFS, stagingDir, files)
+		if err != nil {
+			return err
+		}
+
+		removed, err = RemoveFiles(outputFS, staged.Removed())
+		logRemovedIndexFiles(removed)
+		return err
+	})
+	log.Printf("PublishGeneration: generation:%v files:%d promoted:%d duration:%v\n", generation, len(files), promoted, duration)
+	if err != nil {
+		return &PublishError{Generation: generation, Promoted: promoted, Files: len(files), Err: err}
+	}
+
+	manifest, err := json.Marshal(GenerationManifest{
+		Generation:  generation,
+		PublishedAt: time.Now().UTC(),
+		Files:       len(files),
+		Removed:     len(removed),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = afero.WriteFile(outputFS, generationManifestFile, manifest, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write generation manifest: %w", err)
+	}
+
+	return nil
+}
+
+// publishIndexes runs index against outputFS as a new generation, which is
+// full if index regenerates every index. If cfg.GenerationGuard is set it
+// gives up with ErrSuperseded once a newer generation starts, and if
+// cfg.StagedPublish is set the generation is staged first.
+func publishIndexes(cfg Config, outputFS afero.Fs, full bool, index func(cfg Config, outputFS afero.Fs) error) error {
+	generation := newGeneration()
+
+	if cfg.GenerationGuard {
+		err := ClaimGeneration(outputFS, generation, full)
+		if err != nil {
+			return err
+		}
+		outputFS = guardGeneration(outputFS, generation)
+	}
+
+	if cfg.StagedPublish {
+		return PublishGeneration(cfg, outputFS, generation, index)
+	}
+	return writeIndexes(cfg, outputFS, index)
+}
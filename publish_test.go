@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishGeneration(t *testing.T) {
+	outputFS := NewMemoryOutputFS()
+	afero.WriteFile(outputFS, "/index.html", []byte("old"), 0644)
+	afero.WriteFile(outputFS, "/gone/index.html", []byte("old"), 0644)
+
+	index := func(cfg Config, outputFS afero.Fs) error {
+		// nothing is live until every file has been written
+		content, _ := afero.ReadFile(outputFS, "/index.html")
+		assert.Equal(t, "old", string(content))
+
+		afero.WriteFile(outputFS, "/index.html", []byte("new"), 0644)
+		assert.NoError(t, outputFS.MkdirAll("/a/b", 0755))
+		afero.WriteFile(outputFS, "/a/b/index.html", []byte("new"), 0644)
+
+		content, _ = afero.ReadFile(outputFS, "/index.html")
+		assert.Equal(t, "old", string(content))
+
+		return outputFS.Remove("/gone/index.html")
+	}
+
+	err := PublishGeneration(Config{}, outputFS, newGeneration(), index)
+	if err != nil {
+		t.Fatalf("PublishGeneration() error = %v", err)
+	}
+
+	content, _ := afero.ReadFile(outputFS, "/index.html")
+	assert.Equal(t, "new", string(content))
+	content, _ = afero.ReadFile(outputFS, "/a/b/index.html")
+	assert.Equal(t, "new", string(content))
+
+	exists, _ := afero.Exists(outputFS, "/gone/index.html")
+	assert.False(t, exists)
+
+	manifestContent, err := afero.ReadFile(outputFS, generationManifestFile)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	manifest := GenerationManifest{}
+	assert.NoError(t, json.Unmarshal(manifestContent, &manifest))
+	assert.NotEmpty(t, manifest.Generation)
+	assert.Equal(t, 2, manifest.Files)
+	assert.Equal(t, 1, manifest.Removed)
+
+	exists, _ = afero.Exists(outputFS, path.Join(stagingDirectory, manifest.Generation))
+	assert.False(t, exists)
+}
+
+func TestPublishGenerationFailure(t *testing.T) {
+	outputFS := NewMemoryOutputFS()
+	afero.WriteFile(outputFS, "/index.html", []byte("old"), 0644)
+	afero.WriteFile(outputFS, "/gone/index.html", []byte("old"), 0644)
+
+	index := func(cfg Config, outputFS afero.Fs) error {
+		afero.WriteFile(outputFS, "/index.html", []byte("new"), 0644)
+		outputFS.Remove("/gone/index.html")
+		return errors.New("boom")
+	}
+
+	err := PublishGeneration(Config{}, outputFS, newGeneration(), index)
+	assert.ErrorContains(t, err, "boom")
+
+	content, _ := afero.ReadFile(outputFS, "/index.html")
+	assert.Equal(t, "old", string(content))
+
+	exists, _ := afero.Exists(outputFS, "/gone/index.html")
+	assert.True(t, exists)
+
+	exists, _ = afero.Exists(outputFS, generationManifestFile)
+	assert.False(t, exists)
+}
+
+func TestStagedFiles(t *testing.T) {
+	stagingFS := NewMemoryOutputFS()
+	for _, p := range []string{"/index.html", "/a/index.html", "/a/b/index.html", "/static/style.css"} {
+		afero.WriteFile(stagingFS, p, []byte("content"), 0644)
+	}
+
+	files, err := stagedFiles(stagingFS)
+	if err != nil {
+		t.Fatalf("stagedFiles() error = %v", err)
+	}
+
+	assert.Equal(t, []string{"/a/b/index.html", "/a/index.html", "/static/style.css", "/index.html"}, files)
+}
+
+// failingWriteFs fails to open fail for writing.
+type failingWriteFs struct {
+	afero.Fs
+	fail string
+}
+
+func (f *failingWriteFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if name == f.fail && flag&os.O_WRONLY != 0 {
+		return nil, errors.New("write failed")
+	}
+	return f.Fs.OpenFile(name, flag, perm)
+}
+
+func TestPromoteFilesPartial(t *testing.T) {
+	memFS := NewMemoryOutputFS()
+	files := []string{"/a/index.html", "/b/index.html", "/index.html"}
+	for _, p := range files {
+		afero.WriteFile(memFS, path.Join(stagingDirectory, "gen", p), []byte("new"), 0644)
+	}
+
+	outputFS := &failingWriteFs{Fs: memFS, fail: "/b/index.html"}
+
+	promoted, err := promoteFiles(outputFS, path.Join(stagingDirectory, "gen"), files)
+	assert.ErrorContains(t, err, "failed to publish /b/index.html")
+	assert.Equal(t, 1, promoted)
+
+	content, _ := afero.ReadFile(outputFS, "/a/index.html")
+	assert.Equal(t, "new", string(content))
+
+	exists, _ := afero.Exists(outputFS, "/index.html")
+	assert.False(t, exists)
+}
+
+func TestPublishGenerationCopyFailure(t *testing.T) {
+	outputFS := &failingWriteFs{Fs: NewMemoryOutputFS(), fail: "/b/index.html"}
+
+	index := func(cfg Config, outputFS afero.Fs) error {
+		for _, p := range []string{"/a/index.html", "/b/index.html", "/index.html"} {
+			err := afero.WriteFile(outputFS, p, []byte("new"), 0644)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	generation := newGeneration()
+	err := PublishGeneration(Config{}, outputFS, generation, index)
+	var publishErr *PublishError
+	if !errors.As(err, &publishErr) {
+		t.Fatalf("PublishGeneration() error = %v, expected a PublishError", err)
+	}
+	assert.Equal(t, 1, publishErr.Promoted)
+	assert.Equal(t, 3, publishErr.Files)
+
+	exists, _ := afero.Exists(outputFS, generationManifestFile)
+	assert.False(t, exists)
+	exists, _ = afero.Exists(outputFS, path.Join(stagingDirectory, generation))
+	assert.False(t, exists)
+}
+
+func TestPublishGenerationS3(t *testing.T) {
+	server := newFakeS3Server(t)
+	outputFS := NewS3OutputFS(server.Session(), "bucket-a", "site", aws.String(""))
+	afero.WriteFile(NewSkipUnchangedFs(outputFS), "/a/index.html", []byte("nonce-AAAAAAAA same"), 0644)
+
+	index := func(cfg Config, outputFS afero.Fs) error {
+		for p, content := range map[string]string{"/a/index.html": "nonce-BBBBBBBB same", "/b/index.html": "new"} {
+			err := afero.WriteFile(outputFS, p, []byte(content), 0644)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	generation := newGeneration()
+	puts := server.Requests(http.MethodPut)
+	err := PublishGeneration(Config{SkipUnchanged: true}, guardGeneration(outputFS, generation), generation, index)
+	if err != nil {
+		t.Fatalf("PublishGeneration() error = %v", err)
+	}
+
+	// only the changed file is staged, and it's copied rather than uploaded again
+	assert.Equal(t, 1, server.Requests("COPY"))
+	assert.Equal(t, puts+2, server.Requests(http.MethodPut), "the staged file and the manifest")
+
+	content, _ := afero.ReadFile(outputFS, "/b/index.html")
+	assert.Equal(t, "new", string(content))
+	hash, _ := outputFS.(HashedFs).ReadFileHash("/b/index.html")
+	assert.Equal(t, contentVersion([]byte("new")), hash)
+
+	// the staged generation is removed once it's published
+	assert.Equal(t, []string{"site/.generation.json", "site/a/index.html", "site/b/index.html"}, server.Keys("bucket-a"))
+}
@@ -13,6 +13,19 @@ var (
 	DefaultReleaseInfoKeyExtractor = ReleaseDetailsKeyExtractor(`(?P<Prefix>.*?/)?(?P<Product>[^/]+)/(?P<Version>[^/]+)/(?P<PackageName>[^_]+)(_|_(?P<Extra>.*?)_)(?P<OS>[^_\d]+)_(?P<Arch>[^\.]+)\.(?P<ArchiveType>[^/]+)$`)
 )
 
+// ReleaseDetailTags maps release details to the object tags that can provide
+// them, taking precedence over details extracted from the key.
+var ReleaseDetailTags = map[string]string{
+	"Arch":    "Dioad/Arch",
+	"Product": "Dioad/Project",
+	"OS":      "Dioad/OS",
+	"Version": "Dioad/Version",
+}
+
+// requiredReleaseDetails must be present, from the key or tags, for an object
+// to be listed in the release index.
+var requiredReleaseDetails = []string{"Product", "Version"}
+
 type ReleaseDetailsKeyExtractor string
 
 func extractMetadataFromKey(regExp, key string) (map[string]string, error) {
@@ -150,31 +163,78 @@ func NewVersionIndex(cfg IndexConfig, objectTree *ObjectTree) *VersionIndex {
 }
 
 type IndexEntry struct {
-	Arch     string `json:"arch,omitempty"` // Dioad/Arch
-	Filename string `json:"filename,omitempty"`
-	Name     string `json:"name,omitempty"` // Dioad/Project
-	Os       string `json:"os,omitempty"`   // Dioad/OS
-	Url      string `json:"url,omitempty"`
-	Version  string `json:"version,omitempty"` // Dioad/Version
+	Arch         string `json:"arch,omitempty"` // Dioad/Arch
+	Filename     string `json:"filename,omitempty"`
+	Name         string `json:"name,omitempty"` // Dioad/Project
+	Os           string `json:"os,omitempty"`   // Dioad/OS
+	Url          string `json:"url,omitempty"`
+	Version      string `json:"version,omitempty"` // Dioad/Version
+	ETag         string `json:"etag,omitempty"`
+	StorageClass string `json:"storage_class,omitempty"`
+
+	ContentType    string            `json:"content_type,omitempty"`
+	ChecksumSHA256 string            `json:"checksum_sha256,omitempty"`
+	ChecksumSHA1   string            `json:"checksum_sha1,omitempty"`
+	ChecksumCRC32  string            `json:"checksum_crc32,omitempty"`
+	ChecksumCRC32C string            `json:"checksum_crc32c,omitempty"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+	Tags           map[string]string `json:"tags,omitempty"`
+}
+
+// releaseDetailsFromTags overrides releaseDetails with any provided by tags,
+// returning true if any were found.
+func releaseDetailsFromTags(releaseDetails map[string]string, tags map[string]string) bool {
+	found := false
+	for detail, tag := range ReleaseDetailTags {
+		if value, exists := tags[tag]; exists && value != "" {
+			releaseDetails[detail] = value
+			found = true
+		}
+	}
+
+	if versionStr := releaseDetails["Version"]; found && versionStr != "" {
+		if ver, err := ParseSemVer(versionStr); err == nil {
+			releaseDetails["Version"] = ver.String()
+		}
+	}
+
+	return found
 }
 
 func NewIndexEntry(cfg IndexConfig, o Object) (*IndexEntry, error) {
 	releaseDetails, err := cfg.KeyExtractions.ExtractReleaseDetails(o.Key())
 	if err != nil {
+		releaseDetails = make(map[string]string)
+	}
+
+	if !releaseDetailsFromTags(releaseDetails, o.Tags()) && err != nil {
 		return nil, err
 	}
 
-	if _, exists := releaseDetails["Version"]; !exists {
-		return nil, fmt.Errorf("failed to extract version")
+	// tags may only provide some details, so check the merged result
+	for _, detail := range requiredReleaseDetails {
+		if releaseDetails[detail] == "" {
+			return nil, fmt.Errorf("failed to extract %v", strings.ToLower(detail))
+		}
 	}
 
 	entry := &IndexEntry{
-		Arch:     releaseDetails["Arch"],
-		Filename: o.BaseName(),
-		Name:     releaseDetails["Product"],
-		Os:       releaseDetails["OS"],
-		Url:      filepath.Join("/", o.Key()),
-		Version:  releaseDetails["Version"],
+		Arch:         releaseDetails["Arch"],
+		Filename:     o.BaseName(),
+		Name:         releaseDetails["Product"],
+		Os:           releaseDetails["OS"],
+		Url:          filepath.Join("/", o.Key()),
+		Version:      releaseDetails["Version"],
+		ETag:         o.ETag(),
+		StorageClass: o.StorageClass(),
+
+		ContentType:    o.Metadata().ContentType,
+		ChecksumSHA256: o.Metadata().ChecksumSHA256,
+		ChecksumSHA1:   o.Metadata().ChecksumSHA1,
+		ChecksumCRC32:  o.Metadata().ChecksumCRC32,
+		ChecksumCRC32C: o.Metadata().ChecksumCRC32C,
+		Metadata:       o.Metadata().UserMetadata,
+		Tags:           o.Tags(),
 	}
 
 	return entry, nil
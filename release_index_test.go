@@ -62,6 +62,94 @@ func TestNewIndexEntry(t *testing.T) {
 	}
 }
 
+func TestNewIndexEntryFromTags(t *testing.T) {
+	obj := simpleObject("TestProduct/latest/installer.pkg")
+	obj.SetTags(map[string]string{
+		"Dioad/Project": "TestProduct",
+		"Dioad/Version": "v1.2",
+		"Dioad/OS":      "darwin",
+		"Dioad/Arch":    "arm64",
+	})
+
+	entry, err := NewIndexEntry(DioadIndexConfig, obj)
+	if err != nil {
+		t.Fatalf("NewIndexEntry() failed, %v", err)
+	}
+
+	assert.Equal(t, "TestProduct", entry.Name)
+	assert.Equal(t, "1.2.0", entry.Version)
+	assert.Equal(t, "darwin", entry.Os)
+	assert.Equal(t, "arm64", entry.Arch)
+}
+
+func TestNewIndexEntryTagsOverrideKey(t *testing.T) {
+	obj := simpleObject("TestProduct/1.0.0/TestProduct_linux_amd64.zip")
+	obj.SetTags(map[string]string{
+		"Dioad/Arch": "x86_64",
+	})
+
+	entry, err := NewIndexEntry(DioadIndexConfig, obj)
+	if err != nil {
+		t.Fatalf("NewIndexEntry() failed, %v", err)
+	}
+
+	assert.Equal(t, "x86_64", entry.Arch)
+	assert.Equal(t, "1.0.0", entry.Version)
+}
+
+func TestNewIndexEntryPartialTags(t *testing.T) {
+	tests := map[string]struct {
+		key     string
+		tags    map[string]string
+		name    string
+		version string
+		err     string
+	}{
+		"version tag without key details": {
+			key:  "TestProduct/latest/installer.pkg",
+			tags: map[string]string{"Dioad/Version": "1.2.0"},
+			err:  "failed to extract product",
+		},
+		"product tag without key details": {
+			key:  "TestProduct/latest/installer.pkg",
+			tags: map[string]string{"Dioad/Project": "TestProduct"},
+			err:  "failed to extract version",
+		},
+		"version tag falls back to key for product": {
+			key:     "TestProduct/1.0.0/TestProduct_linux_amd64.zip",
+			tags:    map[string]string{"Dioad/Version": "1.1.0"},
+			name:    "TestProduct",
+			version: "1.1.0",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			obj := simpleObject(tt.key)
+			obj.SetTags(tt.tags)
+
+			entry, err := NewIndexEntry(DioadIndexConfig, obj)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewIndexEntry() failed, %v", err)
+			}
+
+			assert.Equal(t, tt.name, entry.Name)
+			assert.Equal(t, tt.version, entry.Version)
+		})
+	}
+}
+
+func TestNewIndexEntryWithoutDetails(t *testing.T) {
+	_, err := NewIndexEntry(DioadIndexConfig, simpleObject("TestProduct/README.md"))
+	if err == nil {
+		t.Fatalf("NewIndexEntry() expected error")
+	}
+}
+
 func TestNewVersionIndex(t *testing.T) {
 	cfg := IndexConfig{
 		KeyExtractions: ReleaseDetailKeyExtractions{
@@ -1,16 +1,60 @@
 package main
 
 import (
+	"crypto/tls"
+	"net/http"
+
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-xray-sdk-go/xray"
 )
 
-func s3Session() *session.Session {
+// S3Options configures how S3 is reached so that S3 compatible stores such as
+// MinIO, Ceph or R2 can be used. They are applied to the session so cover
+// listing, template and static loading, and output.
+type S3Options struct {
+	// Endpoint overrides the default AWS endpoint resolution
+	Endpoint string
+	// Region overrides the region from the environment or shared config
+	Region string
+	// ForcePathStyle addresses buckets as endpoint/bucket rather than
+	// bucket.endpoint
+	ForcePathStyle bool
+	// InsecureSkipVerify disables TLS certificate verification
+	InsecureSkipVerify bool
+}
+
+func (o S3Options) awsConfig() aws.Config {
+	cfg := aws.Config{}
+
+	if o.Endpoint != "" {
+		cfg.Endpoint = aws.String(o.Endpoint)
+	}
+
+	if o.Region != "" {
+		cfg.Region = aws.String(o.Region)
+	}
+
+	if o.ForcePathStyle {
+		cfg.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	if o.InsecureSkipVerify {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		cfg.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	return cfg
+}
+
+func s3Session(opts S3Options) *session.Session {
 	sess := session.Must(
 		session.NewSessionWithOptions(
 			session.Options{
+				Config:            opts.awsConfig(),
 				SharedConfigState: session.SharedConfigEnable,
 			},
 		),
@@ -26,3 +70,72 @@ func s3Client(sess *session.Session) *s3.S3 {
 
 	return client
 }
+
+// RoleConfig is an IAM role to assume when accessing a location, such as a
+// bucket in another account.
+type RoleConfig struct {
+	RoleARN     string
+	ExternalID  string
+	SessionName string
+}
+
+// Sessions holds the session used for each location the generator reads from
+// or writes to, so each can use its own credentials.
+type Sessions struct {
+	// Source is used to list objects, read inventory reports and dump listings
+	Source *session.Session
+	// Template is used to load templates from TemplateBucketURL
+	Template *session.Session
+	// Static is used to load static files from StaticBucketURL
+	Static *session.Session
+	// Destination is used to write indexes and the enrichment cache
+	Destination *session.Session
+	// Lambda is used to reinvoke the function, with its own credentials
+	Lambda *session.Session
+}
+
+// NewSessions returns a session for each location, assuming the configured
+// role where there is one and otherwise sharing a single session built from
+// the S3 options.
+func NewSessions(cfg Config) *Sessions {
+	sess := s3Session(cfg.S3)
+
+	return &Sessions{
+		Source:      assumeRoleSession(sess, cfg.SourceRole),
+		Template:    assumeRoleSession(sess, cfg.TemplateRole),
+		Static:      assumeRoleSession(sess, cfg.StaticRole),
+		Destination: assumeRoleSession(sess, cfg.DestinationRole),
+		Lambda:      lambdaSession(sess),
+	}
+}
+
+// stsSession returns a copy of sess for calling STS. The S3 endpoint override
+// only applies to S3, so STS falls back to the default endpoint for the region.
+func stsSession(sess *session.Session) *session.Session {
+	return sess.Copy(&aws.Config{Endpoint: aws.String("")})
+}
+
+// lambdaSession returns a copy of sess for calling Lambda, which like STS uses
+// the default endpoint for the region rather than the S3 override.
+func lambdaSession(sess *session.Session) *session.Session {
+	return sess.Copy(&aws.Config{Endpoint: aws.String("")})
+}
+
+// assumeRoleSession returns a copy of sess using credentials for role, or
+// sess itself if no role is configured.
+func assumeRoleSession(sess *session.Session, role RoleConfig) *session.Session {
+	if role.RoleARN == "" {
+		return sess
+	}
+
+	creds := stscreds.NewCredentials(stsSession(sess), role.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+		if role.ExternalID != "" {
+			p.ExternalID = aws.String(role.ExternalID)
+		}
+		if role.SessionName != "" {
+			p.RoleSessionName = role.SessionName
+		}
+	})
+
+	return sess.Copy(&aws.Config{Credentials: creds})
+}
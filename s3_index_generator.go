@@ -29,8 +29,12 @@ var DioadIndexConfig = IndexConfig{
 }
 
 type ObjectTreeConfig struct {
-	PrefixToStrip string
-	Exclusions    Exclusions
+	PrefixToStrip    string
+	Exclusions       Exclusions
+	ObjectExclusions ObjectExclusions
+	// DirectoryExclusions are matched against the key prefix of a directory,
+	// such as data/internal/, to tell whether everything within it is excluded
+	DirectoryExclusions Exclusions
 }
 
 type Page struct {
@@ -68,7 +72,7 @@ type IndexRenderer struct {
 
 func JSONIndexRenderer(config IndexConfig) IndexRenderer {
 	return IndexRenderer{
-		IndexFile: "index.json",
+		IndexFile: JSONIndex.IndexFile(),
 		Render: func(stream io.Writer, objectTree *ObjectTree) error {
 			// New Index
 			index := IndexForObjectTree(config, objectTree)
@@ -82,7 +86,7 @@ func JSONIndexRenderer(config IndexConfig) IndexRenderer {
 
 func HTMLIndexRenderer(tmpl *template.Template, templateName string) IndexRenderer {
 	return IndexRenderer{
-		IndexFile: "index.html",
+		IndexFile: HTMLIndex.IndexFile(),
 		Render: func(stream io.Writer, objectTree *ObjectTree) error {
 			p := Page{
 				Nonce:      nonce(),
@@ -144,3 +148,29 @@ func RenderObjectTreeIndexes(objectTree *ObjectTree, renderers IndexRenderers, d
 
 	return objectTree.Walk(walker, recursive, true)
 }
+
+// RenderObjectTreeIndexesForPaths renders indexes for only the nodes at
+// paths, skipping any that don't exist within objectTree.
+func RenderObjectTreeIndexesForPaths(objectTree *ObjectTree, renderers IndexRenderers, destFS afero.Fs, paths []string) error {
+	return WalkObjectTreePaths(objectTree, RenderWalker(destFS, renderers), paths)
+}
+
+// WalkObjectTreePaths calls walker for the nodes at paths, skipping any that
+// don't exist within objectTree.
+func WalkObjectTreePaths(objectTree *ObjectTree, walker ObjectTreeWalker, paths []string) error {
+	errGroup := errgroup.Group{}
+	errGroup.SetLimit(10)
+
+	for _, p := range paths {
+		node := objectTree.Lookup(p)
+		if node == nil {
+			continue
+		}
+
+		errGroup.Go(func() error {
+			return walker(node)
+		})
+	}
+
+	return errGroup.Wait()
+}
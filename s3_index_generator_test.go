@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"embed"
+	"strings"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -39,6 +40,36 @@ func (b *testBucket) ListObjects(ctx context.Context, key string) ([]Object, err
 	}, nil
 }
 
+func TestHTMLIndexRenderer(t *testing.T) {
+	tmpl, err := loadTemplates(testTemplateFS)
+	if err != nil {
+		t.Fatalf("loadTemplates() error = %v", err)
+	}
+
+	tree := NewObjectTreeWithObjects(ObjectTreeConfig{}, []Object{
+		&object{obj: &s3.Object{
+			Key:          stringToPointer("a/fileA"),
+			ETag:         stringToPointer(`"etag"`),
+			StorageClass: stringToPointer("STANDARD_IA"),
+		}},
+		simpleObject("a/b/fileB"),
+	})
+
+	destFS := afero.NewMemMapFs()
+	err = RenderObjectTreeIndexes(tree, IndexRenderers{HTMLIndexRenderer(tmpl, "multipage.index.html.tmpl")}, destFS, true)
+	if err != nil {
+		t.Fatalf("RenderObjectTreeIndexes() error = %v", err)
+	}
+
+	content, err := afero.ReadFile(destFS, "/a/index.html")
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if !strings.Contains(string(content), "STANDARD_IA") {
+		t.Errorf("expected storage class in index, got %v", string(content))
+	}
+}
+
 //func TestCopyFile(t *testing.T) {
 //	srcFS := afero.NewMemMapFs()
 //	destFS := afero.NewMemMapFs()
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeS3Object is an object held by a fakeS3Server.
+type fakeS3Object struct {
+	content []byte
+	etag    string
+	header  http.Header
+}
+
+// fakeS3Server is a path style S3 endpoint holding objects in memory. It
+// answers GET, HEAD, PUT, CopyObject and DELETE for objects, returning the
+// metadata they were written with and honouring If-Match and If-None-Match on
+// PUT, and ListObjectsV2 for buckets. It counts the requests it receives by
+// method, with copies counted as COPY rather than PUT.
+type fakeS3Server struct {
+	*httptest.Server
+
+	t        *testing.T
+	mu       sync.Mutex
+	objects  map[string]fakeS3Object
+	requests map[string]int
+}
+
+// newFakeS3Server starts a fakeS3Server, closed when the test finishes.
+func newFakeS3Server(t *testing.T) *fakeS3Server {
+	s := &fakeS3Server{
+		t:        t,
+		objects:  make(map[string]fakeS3Object),
+		requests: make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// Options returns the S3Options for connecting to the server.
+func (s *fakeS3Server) Options() S3Options {
+	return S3Options{Endpoint: s.URL, Region: "us-east-1", ForcePathStyle: true}
+}
+
+// Session returns a session with static credentials for the server.
+func (s *fakeS3Server) Session() *session.Session {
+	sess := s3Session(s.Options())
+	sess.Config.Credentials = credentials.NewStaticCredentials("id", "secret", "")
+
+	return sess
+}
+
+// PutObject stores content at key in bucket without counting a request.
+func (s *fakeS3Server) PutObject(bucket string, key string, content []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.objects[bucket+"/"+key] = newFakeS3Object(content, http.Header{})
+}
+
+// Keys returns the keys held in bucket.
+func (s *fakeS3Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0)
+	for path := range s.objects {
+		if key, found := strings.CutPrefix(path, bucket+"/"); found {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Requests returns the number of requests received with method.
+func (s *fakeS3Server) Requests(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests[method]
+}
+
+func newFakeS3Object(content []byte, header http.Header) fakeS3Object {
+	return fakeS3Object{
+		content: content,
+		etag:    fmt.Sprintf(`"%x"`, sha256.Sum256(content)),
+		header:  header,
+	}
+}
+
+func (s *fakeS3Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	copySource := r.Header.Get("X-Amz-Copy-Source")
+	if copySource != "" && r.Method == http.MethodPut {
+		s.requests["COPY"]++
+	} else {
+		s.requests[r.Method]++
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key, _ := strings.Cut(path, "/")
+	if key == "" && r.Method == http.MethodGet {
+		s.listObjects(w, bucket, r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter"))
+		return
+	}
+
+	object, exists := s.objects[path]
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				fmt.Fprint(w, `<Error><Code>NoSuchKey</Code></Error>`)
+			}
+			return
+		}
+		for name, values := range object.header {
+			w.Header()[name] = values
+		}
+		w.Header().Set("ETag", object.etag)
+		w.Header().Set("Content-Length", fmt.Sprint(len(object.content)))
+		w.Header().Set("Last-Modified", "Sat, 01 Jun 2024 10:00:00 GMT")
+		if r.Method == http.MethodGet {
+			w.Write(object.content)
+		}
+	case http.MethodPut:
+		if copySource != "" {
+			source, err := url.PathUnescape(strings.TrimPrefix(copySource, "/"))
+			if err != nil {
+				s.t.Errorf("invalid copy source %v: %v", copySource, err)
+			}
+			object, exists = s.objects[source]
+			if !exists {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `<Error><Code>NoSuchKey</Code></Error>`)
+				return
+			}
+			s.objects[path] = object
+			fmt.Fprintf(w, `<CopyObjectResult><ETag>%v</ETag></CopyObjectResult>`, object.etag)
+			return
+		}
+		ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+		if (ifNoneMatch == "*" && exists) || (ifMatch != "" && (!exists || ifMatch != object.etag)) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			fmt.Fprint(w, `<Error><Code>PreconditionFailed</Code></Error>`)
+			return
+		}
+		content, _ := io.ReadAll(r.Body)
+		header := http.Header{}
+		for name, values := range r.Header {
+			if name == "Content-Type" || strings.HasPrefix(name, "X-Amz-Meta-") {
+				header[name] = values
+			}
+		}
+		object = newFakeS3Object(content, header)
+		s.objects[path] = object
+		w.Header().Set("ETag", object.etag)
+	case http.MethodDelete:
+		delete(s.objects, path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.t.Errorf("unexpected request %v %v", r.Method, r.URL)
+	}
+}
+
+// listObjects answers ListObjectsV2 with every key in bucket under prefix,
+// in a single page.
+func (s *fakeS3Server) listObjects(w http.ResponseWriter, bucket string, prefix string, delimiter string) {
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int64
+		StorageClass string
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	type listBucketResult struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Name           string
+		Prefix         string
+		KeyCount       int
+		IsTruncated    bool
+		Contents       []content
+		CommonPrefixes []commonPrefix
+	}
+
+	keys := make([]string, 0)
+	for path := range s.objects {
+		if key, found := strings.CutPrefix(path, bucket+"/"); found {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := listBucketResult{Name: bucket, Prefix: prefix}
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		rest, found := strings.CutPrefix(key, prefix)
+		if !found {
+			continue
+		}
+		if dir, _, nested := strings.Cut(rest, delimiter); nested && delimiter != "" {
+			if !seen[dir] {
+				seen[dir] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: prefix + dir + delimiter})
+			}
+			continue
+		}
+		object := s.objects[bucket+"/"+key]
+		result.Contents = append(result.Contents, content{
+			Key:          key,
+			LastModified: "2024-06-01T10:00:00.000Z",
+			ETag:         object.etag,
+			Size:         int64(len(object.content)),
+			StorageClass: "STANDARD",
+		})
+	}
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+
+	w.Header().Set("Content-Type", "application/xml")
+	err := xml.NewEncoder(w).Encode(result)
+	if err != nil {
+		s.t.Errorf("failed to encode listing: %v", err)
+	}
+}
+
+func TestS3OptionsAWSConfig(t *testing.T) {
+	cfg := S3Options{}.awsConfig()
+	assert.Nil(t, cfg.Endpoint)
+	assert.Nil(t, cfg.Region)
+	assert.Nil(t, cfg.S3ForcePathStyle)
+	assert.Nil(t, cfg.HTTPClient)
+
+	cfg = S3Options{
+		Endpoint:           "https://minio.example.com:9000",
+		Region:             "eu-west-2",
+		ForcePathStyle:     true,
+		InsecureSkipVerify: true,
+	}.awsConfig()
+	assert.Equal(t, "https://minio.example.com:9000", aws.StringValue(cfg.Endpoint))
+	assert.Equal(t, "eu-west-2", aws.StringValue(cfg.Region))
+	assert.True(t, aws.BoolValue(cfg.S3ForcePathStyle))
+	assert.NotNil(t, cfg.HTTPClient)
+}
+
+func TestS3SessionEndpoint(t *testing.T) {
+	sess := s3Session(S3Options{
+		Endpoint:       "http://localhost:9000",
+		Region:         "us-east-1",
+		ForcePathStyle: true,
+	})
+
+	client := s3Client(sess)
+	assert.Equal(t, "http://localhost:9000", client.Endpoint)
+	assert.True(t, aws.BoolValue(client.Config.S3ForcePathStyle))
+}
+
+func TestNewSessions(t *testing.T) {
+	sessions := NewSessions(Config{
+		S3: S3Options{Region: "eu-west-2"},
+		TemplateRole: RoleConfig{
+			RoleARN:     "arn:aws:iam::123456789012:role/templates",
+			ExternalID:  "external-id",
+			SessionName: "s3-index-generator",
+		},
+	})
+
+	// locations without a role share a session
+	assert.Same(t, sessions.Source, sessions.Static)
+	assert.Same(t, sessions.Source, sessions.Destination)
+
+	assert.NotSame(t, sessions.Source, sessions.Template)
+	assert.NotSame(t, sessions.Source.Config.Credentials, sessions.Template.Config.Credentials)
+	assert.Equal(t, "eu-west-2", aws.StringValue(sessions.Template.Config.Region))
+}
+
+func TestSTSSessionEndpoint(t *testing.T) {
+	sess := s3Session(S3Options{
+		Endpoint: "http://localhost:9000",
+		Region:   "eu-west-2",
+	})
+
+	client := sts.New(stsSession(sess))
+	assert.NotEqual(t, "http://localhost:9000", client.Endpoint)
+	assert.Contains(t, client.Endpoint, "sts.")
+
+	// the S3 session keeps the override
+	assert.Equal(t, "http://localhost:9000", s3Client(sess).Endpoint)
+
+	// the Lambda session used to reinvoke the function drops it, as STS does
+	sessions := NewSessions(Config{S3: S3Options{Endpoint: "http://localhost:9000", Region: "eu-west-2"}})
+	assert.Equal(t, "", aws.StringValue(sessions.Lambda.Config.Endpoint))
+	assert.Equal(t, "eu-west-2", aws.StringValue(sessions.Lambda.Config.Region))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/afero/mem"
+)
+
+// WriteStats counts the files written to, and skipped by, a SkipUnchangedFs.
+type WriteStats struct {
+	Written int64
+	Skipped int64
+}
+
+// HashedFs is implemented by outputs that can store a hash of each file's
+// content alongside it, so that unchanged files can be found without reading
+// them back.
+type HashedFs interface {
+	// ReadFileHash returns the hash stored with name, which is empty if it
+	// was written without one, or fs.ErrNotExist if there isn't one
+	ReadFileHash(name string) (string, error)
+	// WriteFileWithHash writes data to name, storing hash alongside it
+	WriteFileWithHash(name string, data []byte, hash string) error
+}
+
+// SkipUnchangedFs is an afero.Fs that buffers each file opened for writing
+// and, when it's closed, only writes it to the underlying Fs if its content
+// differs from the existing file. Nonces are ignored when comparing, so
+// re-rendering an unchanged index doesn't rewrite it. If the underlying Fs is
+// a HashedFs the stored hash is compared instead of the existing content.
+type SkipUnchangedFs struct {
+	afero.Fs
+
+	written atomic.Int64
+	skipped atomic.Int64
+}
+
+func NewSkipUnchangedFs(fs afero.Fs) *SkipUnchangedFs {
+	return &SkipUnchangedFs{Fs: fs}
+}
+
+// Stats returns the number of files written and skipped so far.
+func (s *SkipUnchangedFs) Stats() WriteStats {
+	return WriteStats{
+		Written: s.written.Load(),
+		Skipped: s.skipped.Load(),
+	}
+}
+
+func (s *SkipUnchangedFs) Create(name string) (afero.File, error) {
+	return s.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (s *SkipUnchangedFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	// appends depend on the existing content so are passed straight through
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 || flag&os.O_APPEND != 0 {
+		return s.Fs.OpenFile(name, flag, perm)
+	}
+
+	return &skipUnchangedFile{
+		File: mem.NewFileHandle(mem.CreateFile(name)),
+		fs:   s,
+		name: name,
+		flag: flag,
+		perm: perm,
+	}, nil
+}
+
+// write writes content to name unless the existing file has the same content.
+func (s *SkipUnchangedFs) write(name string, flag int, perm os.FileMode, content []byte) error {
+	if hashed, ok := s.Fs.(HashedFs); ok {
+		return s.writeHashed(hashed, name, content)
+	}
+
+	existing, err := afero.ReadFile(s.Fs, name)
+	if err == nil && bytes.Equal(withoutNonce(existing), withoutNonce(content)) {
+		s.skipped.Add(1)
+		return nil
+	}
+
+	f, err := s.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(content)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	s.written.Add(1)
+	return nil
+}
+
+// writeHashed writes content to name unless the hash stored with the existing
+// file matches it. Files written without a hash are rewritten once to store
+// one.
+func (s *SkipUnchangedFs) writeHashed(hashed HashedFs, name string, content []byte) error {
+	hash := contentVersion(withoutNonce(content))
+
+	existing, err := hashed.ReadFileHash(name)
+	if err == nil && existing == hash {
+		s.skipped.Add(1)
+		return nil
+	}
+
+	err = hashed.WriteFileWithHash(name, content, hash)
+	if err != nil {
+		return err
+	}
+
+	s.written.Add(1)
+	return nil
+}
+
+// skipUnchangedFile buffers writes in memory until it's closed.
+type skipUnchangedFile struct {
+	*mem.File
+
+	fs   *SkipUnchangedFs
+	name string
+	flag int
+	perm os.FileMode
+}
+
+func (f *skipUnchangedFile) Name() string {
+	return f.name
+}
+
+func (f *skipUnchangedFile) Close() error {
+	_, err := f.File.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	content, err := io.ReadAll(f.File)
+	if err != nil {
+		return err
+	}
+
+	err = f.File.Close()
+	if err != nil {
+		return err
+	}
+
+	return f.fs.write(f.name, f.flag, f.perm, content)
+}
+
+// writeIndexes runs index against outputFS, skipping files whose content
+// hasn't changed if cfg.SkipUnchanged is set.
+func writeIndexes(cfg Config, outputFS afero.Fs, index func(cfg Config, outputFS afero.Fs) error) error {
+	if !cfg.SkipUnchanged {
+		return index(cfg, outputFS)
+	}
+
+	skipFS := NewSkipUnchangedFs(outputFS)
+	err := index(cfg, skipFS)
+
+	stats := skipFS.Stats()
+	log.Printf("SkipUnchanged: written:%d skipped:%d\n", stats.Written, stats.Skipped)
+
+	return err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkipUnchangedFs(t *testing.T) {
+	baseFS := NewMemoryOutputFS()
+	afero.WriteFile(baseFS, "/a/index.html", []byte("nonce-AAAAAAAA same"), 0644)
+	afero.WriteFile(baseFS, "/a/index.json", []byte("older"), 0644)
+
+	skipFS := NewSkipUnchangedFs(baseFS)
+	assert.NoError(t, afero.WriteFile(skipFS, "/a/index.html", []byte("nonce-BBBBBBBB same"), 0644))
+	assert.NoError(t, afero.WriteFile(skipFS, "/a/index.json", []byte("new"), 0644))
+	assert.NoError(t, afero.WriteFile(skipFS, "/b/index.json", []byte("created"), 0644))
+
+	assert.Equal(t, WriteStats{Written: 2, Skipped: 1}, skipFS.Stats())
+
+	content, _ := afero.ReadFile(baseFS, "/a/index.html")
+	assert.Equal(t, "nonce-AAAAAAAA same", string(content))
+	content, _ = afero.ReadFile(baseFS, "/a/index.json")
+	assert.Equal(t, "new", string(content))
+	content, _ = afero.ReadFile(baseFS, "/b/index.json")
+	assert.Equal(t, "created", string(content))
+}
+
+func TestSkipUnchangedFsRerender(t *testing.T) {
+	tmpl, err := loadTemplates(testTemplateFS)
+	if err != nil {
+		t.Fatalf("loadTemplates() error = %v", err)
+	}
+
+	renderers := IndexRenderers{
+		HTMLIndexRenderer(tmpl, "multipage.index.html.tmpl"),
+		JSONIndexRenderer(DioadIndexConfig),
+	}
+
+	baseFS := NewMemoryOutputFS()
+	err = RenderObjectTreeIndexes(sampleObjectTree(), renderers, baseFS, true)
+	if err != nil {
+		t.Fatalf("RenderObjectTreeIndexes() error = %v", err)
+	}
+
+	skipFS := NewSkipUnchangedFs(baseFS)
+	err = RenderObjectTreeIndexes(sampleObjectTree(), renderers, skipFS, true)
+	if err != nil {
+		t.Fatalf("RenderObjectTreeIndexes() error = %v", err)
+	}
+
+	stats := skipFS.Stats()
+	assert.Equal(t, int64(0), stats.Written)
+	assert.Equal(t, int64(6), stats.Skipped)
+}
+
+func TestSkipUnchangedFsContentHash(t *testing.T) {
+	server := newFakeS3Server(t)
+	outputFS := NewS3OutputFS(server.Session(), "bucket-a", "site", aws.String(""))
+
+	skipFS := NewSkipUnchangedFs(outputFS)
+	assert.NoError(t, afero.WriteFile(skipFS, "/a/index.html", []byte("nonce-AAAAAAAA same"), 0644))
+	assert.Equal(t, WriteStats{Written: 1, Skipped: 0}, skipFS.Stats())
+
+	// only the stored hash is compared, the existing index is never fetched
+	skipFS = NewSkipUnchangedFs(outputFS)
+	assert.NoError(t, afero.WriteFile(skipFS, "/a/index.html", []byte("nonce-BBBBBBBB same"), 0644))
+	assert.NoError(t, afero.WriteFile(skipFS, "/b/index.html", []byte("created"), 0644))
+	assert.Equal(t, WriteStats{Written: 1, Skipped: 1}, skipFS.Stats())
+	assert.Equal(t, 2, server.Requests(http.MethodPut))
+	assert.Equal(t, 0, server.Requests(http.MethodGet))
+
+	// the generation guard keeps the output hashed
+	_, hashed := guardGeneration(outputFS, newGeneration()).(HashedFs)
+	assert.True(t, hashed)
+	_, hashed = guardGeneration(NewMemoryOutputFS(), newGeneration()).(HashedFs)
+	assert.False(t, hashed)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// BatchSummary is the response to an SQS event. BatchItemFailures lists the
+// messages to be retried, in the form Lambda expects for partial batch
+// responses.
+type BatchSummary struct {
+	*EventSummary
+	Messages          int                          `json:"messages"`
+	BatchItemFailures []events.SQSBatchItemFailure `json:"batchItemFailures"`
+}
+
+// sqsMessageBody is the part of an SQS message body needed to tell an SNS
+// notification or an S3 test event from the events that carry records.
+type sqsMessageBody struct {
+	Type    string `json:"Type"`
+	Message string `json:"Message"`
+	Event   string `json:"Event"`
+}
+
+// s3EventFromMessage parses body as an S3 event notification or an S3 event
+// forwarded by EventBridge, unwrapping it first if it was delivered through
+// SNS. The test event S3 sends when notifications are configured has no
+// records; any other body without records is an error so the message isn't
+// lost.
+func s3EventFromMessage(body string) (events.S3Event, error) {
+	message := sqsMessageBody{}
+	err := json.Unmarshal([]byte(body), &message)
+	if err != nil {
+		return events.S3Event{}, err
+	}
+
+	if message.Type == "Notification" && message.Message != "" {
+		return s3EventFromMessage(message.Message)
+	}
+
+	if message.Event == "s3:TestEvent" {
+		return events.S3Event{Records: make([]events.S3EventRecord, 0)}, nil
+	}
+
+	event, err := s3EventFromPayload([]byte(body))
+	if err != nil {
+		return event, err
+	}
+
+	if len(event.Records) == 0 {
+		return event, fmt.Errorf("message has no S3 records")
+	}
+
+	return event, nil
+}
+
+// handleSQSEvent unwraps the S3 event notifications, or S3 events forwarded
+// by EventBridge, in the messages of event and handles them as a single S3
+// event, so that a batch of changes results in one regeneration per job.
+// Messages published to SNS are unwrapped first. A message is reported as
+// failed if it can't be parsed, has no records and isn't an S3 test event, or
+// any regeneration covering one of its records failed.
+func handleSQSEvent(ctx context.Context, jobs []Config, event events.SQSEvent, regenerate RegenerateFunc) (*BatchSummary, error) {
+	s3Event := events.S3Event{Records: make([]events.S3EventRecord, 0)}
+	recordMessages := make([]string, 0)
+	failed := make(map[string]bool)
+
+	log.Printf("messages length: %d\n", len(event.Records))
+
+	for _, message := range event.Records {
+		messageEvent, err := s3EventFromMessage(message.Body)
+		if err != nil {
+			log.Printf("failed to parse message: id:%v err:%v\n", message.MessageId, err)
+			failed[message.MessageId] = true
+			continue
+		}
+
+		for _, record := range messageEvent.Records {
+			s3Event.Records = append(s3Event.Records, record)
+			recordMessages = append(recordMessages, message.MessageId)
+		}
+	}
+
+	summary, err := handleS3Event(ctx, jobs, s3Event, regenerate)
+	if err != nil {
+		log.Printf("failed to regenerate: %v\n", err)
+
+		for i, record := range s3Event.Records {
+			for _, target := range summary.Regenerated {
+				if target.Error != "" && target.Bucket == record.S3.Bucket.Name && slices.Contains(target.Keys, recordKey(record)) {
+					failed[recordMessages[i]] = true
+				}
+			}
+		}
+	}
+
+	batch := &BatchSummary{
+		EventSummary:      summary,
+		Messages:          len(event.Records),
+		BatchItemFailures: make([]events.SQSBatchItemFailure, 0),
+	}
+	for _, message := range event.Records {
+		if failed[message.MessageId] {
+			batch.BatchItemFailures = append(batch.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: message.MessageId})
+		}
+	}
+
+	// failures are reported per message so the batch isn't retried as a whole
+	return batch, nil
+}
+
+// SyntheticS3Event returns an S3 event with a record named eventName for each
+// of keys in bucket, as S3 would send it.
+func SyntheticS3Event(bucket string, eventName string, keys []string) events.S3Event {
+	eventTime := time.Now().UTC()
+
+	event := events.S3Event{Records: make([]events.S3EventRecord, 0, len(keys))}
+	for _, key := range keys {
+		event.Records = append(event.Records, events.S3EventRecord{
+			EventVersion: "2.1",
+			EventSource:  "aws:s3",
+			EventTime:    eventTime,
+			EventName:    eventName,
+			S3: events.S3Entity{
+				Bucket: events.S3Bucket{Name: bucket, Arn: fmt.Sprintf("arn:aws:s3:::%v", bucket)},
+				Object: events.S3Object{
+					Key:           strings.ReplaceAll(url.QueryEscape(key), "%2F", "/"),
+					URLDecodedKey: key,
+				},
+			},
+		})
+	}
+
+	return event
+}
+
+// SyntheticSQSEvent returns an SQS event with one message wrapping each
+// record of event, as delivered by an S3 notification to an SQS queue.
+func SyntheticSQSEvent(event events.S3Event) (events.SQSEvent, error) {
+	sqsEvent := events.SQSEvent{Records: make([]events.SQSMessage, 0, len(event.Records))}
+	for i, record := range event.Records {
+		body, err := json.Marshal(events.S3Event{Records: []events.S3EventRecord{record}})
+		if err != nil {
+			return sqsEvent, err
+		}
+
+		sqsEvent.Records = append(sqsEvent.Records, events.SQSMessage{
+			MessageId:   fmt.Sprintf("message-%d", i),
+			Body:        string(body),
+			EventSource: "aws:sqs",
+		})
+	}
+
+	return sqsEvent, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleSQSEventCoalescesBatch(t *testing.T) {
+	cfg := Config{ObjectPrefix: "data"}
+
+	sqsEvent, err := SyntheticSQSEvent(SyntheticS3Event("bucket-a", "ObjectCreated:Put", []string{
+		"data/product/1.0.0/product_linux_amd64.zip",
+		"data/product/1.0.0/product_linux_arm64.zip",
+		"data/product/1.0.0/product_SHA256SUMS",
+	}))
+	if err != nil {
+		t.Fatalf("SyntheticSQSEvent() error = %v", err)
+	}
+	sqsEvent.Records = append(sqsEvent.Records,
+		events.SQSMessage{MessageId: "test-event", Body: `{"Service":"Amazon S3","Event":"s3:TestEvent","Bucket":"bucket-a"}`},
+		events.SQSMessage{MessageId: "malformed", Body: `not json`},
+	)
+
+	calls := make([]regenerateCall, 0)
+	summary, err := handleSQSEvent(context.Background(), []Config{cfg}, sqsEvent, recordingRegenerate(&calls, nil))
+	if err != nil {
+		t.Fatalf("handleSQSEvent() error = %v", err)
+	}
+
+	assert.Equal(t, []regenerateCall{
+		{bucket: "bucket-a", keys: []string{
+			"data/product/1.0.0/product_linux_amd64.zip",
+			"data/product/1.0.0/product_linux_arm64.zip",
+			"data/product/1.0.0/product_SHA256SUMS",
+		}},
+	}, calls)
+
+	assert.Equal(t, 5, summary.Messages)
+	assert.Equal(t, 3, summary.Records)
+	assert.Equal(t, []events.SQSBatchItemFailure{{ItemIdentifier: "malformed"}}, summary.BatchItemFailures)
+}
+
+func TestHandleSQSEventPartialFailure(t *testing.T) {
+	jobs := []Config{{Name: "a", Bucket: "bucket-a"}, {Name: "b", Bucket: "bucket-b"}}
+
+	sqsEvent := events.SQSEvent{}
+	for i, bucket := range []string{"bucket-a", "bucket-b", "bucket-a"} {
+		s3Event, err := SyntheticSQSEvent(SyntheticS3Event(bucket, "ObjectCreated:Put", []string{"file.zip"}))
+		if err != nil {
+			t.Fatalf("SyntheticSQSEvent() error = %v", err)
+		}
+		message := s3Event.Records[0]
+		message.MessageId = []string{"a-1", "b-1", "a-2"}[i]
+		sqsEvent.Records = append(sqsEvent.Records, message)
+	}
+
+	regenerate := func(ctx context.Context, cfg Config, keys []string) error {
+		if cfg.Bucket == "bucket-b" {
+			return errors.New("boom")
+		}
+		return nil
+	}
+
+	summary, err := handleSQSEvent(context.Background(), jobs, sqsEvent, regenerate)
+	if err != nil {
+		t.Fatalf("handleSQSEvent() error = %v", err)
+	}
+
+	assert.Equal(t, []events.SQSBatchItemFailure{{ItemIdentifier: "b-1"}}, summary.BatchItemFailures)
+
+	encoded, err := json.Marshal(summary)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	assert.Contains(t, string(encoded), `"batchItemFailures":[{"itemIdentifier":"b-1"}]`)
+	assert.Contains(t, string(encoded), `"records":3`)
+}
+
+func TestHandleSQSEventMessageBodies(t *testing.T) {
+	cfg := Config{ObjectPrefix: "data"}
+
+	s3Body, err := json.Marshal(SyntheticS3Event("bucket-a", "ObjectCreated:Put", []string{"data/product/1.0.0/product_linux_amd64.zip"}))
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	snsBody, err := json.Marshal(map[string]string{"Type": "Notification", "Message": string(s3Body)})
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	snsTestBody, err := json.Marshal(map[string]string{"Type": "Notification", "Message": `{"Service":"Amazon S3","Event":"s3:TestEvent","Bucket":"bucket-a"}`})
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+
+	sqsEvent := events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "sns", Body: string(snsBody)},
+		{MessageId: "sns-test-event", Body: string(snsTestBody)},
+		{MessageId: "scheduled", Body: `{"source":"aws.events","detail-type":"Scheduled Event","detail":{}}`},
+		{MessageId: "empty", Body: `{}`},
+	}}
+
+	calls := make([]regenerateCall, 0)
+	summary, err := handleSQSEvent(context.Background(), []Config{cfg}, sqsEvent, recordingRegenerate(&calls, nil))
+	if err != nil {
+		t.Fatalf("handleSQSEvent() error = %v", err)
+	}
+
+	assert.Equal(t, []regenerateCall{
+		{bucket: "bucket-a", keys: []string{"data/product/1.0.0/product_linux_amd64.zip"}},
+	}, calls)
+	assert.Equal(t, []events.SQSBatchItemFailure{{ItemIdentifier: "scheduled"}, {ItemIdentifier: "empty"}}, summary.BatchItemFailures)
+}
+
+func TestSyntheticS3EventKeys(t *testing.T) {
+	key := "data/product name/1.0.0/product+extra_linux.zip"
+
+	encoded, err := json.Marshal(SyntheticS3Event("bucket-a", "ObjectCreated:Put", []string{key}))
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+
+	decoded := events.S3Event{}
+	err = json.Unmarshal(encoded, &decoded)
+	if err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+
+	assert.Equal(t, "data/product+name/1.0.0/product%2Bextra_linux.zip", decoded.Records[0].S3.Object.Key)
+	assert.Equal(t, key, recordKey(decoded.Records[0]))
+}
+
+func TestEventSource(t *testing.T) {
+	tests := map[string]struct {
+		payload  string
+		expected string
+	}{
+		"s3":    {payload: `{"Records":[{"eventSource":"aws:s3"}]}`, expected: "aws:s3"},
+		"sqs":   {payload: `{"Records":[{"eventSource":"aws:sqs"}]}`, expected: "aws:sqs"},
+		"empty": {payload: `{"Records":[]}`, expected: ""},
+		"other": {payload: `{"detail-type":"Scheduled Event"}`, expected: ""},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			source, err := eventSource(json.RawMessage(tt.payload))
+			if err != nil {
+				t.Fatalf("eventSource() error = %v", err)
+			}
+			assert.Equal(t, tt.expected, source)
+		})
+	}
+}
@@ -1,16 +1,24 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"io/fs"
+	"mime"
+	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"strings"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	aferos3 "github.com/fclairamb/afero-s3"
 	"github.com/spf13/afero"
 )
@@ -139,7 +147,145 @@ func NewS3OutputFS(sess *session.Session, bucketName string, prefix string, serv
 		s = sp
 	}
 
-	return s
+	return &S3OutputFs{
+		Fs:        s,
+		client:    s3Client(sess),
+		bucket:    bucketName,
+		prefix:    prefix,
+		fileProps: fileProps,
+	}
+}
+
+// S3OutputFs is an S3 output, which also knows the bucket and prefix it
+// writes to so that files can be read and written by version.
+type S3OutputFs struct {
+	afero.Fs
+
+	client    *s3.S3
+	bucket    string
+	prefix    string
+	fileProps *aferos3.UploadedFileProperties
+}
+
+func (o *S3OutputFs) key(name string) string {
+	return strings.TrimPrefix(path.Join("/", o.prefix, name), "/")
+}
+
+// ReadFileVersion returns the content of name along with its ETag.
+func (o *S3OutputFs) ReadFileVersion(name string) ([]byte, string, error) {
+	output, err := o.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(o.bucket),
+		Key:    aws.String(o.key(name)),
+	})
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, "", fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer output.Body.Close()
+
+	content, err := io.ReadAll(output.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return content, aws.StringValue(output.ETag), nil
+}
+
+// WriteFileIfVersion writes name with If-Match set to version, or with
+// If-None-Match if version is empty, so that S3 rejects the write if another
+// has happened since name was read.
+func (o *S3OutputFs) WriteFileIfVersion(name string, data []byte, version string) error {
+	req, _ := o.client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:               aws.String(o.bucket),
+		Key:                  aws.String(o.key(name)),
+		Body:                 bytes.NewReader(data),
+		CacheControl:         o.fileProps.CacheControl,
+		ServerSideEncryption: o.fileProps.ServerSideEncryption,
+		BucketKeyEnabled:     o.fileProps.BucketKeyEnabled,
+	})
+	if version == "" {
+		req.HTTPRequest.Header.Set("If-None-Match", "*")
+	} else {
+		req.HTTPRequest.Header.Set("If-Match", version)
+	}
+
+	err := req.Send()
+	var requestErr awserr.RequestFailure
+	if errors.As(err, &requestErr) && (requestErr.StatusCode() == http.StatusPreconditionFailed || requestErr.StatusCode() == http.StatusConflict) {
+		return fmt.Errorf("%w: %v", errVersionMismatch, name)
+	}
+
+	return err
+}
+
+// contentHashMetadata is the object metadata holding the hash of a file's
+// content without nonces, so SkipUnchangedFs can compare it with a HEAD
+// request rather than fetching the file.
+const contentHashMetadata = "Content-Hash"
+
+// ReadFileHash returns the content hash stored in the metadata of name, which
+// is empty if it was written without one.
+func (o *S3OutputFs) ReadFileHash(name string) (string, error) {
+	output, err := o.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(o.bucket),
+		Key:    aws.String(o.key(name)),
+	})
+	var requestErr awserr.RequestFailure
+	if errors.As(err, &requestErr) && requestErr.StatusCode() == http.StatusNotFound {
+		return "", fs.ErrNotExist
+	}
+	if err != nil {
+		return "", err
+	}
+
+	for key, value := range output.Metadata {
+		if strings.EqualFold(key, contentHashMetadata) {
+			return aws.StringValue(value), nil
+		}
+	}
+
+	return "", nil
+}
+
+// WriteFileWithHash writes name with hash stored in its metadata.
+func (o *S3OutputFs) WriteFileWithHash(name string, data []byte, hash string) error {
+	contentType := o.fileProps.ContentType
+	if contentType == nil {
+		contentType = aws.String(mime.TypeByExtension(path.Ext(name)))
+	}
+
+	_, err := o.client.PutObject(&s3.PutObjectInput{
+		Bucket:               aws.String(o.bucket),
+		Key:                  aws.String(o.key(name)),
+		Body:                 bytes.NewReader(data),
+		CacheControl:         o.fileProps.CacheControl,
+		ContentType:          contentType,
+		ServerSideEncryption: o.fileProps.ServerSideEncryption,
+		BucketKeyEnabled:     o.fileProps.BucketKeyEnabled,
+		Metadata:             map[string]*string{contentHashMetadata: aws.String(hash)},
+	})
+
+	return err
+}
+
+// CopyFile copies src to dst with a server side copy, keeping the metadata,
+// including the content hash, that src was written with.
+func (o *S3OutputFs) CopyFile(src string, dst string) error {
+	copySource := url.URL{Path: path.Join(o.bucket, o.key(src))}
+
+	_, err := o.client.CopyObject(&s3.CopyObjectInput{
+		Bucket:               aws.String(o.bucket),
+		Key:                  aws.String(o.key(dst)),
+		CopySource:           aws.String(copySource.EscapedPath()),
+		MetadataDirective:    aws.String(s3.MetadataDirectiveCopy),
+		ServerSideEncryption: o.fileProps.ServerSideEncryption,
+		BucketKeyEnabled:     o.fileProps.BucketKeyEnabled,
+	})
+
+	return err
 }
 
 func LoadTemplates(sess *session.Session, templateBucketURL *url.URL) (*template.Template, error) {
@@ -170,3 +316,51 @@ func CopyStaticFiles(sess *session.Session, destFS afero.Fs, staticBucketURL *ur
 
 	return nil
 }
+
+// sampleObjectTree is a small release tree used to check that templates
+// render.
+func sampleObjectTree() *ObjectTree {
+	lastModified := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+	size := int64(1024)
+
+	objects := make([]Object, 0)
+	for _, key := range []string{
+		"product/1.0.0/product_1.0.0_linux_amd64.zip",
+		"product/1.0.0/product_1.0.0_darwin_arm64.zip",
+		"product/1.0.0/product_1.0.0_SHA256SUMS",
+		"README.txt",
+	} {
+		key := key
+		objects = append(objects, NewObjectWithTags(&s3.Object{
+			Key:          &key,
+			Size:         &size,
+			LastModified: &lastModified,
+		}, map[string]string{}))
+	}
+
+	return NewObjectTreeWithObjects(ObjectTreeConfig{}, objects)
+}
+
+// ValidateTemplates checks that tmpl defines templateName and that it renders
+// a sample tree, recursively unless recursive is false as for a single page
+// index.
+func ValidateTemplates(tmpl *template.Template, templateName string, recursive bool) error {
+	if tmpl.Lookup(templateName) == nil {
+		return fmt.Errorf("template %v is not defined, found %v", templateName, tmpl.DefinedTemplates())
+	}
+
+	renderers := IndexRenderers{HTMLIndexRenderer(tmpl, templateName)}
+	err := RenderObjectTreeIndexes(sampleObjectTree(), renderers, afero.NewMemMapFs(), recursive)
+	if err != nil {
+		return fmt.Errorf("template %v failed to render: %w", templateName, err)
+	}
+
+	return nil
+}
+
+// NewMemoryOutputFS returns an in-memory output. MemMapFs treats relative and
+// absolute paths as different files, so paths are rooted to match how
+// RenderWalker and CopyStaticFiles address the output.
+func NewMemoryOutputFS() afero.Fs {
+	return afero.NewBasePathFs(afero.NewMemMapFs(), "/")
+}